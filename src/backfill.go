@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ./app backfill copies the MySQL carts/cart_items into the DynamoDB
+// shopping_carts table, keeping cart IDs, for the move to DB_BACKEND=dynamodb:
+//
+//	./app backfill [-from ID] [-batch N] [-overwrite]
+//
+// Run it while the service is in DB_BACKEND=dualwrite, so carts that change
+// during or after the copy are mirrored too. It is safe to re-run: by default a
+// cart already in DynamoDB is left alone (the mirror keeps it current), and
+// -overwrite copies it again from MySQL. Orders, payments and the other tables
+// are not copied. It needs both the MySQL (DB_*) and DynamoDB environments.
+
+const backfillUsage = "usage: app backfill [-from ID] [-batch N] [-overwrite]"
+
+// runBackfill is the backfill subcommand; args follow "backfill"
+func runBackfill(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := fs.Int("from", 0, "copy carts with a cart_id above this one (resume after an interrupted run)")
+	batch := fs.Int("batch", 500, "carts read from MySQL per query")
+	overwrite := fs.Bool("overwrite", false, "copy carts that are already in DynamoDB again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *batch < 1 {
+		return errors.New(backfillUsage)
+	}
+
+	mysql, err := initMySQL()
+	if err != nil {
+		return err
+	}
+	ddb, err := initDynamoDB()
+	if err != nil {
+		return fmt.Errorf("init DynamoDB: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return backfillCarts(ctx, mysql, ddb, *from, *batch, *overwrite, stdout)
+}
+
+func backfillCarts(ctx context.Context, mysql *MySQLStore, ddb *DynamoDBClient, after, batch int, overwrite bool, stdout io.Writer) error {
+	var copied, present, failed int
+	for {
+		ids, err := mysqlCartIDsAfter(ctx, mysql, after, batch)
+		if err != nil {
+			return fmt.Errorf("list carts after %d: %w", after, err)
+		}
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return fmt.Errorf("interrupted after cart %d (resume with -from %d): %w", after, after, ctx.Err())
+			}
+			created, err := backfillCart(ctx, mysql, ddb, id, overwrite)
+			switch {
+			case err != nil:
+				failed++
+				fmt.Fprintf(stdout, "cart %d: %v\n", id, err)
+			case created:
+				copied++
+			default:
+				present++
+			}
+			after = id
+		}
+		fmt.Fprintf(stdout, "up to cart %d: %d copied, %d already in dynamodb, %d failed\n", after, copied, present, failed)
+		if len(ids) < batch {
+			break
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d cart(s) not copied", failed)
+	}
+	return nil
+}
+
+// backfillCart copies one cart and reports whether it wrote it
+func backfillCart(ctx context.Context, mysql *MySQLStore, ddb *DynamoDBClient, id int, overwrite bool) (bool, error) {
+	cartID := fmt.Sprint(id)
+	c, err := mysql.GetCart(ctx, cartID)
+	if errors.Is(err, ErrCartNotFound) {
+		return false, nil // deleted since it was listed
+	}
+	if err != nil {
+		return false, fmt.Errorf("mysql: %w", err)
+	}
+	if err := mapProjectedCart(ctx, mysql, cartID); err != nil {
+		return false, fmt.Errorf("mysql: %w", err)
+	}
+	if overwrite {
+		if err := ddb.PutCart(ctx, c); err != nil {
+			return false, fmt.Errorf("dynamodb: %w", err)
+		}
+		return true, nil
+	}
+	created, err := ddb.ImportCart(ctx, c)
+	if err != nil {
+		return false, fmt.Errorf("dynamodb: %w", err)
+	}
+	return created, nil
+}
+
+// IDs of the carts to copy, in order. Carts the projector made from DynamoDB
+// carts with other IDs are skipped: DynamoDB has them already.
+func mysqlCartIDsAfter(ctx context.Context, s *MySQLStore, after, limit int) ([]int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT c.cart_id FROM carts c
+		LEFT JOIN cart_projection p ON p.cart_id = c.cart_id AND p.source_cart_id <> CAST(c.cart_id AS CHAR)
+		WHERE c.cart_id > ? AND p.cart_id IS NULL
+		ORDER BY c.cart_id LIMIT ?
+	`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
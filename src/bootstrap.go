@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The DynamoDB tables are normally created by terraform. The bootstrap makes
+// the service check them, or create them where they are missing (DynamoDB
+// Local and other stand-ins start out empty):
+//
+//	DYNAMODB_BOOTSTRAP=off     (default) trust the tables as they are
+//	DYNAMODB_BOOTSTRAP=check   fail at startup unless every configured table
+//	                           and index exists with the keys the code expects
+//	DYNAMODB_BOOTSTRAP=create  create missing tables and indexes, then check
+//
+// ./app dynamodb-bootstrap [-check] does the same once, without the service.
+// Only the tables whose DYNAMODB_*_TABLE_NAME is set are touched. Created
+// tables are on-demand; a key schema mismatch is reported, never "fixed".
+
+// Longest wait for created tables and indexes to become ACTIVE
+const dynamoBootstrapTimeout = 10 * time.Minute
+
+// dynamoKey is a key attribute: its name and scalar type
+type dynamoKey struct {
+	Name string
+	Type types.ScalarAttributeType
+}
+
+// dynamoIndexSpec is a global secondary index the code queries (projection ALL)
+type dynamoIndexSpec struct {
+	Name    string
+	Hash    dynamoKey
+	Range   dynamoKey // zero Name: hash key only
+	Purpose string
+}
+
+// dynamoTableSpec is a table as the code expects it
+type dynamoTableSpec struct {
+	Env     string // environment variable holding the table name
+	Hash    dynamoKey
+	Stream  bool // NEW_AND_OLD_IMAGES stream (read by the projector)
+	Indexes []dynamoIndexSpec
+}
+
+var dynamoTableSpecs = []dynamoTableSpec{
+	{Env: "DYNAMODB_TABLE_NAME", Hash: dynamoKey{"cart_id", types.ScalarAttributeTypeS}, Stream: true},
+	{Env: "DYNAMODB_ORDERS_TABLE_NAME", Hash: dynamoKey{"order_id", types.ScalarAttributeTypeS}, Indexes: []dynamoIndexSpec{{
+		Name:    ordersByCustomerIndex,
+		Hash:    dynamoKey{"customer_id", types.ScalarAttributeTypeN},
+		Range:   dynamoKey{"created_at", types.ScalarAttributeTypeS},
+		Purpose: "per-customer order history",
+	}}},
+	{Env: "DYNAMODB_PRODUCTS_TABLE_NAME", Hash: dynamoKey{"product_id", types.ScalarAttributeTypeN}},
+	{Env: "DYNAMODB_INVENTORY_TABLE_NAME", Hash: dynamoKey{"product_id", types.ScalarAttributeTypeN}},
+	{Env: "DYNAMODB_PAYMENTS_TABLE_NAME", Hash: dynamoKey{"order_id", types.ScalarAttributeTypeS}},
+	{Env: "DYNAMODB_SAGAS_TABLE_NAME", Hash: dynamoKey{"cart_id", types.ScalarAttributeTypeS}},
+	{Env: "DYNAMODB_OUTBOX_TABLE_NAME", Hash: dynamoKey{"event_id", types.ScalarAttributeTypeS}, Indexes: []dynamoIndexSpec{{
+		Name:    outboxPendingIndex,
+		Hash:    dynamoKey{"pending", types.ScalarAttributeTypeS},
+		Range:   dynamoKey{"next_attempt_ms", types.ScalarAttributeTypeN},
+		Purpose: "unsent outbox events",
+	}}},
+}
+
+// dynamoTableAPI is the part of the DynamoDB client the bootstrap uses
+type dynamoTableAPI interface {
+	DescribeTable(ctx context.Context, in *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, in *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	UpdateTable(ctx context.Context, in *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+}
+
+// dynamoBootstrap checks (and with create, first provisions) the configured tables
+type dynamoBootstrap struct {
+	client dynamoTableAPI
+	create bool
+	poll   time.Duration // DescribeTable interval while waiting for ACTIVE
+}
+
+// runDynamoDBBootstrap is the dynamodb-bootstrap subcommand; args follow
+// "dynamodb-bootstrap". Without -check it creates what is missing.
+func runDynamoDBBootstrap(args []string) error {
+	fs := flag.NewFlagSet("dynamodb-bootstrap", flag.ContinueOnError)
+	check := fs.Bool("check", false, "only check the tables, create nothing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: app dynamodb-bootstrap [-check]")
+	}
+	client, err := newDynamoDBAPIClient()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	b := &dynamoBootstrap{client: client, create: !*check, poll: time.Second}
+	if err := b.run(ctx); err != nil {
+		return err
+	}
+	log.Printf("dynamodb: tables match the code")
+	return nil
+}
+
+// bootstrapDynamoDBFromEnv runs the bootstrap DYNAMODB_BOOTSTRAP asks for
+func bootstrapDynamoDBFromEnv(ctx context.Context, client dynamoTableAPI) error {
+	switch mode := getenv("DYNAMODB_BOOTSTRAP", "off"); mode {
+	case "off":
+		return nil
+	case "check", "create":
+		b := &dynamoBootstrap{client: client, create: mode == "create", poll: time.Second}
+		return b.run(ctx)
+	default:
+		return fmt.Errorf("unknown DYNAMODB_BOOTSTRAP %q (off, check or create)", mode)
+	}
+}
+
+func (b *dynamoBootstrap) run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dynamoBootstrapTimeout)
+	defer cancel()
+	var problems []string
+	for _, spec := range dynamoTableSpecs {
+		name := os.Getenv(spec.Env)
+		if name == "" {
+			continue
+		}
+		if err := b.table(ctx, name, spec); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (%s): %v", name, spec.Env, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("dynamodb tables do not match the code:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// table brings one table to spec (when creating) and checks it
+func (b *dynamoBootstrap) table(ctx context.Context, name string, spec dynamoTableSpec) error {
+	desc, err := b.describe(ctx, name)
+	if err != nil {
+		return err
+	}
+	if desc == nil {
+		if !b.create {
+			return errors.New("table does not exist")
+		}
+		if err := b.createTable(ctx, name, spec); err != nil {
+			return err
+		}
+		log.Printf("dynamodb: created table %s", name)
+	}
+	if desc == nil || desc.TableStatus != types.TableStatusActive || !indexesActive(desc) {
+		if desc, err = b.waitActive(ctx, name); err != nil {
+			return err
+		}
+	}
+	if err := checkKeySchema(desc.KeySchema, desc.AttributeDefinitions, spec.Hash, dynamoKey{}); err != nil {
+		return err
+	}
+
+	for _, idx := range spec.Indexes {
+		gsi := findIndex(desc, idx.Name)
+		if gsi == nil {
+			if !b.create {
+				return fmt.Errorf("index %s (%s) does not exist", idx.Name, idx.Purpose)
+			}
+			// One new index per UpdateTable call, and the table must be ACTIVE again in between
+			if _, err := b.client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+				TableName:            aws.String(name),
+				AttributeDefinitions: indexAttributes(idx),
+				GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+					Create: &types.CreateGlobalSecondaryIndexAction{
+						IndexName:  aws.String(idx.Name),
+						KeySchema:  indexKeySchema(idx),
+						Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+					},
+				}},
+			}); err != nil {
+				return fmt.Errorf("create index %s: %w", idx.Name, err)
+			}
+			log.Printf("dynamodb: creating index %s on %s", idx.Name, name)
+			if desc, err = b.waitActive(ctx, name); err != nil {
+				return err
+			}
+			gsi = findIndex(desc, idx.Name)
+			if gsi == nil {
+				return fmt.Errorf("index %s missing after it was created", idx.Name)
+			}
+		}
+		if err := checkKeySchema(gsi.KeySchema, desc.AttributeDefinitions, idx.Hash, idx.Range); err != nil {
+			return fmt.Errorf("index %s: %w", idx.Name, err)
+		}
+	}
+
+	if spec.Stream && !streamEnabled(desc) {
+		if !b.create {
+			return errors.New("stream is not enabled (the projector reads it)")
+		}
+		if _, err := b.client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+			TableName: aws.String(name),
+			StreamSpecification: &types.StreamSpecification{
+				StreamEnabled:  aws.Bool(true),
+				StreamViewType: types.StreamViewTypeNewAndOldImages,
+			},
+		}); err != nil {
+			return fmt.Errorf("enable stream: %w", err)
+		}
+		log.Printf("dynamodb: enabled the stream of %s", name)
+		if _, err := b.waitActive(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe returns nil (and no error) if the table does not exist
+func (b *dynamoBootstrap) describe(ctx context.Context, name string) (*types.TableDescription, error) {
+	out, err := b.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("describe: %w", err)
+	}
+	return out.Table, nil
+}
+
+func (b *dynamoBootstrap) createTable(ctx context.Context, name string, spec dynamoTableSpec) error {
+	in := &dynamodb.CreateTableInput{
+		TableName:   aws.String(name),
+		BillingMode: types.BillingModePayPerRequest,
+		KeySchema:   []types.KeySchemaElement{{AttributeName: aws.String(spec.Hash.Name), KeyType: types.KeyTypeHash}},
+	}
+	attrs := map[string]types.ScalarAttributeType{spec.Hash.Name: spec.Hash.Type}
+	for _, idx := range spec.Indexes {
+		for _, a := range indexAttributes(idx) {
+			attrs[aws.ToString(a.AttributeName)] = a.AttributeType
+		}
+		in.GlobalSecondaryIndexes = append(in.GlobalSecondaryIndexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(idx.Name),
+			KeySchema:  indexKeySchema(idx),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	for attr, typ := range attrs {
+		in.AttributeDefinitions = append(in.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(attr), AttributeType: typ})
+	}
+	if spec.Stream {
+		in.StreamSpecification = &types.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: types.StreamViewTypeNewAndOldImages,
+		}
+	}
+	var inUse *types.ResourceInUseException
+	if _, err := b.client.CreateTable(ctx, in); err != nil && !errors.As(err, &inUse) {
+		// In use: another task is creating it; waitActive waits for that one
+		return fmt.Errorf("create: %w", err)
+	}
+	return nil
+}
+
+// waitActive polls until the table and all its indexes are ACTIVE
+func (b *dynamoBootstrap) waitActive(ctx context.Context, name string) (*types.TableDescription, error) {
+	for {
+		desc, err := b.describe(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if desc != nil && desc.TableStatus == types.TableStatusActive && indexesActive(desc) {
+			return desc, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for the table to become ACTIVE: %w", ctx.Err())
+		case <-time.After(b.poll):
+		}
+	}
+}
+
+func indexesActive(desc *types.TableDescription) bool {
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		if gsi.IndexStatus != types.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+func findIndex(desc *types.TableDescription, name string) *types.GlobalSecondaryIndexDescription {
+	for i := range desc.GlobalSecondaryIndexes {
+		if aws.ToString(desc.GlobalSecondaryIndexes[i].IndexName) == name {
+			return &desc.GlobalSecondaryIndexes[i]
+		}
+	}
+	return nil
+}
+
+func streamEnabled(desc *types.TableDescription) bool {
+	s := desc.StreamSpecification
+	return s != nil && aws.ToBool(s.StreamEnabled) && s.StreamViewType == types.StreamViewTypeNewAndOldImages
+}
+
+func indexKeySchema(idx dynamoIndexSpec) []types.KeySchemaElement {
+	ks := []types.KeySchemaElement{{AttributeName: aws.String(idx.Hash.Name), KeyType: types.KeyTypeHash}}
+	if idx.Range.Name != "" {
+		ks = append(ks, types.KeySchemaElement{AttributeName: aws.String(idx.Range.Name), KeyType: types.KeyTypeRange})
+	}
+	return ks
+}
+
+func indexAttributes(idx dynamoIndexSpec) []types.AttributeDefinition {
+	attrs := []types.AttributeDefinition{{AttributeName: aws.String(idx.Hash.Name), AttributeType: idx.Hash.Type}}
+	if idx.Range.Name != "" {
+		attrs = append(attrs, types.AttributeDefinition{AttributeName: aws.String(idx.Range.Name), AttributeType: idx.Range.Type})
+	}
+	return attrs
+}
+
+// checkKeySchema compares a table's or index's keys with the expected ones
+func checkKeySchema(ks []types.KeySchemaElement, defs []types.AttributeDefinition, hash, rng dynamoKey) error {
+	attrTypes := map[string]types.ScalarAttributeType{}
+	for _, d := range defs {
+		attrTypes[aws.ToString(d.AttributeName)] = d.AttributeType
+	}
+	describe := func(k dynamoKey) string {
+		if k.Name == "" {
+			return "none"
+		}
+		return fmt.Sprintf("%s (%s)", k.Name, k.Type)
+	}
+	var gotHash, gotRange dynamoKey
+	for _, k := range ks {
+		key := dynamoKey{aws.ToString(k.AttributeName), attrTypes[aws.ToString(k.AttributeName)]}
+		if k.KeyType == types.KeyTypeHash {
+			gotHash = key
+		} else {
+			gotRange = key
+		}
+	}
+	if gotHash != hash {
+		return fmt.Errorf("hash key is %s, the code expects %s", describe(gotHash), describe(hash))
+	}
+	if gotRange != rng {
+		return fmt.Errorf("range key is %s, the code expects %s", describe(gotRange), describe(rng))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// Card numbers (PANs) never leave the request that carried them: the payment
+// handler hands the number to the processor and stores only a CardToken.
+// Everything that renders text for humans (error responses, logs) goes through
+// redactPANs as a second line of defence.
+
+// CardToken is everything we keep about a card
+type CardToken struct {
+	Token string // stable for a given card and CARD_TOKEN_KEY, useless without the key
+	Last4 string
+	Brand string
+}
+
+// CardTokenizer turns a PAN into a CardToken.
+type CardTokenizer interface {
+	Tokenize(ctx context.Context, pan string) (CardToken, error)
+}
+
+// Select the tokenizer. CARD_TOKEN_KEY (hex) keys the HMAC; without it a random
+// key is generated, so tokens are only stable for the life of the process.
+func newCardTokenizerFromEnv() (CardTokenizer, error) {
+	if v := getenv("CARD_TOKEN_KEY", ""); v != "" {
+		key, err := hex.DecodeString(v)
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("CARD_TOKEN_KEY must be at least 16 hex-encoded bytes")
+		}
+		return hmacTokenizer{key: key}, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate card token key: %w", err)
+	}
+	log.Printf("cards: CARD_TOKEN_KEY not set, card tokens will change on restart")
+	return hmacTokenizer{key: key}, nil
+}
+
+// hmacTokenizer derives the token as HMAC-SHA256(key, PAN); the same card
+// always maps to the same token, and the PAN cannot be recovered from it.
+type hmacTokenizer struct {
+	key []byte
+}
+
+func (t hmacTokenizer) Tokenize(ctx context.Context, pan string) (CardToken, error) {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(pan))
+	return CardToken{
+		Token: "tok_" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18]),
+		Last4: pan[len(pan)-4:],
+		Brand: cardBrand(pan),
+	}, nil
+}
+
+// Card brand from the issuer identification number (leading digits)
+func cardBrand(pan string) string {
+	prefix := func(lo, hi string) bool {
+		p := pan[:min(len(pan), len(lo))]
+		return p >= lo && p <= hi
+	}
+	switch {
+	case strings.HasPrefix(pan, "4"):
+		return "visa"
+	case prefix("51", "55"), prefix("2221", "2720"):
+		return "mastercard"
+	case prefix("34", "34"), prefix("37", "37"):
+		return "amex"
+	case strings.HasPrefix(pan, "6011"), strings.HasPrefix(pan, "65"), prefix("644", "649"):
+		return "discover"
+	case prefix("3528", "3589"):
+		return "jcb"
+	case strings.HasPrefix(pan, "36"), prefix("300", "305"):
+		return "diners"
+	case strings.HasPrefix(pan, "62"):
+		return "unionpay"
+	default:
+		return "unknown"
+	}
+}
+
+/************ Validation ************/
+
+var cardNumberPattern = regexp.MustCompile(`^[0-9]{13,19}$`)
+
+// validCardNumber checks the api.yaml pattern and the Luhn checksum
+func validCardNumber(pan string) bool {
+	if !cardNumberPattern.MatchString(pan) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(pan); i++ {
+		d := int(pan[len(pan)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+/************ Redaction ************/
+
+// 13-19 digits, optionally grouped with spaces or dashes ("4111 1111 1111 1111"),
+// wherever they appear (also glued to letters, as in "card=4111..."). Only the
+// runs that pass the Luhn check are card numbers; the rest are left as they
+// are. A cart or order ID that happens to pass Luhn is masked too: nothing
+// about a number's size tells an ID from a card.
+var panLike = regexp.MustCompile(`[0-9](?:[ -]?[0-9]){12,18}`)
+
+// redactPANs masks every card number in s, keeping its last four digits
+func redactPANs(s string) string {
+	return panLike.ReplaceAllStringFunc(s, redactRun)
+}
+
+// redactRun masks the card numbers in one run of digit groups: the whole run,
+// or a stretch of whole groups within it ("4111 1111 1111 1111 7" still hides
+// a card), that is 13-19 digits long and passes Luhn
+func redactRun(run string) string {
+	var digits []byte
+	var pos []int      // byte offset in run of each digit
+	starts := []int{0} // digit indexes where a group starts
+	for i := 0; i < len(run); i++ {
+		if run[i] < '0' || run[i] > '9' {
+			starts = append(starts, len(digits))
+			continue
+		}
+		digits = append(digits, run[i])
+		pos = append(pos, i)
+	}
+
+	masked := make([]bool, len(digits))
+	ends := append(starts[1:], len(digits))
+	for _, i := range starts {
+		for _, j := range ends {
+			if n := j - i; n >= 13 && n <= 19 && validCardNumber(string(digits[i:j])) {
+				for k := i; k < j-4; k++ {
+					masked[k] = true
+				}
+			}
+		}
+	}
+	out := []byte(run)
+	for k, m := range masked {
+		if m {
+			out[pos[k]] = '*'
+		}
+	}
+	return string(out)
+}
+
+// redactingWriter scrubs PANs from everything written through it; main puts
+// it under the standard logger so every log line is covered.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, redactPANs(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestRedactPANs(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"card", "charge 4111111111111111 declined", "charge ************1111 declined"},
+		{"grouped card", "card 4111 1111 1111 1111", "card **** **** **** 1111"},
+		{"dashed card", "card=5500-0000-0000-0004", "card=****-****-****-0004"},
+		{"card glued to letters", "pan4111111111111111x", "pan************1111x"},
+		{"card followed by a number", "4111 1111 1111 1111 7", "**** **** **** 1111 7"},
+		{"18-digit jcb card", "card 352800000000000007", "card **************0007"},
+		{"18-digit diners card", "card 360000000000000008", "card **************0008"},
+		{"id that is not luhn", "cart 312345678901234567 not found", "cart 312345678901234567 not found"},
+		{"id that passes luhn", "cart 312345678901234563 not found", "cart **************4563 not found"},
+		{"millisecond timestamp", "at 1760000000000 ms", "at 1760000000000 ms"},
+		{"not luhn", "ref 4111111111111112", "ref 4111111111111112"},
+		{"short number", "order 42", "order 42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactPANs(tt.in); got != tt.want {
+				t.Errorf("redactPANs(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCartContract checks that every backend serves the same shopping cart API
+// (api.yaml ShoppingCart), so switching DB_BACKEND does not break clients. It
+// runs one scenario through the real cart handlers on each backend and makes
+// the same assertions on every response: status codes, the exact set of JSON
+// fields and their types, status values, timestamp format and item order.
+//
+// The memory backend always runs. The others write to a real database, so they
+// only run when named in CONTRACT_TEST_BACKENDS (e.g. "mysql,dynamodb"), and
+// they connect with CONTRACT_-prefixed copies of the service's variables
+// (CONTRACT_DB_HOST, CONTRACT_DYNAMODB_TABLE_NAME, ...): the service's own
+// DB_* and DYNAMODB_* are ignored, so a shell with deployment settings
+// exported never reaches that database. The scenario leaves a few carts of
+// customer contractCustomerID behind and restocks the products it buys.
+// Checkout is paid through the fake processor.
+
+const contractCustomerID = 4242
+
+// Approved by the fake processor
+const contractCard = "4111111111111111"
+
+// Cart timestamps are UTC RFC3339 with whole seconds on every backend
+var contractTimestamp = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}Z$`)
+
+var contractBackends = []struct {
+	backend string
+	needs   []string // connection variables the backend cannot run without
+}{
+	{"memory", nil},
+	{"mysql", []string{"DB_HOST", "DB_USER", "DB_NAME"}},
+	{"dynamodb", []string{"DYNAMODB_TABLE_NAME"}},
+	{"dualwrite", []string{"DB_HOST", "DB_USER", "DB_NAME", "DYNAMODB_TABLE_NAME"}},
+}
+
+// contractEnv lists the variables newStore connects with; each is taken from
+// its CONTRACT_ copy, or cleared
+func contractEnv() []string {
+	env := []string{"DB_HOST", "DB_USER", "DB_PASS", "DB_NAME", "DYNAMODB_ENDPOINT"}
+	for _, spec := range dynamoTableSpecs {
+		env = append(env, spec.Env)
+	}
+	return env
+}
+
+func TestCartContract(t *testing.T) {
+	enabled := strings.Split(os.Getenv("CONTRACT_TEST_BACKENDS"), ",")
+	for i := range enabled {
+		enabled[i] = strings.TrimSpace(enabled[i])
+	}
+	for _, tt := range contractBackends {
+		t.Run(tt.backend, func(t *testing.T) {
+			if tt.backend != "memory" && !slices.Contains(enabled, tt.backend) {
+				t.Skipf("%s not in CONTRACT_TEST_BACKENDS", tt.backend)
+			}
+			for _, env := range contractEnv() {
+				t.Setenv(env, os.Getenv("CONTRACT_"+env))
+			}
+			for _, env := range tt.needs {
+				if os.Getenv(env) == "" {
+					t.Fatalf("CONTRACT_%s not set", env)
+				}
+			}
+			store, err := newStore(tt.backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCartContract(t, store)
+		})
+	}
+}
+
+// checkCartContract runs the scenario against store
+func checkCartContract(t *testing.T, store Store) {
+	for _, productID := range []int{10, 30} {
+		if err := store.Restock(context.Background(), productID, 10); err != nil {
+			t.Fatalf("restock product %d: %v", productID, err)
+		}
+	}
+	checkout := newPaidCheckout(store, newCheckoutOrchestrator(store, newFakeProcessor()), hmacTokenizer{key: []byte("contract-card-token-key")}, discardPublisher{})
+	mux := http.NewServeMux()
+	registerCartRoutes(mux, store, nil, discardPublisher{}, checkout)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := srv.Client()
+	client.Timeout = 10 * time.Second
+	c := &contractRun{t: t, base: srv.URL, client: client}
+	c.run()
+}
+
+type contractRun struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+}
+
+func (c *contractRun) run() {
+	// Create
+	status, body := c.do(http.MethodPost, "/shopping-carts", map[string]any{"customer_id": 0})
+	c.expectError("create with customer_id 0", status, body, 400, "INVALID_INPUT")
+	status, body = c.do(http.MethodPost, "/shopping-carts", map[string]any{"customer_id": contractCustomerID})
+	c.expect("create returns 201", status == 201, "got %d: %s", status, body)
+	created := c.object("create response", body, "shopping_cart_id")
+	cartID, _ := created["shopping_cart_id"].(string)
+	if !c.expect("shopping_cart_id is a non-empty string", cartID != "", "got %#v", created["shopping_cart_id"]) {
+		return
+	}
+	cartPath := "/shopping-carts/" + cartID
+
+	// A new cart
+	cart, items := c.getCart("new cart", cartPath, cartID, CartStatusOpen, false)
+	c.expect("new cart has no items", items != nil && len(items) == 0, "got %v", items)
+	if cart != nil {
+		c.expect("new cart: updated_at is not before created_at", !cart.UpdatedAt.Before(cart.CreatedAt),
+			"created_at %s, updated_at %s", cart.CreatedAt, cart.UpdatedAt)
+	}
+
+	// Items: add, update, remove, remove an absent product
+	for _, it := range []CartItem{{ProductID: 30, Quantity: 2}, {ProductID: 10, Quantity: 1}, {ProductID: 30, Quantity: 5}, {ProductID: 20, Quantity: 4}} {
+		status, body = c.do(http.MethodPost, cartPath+"/items", it)
+		c.expect(fmt.Sprintf("set product %d to %d returns 204", it.ProductID, it.Quantity), status == 204, "got %d: %s", status, body)
+	}
+	_, items = c.getCart("cart with items", cartPath, cartID, CartStatusOpen, false)
+	c.expectItems("items are sorted by product_id, quantities updated", items,
+		[]CartItem{{ProductID: 10, Quantity: 1}, {ProductID: 20, Quantity: 4}, {ProductID: 30, Quantity: 5}})
+	for _, productID := range []int{20, 99} {
+		status, body = c.do(http.MethodPost, cartPath+"/items", CartItem{ProductID: productID})
+		c.expect(fmt.Sprintf("remove product %d returns 204", productID), status == 204, "got %d: %s", status, body)
+	}
+	_, items = c.getCart("cart after removals", cartPath, cartID, CartStatusOpen, false)
+	c.expectItems("removed products are gone", items, []CartItem{{ProductID: 10, Quantity: 1}, {ProductID: 30, Quantity: 5}})
+
+	// Checkout (paid)
+	pay := map[string]any{"credit_card_number": contractCard}
+	status, body = c.do(http.MethodPost, cartPath+"/checkout", map[string]any{})
+	c.expectError("checkout without a card", status, body, 400, "INVALID_INPUT")
+	status, body = c.do(http.MethodPost, cartPath+"/checkout", pay)
+	c.expect("checkout returns 200", status == 200, "got %d: %s", status, body)
+	checkout := c.object("checkout response", body, "success", "transaction_id", "order_id")
+	orderID, _ := checkout["order_id"].(string)
+	c.expect("order_id is a non-empty string", orderID != "", "got %#v", checkout["order_id"])
+	cart, items = c.getCart("checked-out cart", cartPath, cartID, CartStatusCheckedOut, true)
+	if cart != nil {
+		c.expect("checked-out cart carries the order_id", cart.OrderID == orderID, "got %q, want %q", cart.OrderID, orderID)
+	}
+	c.expectItems("checkout keeps the items", items, []CartItem{{ProductID: 10, Quantity: 1}, {ProductID: 30, Quantity: 5}})
+	status, body = c.do(http.MethodPost, cartPath+"/items", CartItem{ProductID: 40, Quantity: 1})
+	c.expectError("add to a checked-out cart", status, body, 400, "INVALID_STATE")
+	status, body = c.do(http.MethodPost, cartPath+"/checkout", pay)
+	again := c.object("second checkout response", body, "success", "transaction_id", "order_id")
+	c.expect("second checkout returns the original order", status == 200 && again["order_id"] == orderID,
+		"got %d: %s", status, body)
+
+	// Errors
+	status, body = c.do(http.MethodPost, "/shopping-carts", map[string]any{"customer_id": contractCustomerID})
+	empty := c.object("create response", body, "shopping_cart_id")
+	if emptyID, _ := empty["shopping_cart_id"].(string); status == 201 && emptyID != "" {
+		status, body = c.do(http.MethodPost, "/shopping-carts/"+emptyID+"/checkout", pay)
+		c.expectError("checkout of an empty cart", status, body, 400, "INVALID_STATE")
+	}
+	status, body = c.do(http.MethodGet, "/shopping-carts/999999999", nil)
+	c.expectError("get an unknown cart", status, body, 404, "NOT_FOUND")
+	status, body = c.do(http.MethodPost, "/shopping-carts/999999999/items", CartItem{ProductID: 10, Quantity: 1})
+	c.expectError("add to an unknown cart", status, body, 404, "NOT_FOUND")
+}
+
+// getCart fetches a cart and checks the response shape; it returns nil values
+// if the response is unusable
+func (c *contractRun) getCart(what, path, cartID, wantStatus string, wantOrder bool) (*cartDTO, []CartItem) {
+	status, body := c.do(http.MethodGet, path, nil)
+	if !c.expect(what+": GET returns 200", status == 200, "got %d: %s", status, body) {
+		return nil, nil
+	}
+	resp := c.object(what, body, "cart", "items")
+	fields := []string{"cart_id", "customer_id", "status", "created_at", "updated_at"}
+	if wantOrder {
+		fields = append(fields, "order_id")
+	}
+	raw, _ := resp["cart"].(map[string]any)
+	c.expectFields(what+": cart", raw, fields...)
+	c.expectType(what+": cart_id", raw["cart_id"], "string")
+	c.expectType(what+": customer_id", raw["customer_id"], "number")
+	c.expectType(what+": status", raw["status"], "string")
+	for _, f := range []string{"created_at", "updated_at"} {
+		s, _ := raw[f].(string)
+		c.expect(fmt.Sprintf("%s: %s is UTC RFC3339 in whole seconds", what, f), contractTimestamp.MatchString(s), "got %#v", raw[f])
+	}
+	rawItems, ok := resp["items"].([]any)
+	c.expect(what+": items is an array", ok, "got %#v", resp["items"])
+	for i, it := range rawItems {
+		m, _ := it.(map[string]any)
+		c.expectFields(fmt.Sprintf("%s: items[%d]", what, i), m, "product_id", "quantity")
+	}
+
+	var typed getCartResp
+	if err := json.Unmarshal(body, &typed); !c.expect(what+": decodes", err == nil, "%v", err) {
+		return nil, nil
+	}
+	c.expect(what+": cart_id", typed.Cart.CartID == cartID, "got %q, want %q", typed.Cart.CartID, cartID)
+	c.expect(what+": customer_id", typed.Cart.CustomerID == contractCustomerID, "got %d", typed.Cart.CustomerID)
+	c.expect(what+": status", typed.Cart.Status == wantStatus, "got %q, want %q", typed.Cart.Status, wantStatus)
+	if typed.Items == nil {
+		typed.Items = []CartItem{}
+	}
+	return &typed.Cart, typed.Items
+}
+
+func (c *contractRun) do(method, path string, body any) (int, []byte) {
+	var rdr io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		rdr = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, rdr)
+	if err != nil {
+		return 0, []byte(err.Error())
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, []byte(err.Error())
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// object decodes a JSON object response that must have exactly fields
+func (c *contractRun) object(what string, body []byte, fields ...string) map[string]any {
+	var m map[string]any
+	if err := json.Unmarshal(body, &m); err != nil {
+		c.expect(what+" is a JSON object", false, "%v: %s", err, body)
+		return nil
+	}
+	c.expectFields(what, m, fields...)
+	return m
+}
+
+func (c *contractRun) expectFields(what string, m map[string]any, fields ...string) {
+	got := slices.Sorted(maps.Keys(m))
+	want := slices.Sorted(slices.Values(fields))
+	c.expect(what+" has fields "+strings.Join(want, ", "), slices.Equal(got, want), "got %s", strings.Join(got, ", "))
+}
+
+func (c *contractRun) expectType(what string, v any, want string) {
+	var got string
+	switch v.(type) {
+	case string:
+		got = "string"
+	case float64:
+		got = "number"
+	default:
+		got = fmt.Sprintf("%T", v)
+	}
+	c.expect(what+" is a "+want, got == want, "got %s %#v", got, v)
+}
+
+func (c *contractRun) expectItems(what string, got, want []CartItem) {
+	if got == nil {
+		return // the GET already failed
+	}
+	c.expect(what, reflect.DeepEqual(got, want), "got %v, want %v", got, want)
+}
+
+func (c *contractRun) expectError(what string, status int, body []byte, wantStatus int, wantCode string) {
+	c.expect(fmt.Sprintf("%s returns %d", what, wantStatus), status == wantStatus, "got %d: %s", status, body)
+	e := c.object(what+": error", body, "error", "message")
+	c.expect(what+": error is "+wantCode, e["error"] == wantCode, "got %#v", e["error"])
+}
+
+func (c *contractRun) expect(what string, ok bool, format string, args ...any) bool {
+	c.t.Helper()
+	if !ok {
+		c.t.Errorf("%s: %s", what, fmt.Sprintf(format, args...))
+	}
+	return ok
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// ./app dlq is the operator's view of the order queue's dead-letter queue:
+//
+//	./app dlq list [-max N] [-json]          show dead letters and why they failed
+//	./app dlq replay [-max N] ID...          send them back to the order queue
+//	./app dlq replay [-max N] -all           send back every dead letter
+//
+// IDs are the dead-letter queue's message IDs, or the order queue's IDs as
+// logged by the processor. It needs the processor's queue environment
+// (QUEUE_BACKEND=aws, SQS_QUEUE_URL, SQS_DLQ_URL).
+
+const dlqUsage = `usage:
+  app dlq list [-max N] [-json]
+  app dlq replay [-max N] (-all | ID...)`
+
+// runDLQ is the dlq subcommand; args follow "dlq"
+func runDLQ(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(dlqUsage)
+	}
+	if getenv("QUEUE_BACKEND", "log") != "aws" {
+		return errors.New("the dlq subcommand needs QUEUE_BACKEND=aws")
+	}
+	_, _, dlq, err := newQueueFromEnv()
+	if err != nil {
+		return err
+	}
+	if dlq == nil {
+		return errors.New("the dlq subcommand needs SQS_DLQ_URL")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+		limit := fs.Int("max", 100, "list at most this many dead letters")
+		asJSON := fs.Bool("json", false, "print JSON instead of a table")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return listDeadLetters(ctx, dlq, *limit, *asJSON, stdout)
+	case "replay":
+		fs := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+		limit := fs.Int("max", 1000, "look through at most this many dead letters")
+		all := fs.Bool("all", false, "replay every dead letter")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *all == (fs.NArg() > 0) {
+			return errors.New(dlqUsage)
+		}
+		return replayDeadLetters(ctx, dlq, *limit, *all, fs.Args(), stdout)
+	default:
+		return errors.New(dlqUsage)
+	}
+}
+
+// deadLetterView is a dead letter as listed
+type deadLetterView struct {
+	ID        string     `json:"id"`
+	SourceID  string     `json:"source_message_id"`
+	Receives  int        `json:"receive_count,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+	Reason    string     `json:"reason"`
+	EventType string     `json:"event_type,omitempty"`
+	OrderID   string     `json:"order_id,omitempty"`
+	Body      string     `json:"body"`
+}
+
+func newDeadLetterView(d DeadLetter) deadLetterView {
+	v := deadLetterView{ID: d.ID, SourceID: d.SourceID, Receives: d.Receives, Reason: d.Reason, Body: d.Body}
+	if v.Reason == "" {
+		v.Reason = "moved by the queue's redrive policy (no error recorded)"
+	}
+	if !d.FailedAt.IsZero() {
+		t := d.FailedAt
+		v.FailedAt = &t
+	}
+	body := d.Body
+	var env snsEnvelope
+	if err := json.Unmarshal([]byte(body), &env); err == nil && env.Type == "Notification" {
+		body = env.Message
+	}
+	var event struct {
+		EventType string `json:"event_type"`
+		OrderID   string `json:"order_id"`
+	}
+	if json.Unmarshal([]byte(body), &event) == nil {
+		v.EventType, v.OrderID = event.EventType, event.OrderID
+	}
+	return v
+}
+
+func listDeadLetters(ctx context.Context, dlq DeadLetterQueue, limit int, asJSON bool, stdout io.Writer) error {
+	letters, err := dlq.Browse(ctx, limit)
+	// Listing must not hide the letters from the next command
+	defer func() {
+		if err := dlq.Release(context.WithoutCancel(ctx), letters); err != nil {
+			fmt.Fprintf(os.Stderr, "dlq: %v\n", err)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	views := make([]deadLetterView, 0, len(letters))
+	for _, d := range letters {
+		views = append(views, newDeadLetterView(d))
+	}
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSOURCE ID\tRECEIVES\tFAILED AT\tEVENT\tORDER\tREASON")
+	for _, v := range views {
+		failedAt := "-"
+		if v.FailedAt != nil {
+			failedAt = v.FailedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", v.ID, v.SourceID, v.Receives, failedAt,
+			orDash(v.EventType), orDash(v.OrderID), strings.ReplaceAll(v.Reason, "\n", " "))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d dead letter(s)\n", len(views))
+	return nil
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func replayDeadLetters(ctx context.Context, dlq DeadLetterQueue, limit int, all bool, ids []string, stdout io.Writer) error {
+	letters, err := dlq.Browse(ctx, limit)
+	var rest []DeadLetter // browsed but not replayed; released at the end
+	defer func() {
+		if err := dlq.Release(context.WithoutCancel(ctx), rest); err != nil {
+			fmt.Fprintf(os.Stderr, "dlq: %v\n", err)
+		}
+	}()
+	if err != nil {
+		rest = letters
+		return err
+	}
+
+	found := make(map[string]bool, len(ids))
+	var failed int
+	for _, d := range letters {
+		if !all && !slices.Contains(ids, d.ID) && !slices.Contains(ids, d.SourceID) {
+			rest = append(rest, d)
+			continue
+		}
+		found[d.ID], found[d.SourceID] = true, true
+		if err := dlq.Replay(ctx, d); err != nil {
+			failed++
+			rest = append(rest, d)
+			fmt.Fprintf(stdout, "%s: %v\n", d.ID, err)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: replayed\n", d.ID)
+	}
+	for _, id := range ids {
+		if !found[id] {
+			failed++
+			fmt.Fprintf(stdout, "%s: not found in the dead-letter queue\n", id)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d dead letter(s) not replayed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DB_BACKEND=dualwrite is the migration mode from MySQL to DynamoDB. MySQL is
+// the primary: it serves every read and write and its answer is the one the
+// client gets. Cart writes are then mirrored to the DynamoDB shopping_carts
+// table under the same cart ID, so flipping DB_BACKEND to dynamodb later keeps
+// every live cart. Carts created before the switch are copied by ./app
+// backfill (or the first time they change).
+//
+// Reads come from MySQL too; shadow.go compares them with DynamoDB.
+//
+// A failed mirror never fails the request. Anything the mirror finds different
+// in DynamoDB is a divergence: it is logged, recorded in cart_divergences and
+// repaired by copying the primary's cart over.
+
+// Mirrors of one cart are serialized per replica so they reach DynamoDB in
+// the order MySQL applied them
+const dualWriteLockStripes = 64
+
+// DualWriteStore is MySQLStore with cart writes mirrored to DynamoDB. Orders,
+// payments, inventory and the rest stay in MySQL only.
+type DualWriteStore struct {
+	*MySQLStore
+	secondary *DynamoDBClient
+	shadow    *ShadowReader // nil without shadow reads
+	locks     [dualWriteLockStripes]sync.Mutex
+
+	mirrored       atomic.Int64
+	divergences    atomic.Int64
+	repairFailures atomic.Int64
+
+	mu        sync.Mutex
+	lastError string
+}
+
+func newDualWriteStore(primary *MySQLStore, secondary *DynamoDBClient) *DualWriteStore {
+	return &DualWriteStore{MySQLStore: primary, secondary: secondary, shadow: newShadowReaderFromEnv(primary, secondary)}
+}
+
+func (d *DualWriteStore) lock(cartID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(cartID))
+	mu := &d.locks[h.Sum32()%dualWriteLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// GetCart answers from MySQL and has the shadow reader check DynamoDB's copy
+func (d *DualWriteStore) GetCart(ctx context.Context, cartID string) (*Cart, error) {
+	c, err := d.MySQLStore.GetCart(ctx, cartID)
+	if err == nil && d.shadow != nil {
+		d.shadow.Observe(c)
+	}
+	return c, err
+}
+
+func (d *DualWriteStore) CreateCart(ctx context.Context, customerID int) (string, error) {
+	cartID, err := d.MySQLStore.CreateCart(ctx, customerID)
+	if err != nil {
+		return "", err
+	}
+	defer d.lock(cartID)()
+	ctx = context.WithoutCancel(ctx)
+	if err := d.copyCart(ctx, cartID); err != nil {
+		d.diverge(ctx, cartID, "create", err.Error())
+		return cartID, nil
+	}
+	d.mirrored.Add(1)
+	return cartID, nil
+}
+
+func (d *DualWriteStore) UpsertItem(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error) {
+	defer d.lock(cartID)()
+	change, err := d.MySQLStore.UpsertItem(ctx, cartID, productID, quantity)
+	if err != nil {
+		return change, err
+	}
+	d.mirrorItem(context.WithoutCancel(ctx), "upsert_item", cartID, productID, quantity, change)
+	return change, nil
+}
+
+func (d *DualWriteStore) RemoveItem(ctx context.Context, cartID string, productID int) (CartItemChange, error) {
+	defer d.lock(cartID)()
+	change, err := d.MySQLStore.RemoveItem(ctx, cartID, productID)
+	if err != nil {
+		return change, err
+	}
+	d.mirrorItem(context.WithoutCancel(ctx), "remove_item", cartID, productID, 0, change)
+	return change, nil
+}
+
+// Checkout checks out in MySQL, which writes the order and its outbox event,
+// and copies the checked-out cart (with the MySQL order ID) to DynamoDB
+func (d *DualWriteStore) Checkout(ctx context.Context, cartID string, items []CartItem) (string, error) {
+	defer d.lock(cartID)()
+	orderID, err := d.MySQLStore.Checkout(ctx, cartID, items)
+	if err != nil {
+		return "", err
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	primary, err := d.MySQLStore.GetCart(ctx, cartID)
+	if err != nil {
+		d.fail(fmt.Errorf("cart %s: read mysql after checkout: %w", cartID, err))
+		return orderID, nil
+	}
+	secondary, err := d.secondary.GetCart(ctx, cartID)
+	switch {
+	case err != nil:
+		d.diverge(ctx, cartID, "checkout", fmt.Sprintf("dynamodb: %v", err))
+		return orderID, nil
+	case secondary.Status != CartStatusOpen:
+		d.diverge(ctx, cartID, "checkout", fmt.Sprintf("dynamodb: cart is %s", secondary.Status))
+		return orderID, nil
+	}
+	if diff := diffCarts(primary, secondary); diff != "" {
+		d.diverge(ctx, cartID, "checkout", diff)
+		return orderID, nil
+	}
+	if err := d.secondary.PutCart(ctx, primary); err != nil {
+		d.diverge(ctx, cartID, "checkout", fmt.Sprintf("dynamodb: %v", err))
+		return orderID, nil
+	}
+	d.mirrored.Add(1)
+	return orderID, nil
+}
+
+// mirrorItem replays an item change on DynamoDB, which must have seen the same
+// cart owner and quantity before the change as MySQL did
+func (d *DualWriteStore) mirrorItem(ctx context.Context, op, cartID string, productID, quantity int, primary CartItemChange) {
+	secondary, err := d.secondary.UpdateCartItems(ctx, cartID, productID, quantity)
+	switch {
+	case err != nil:
+		d.diverge(ctx, cartID, op, fmt.Sprintf("dynamodb: %v", err))
+	case secondary.CustomerID != primary.CustomerID:
+		d.diverge(ctx, cartID, op, fmt.Sprintf("customer_id is %d in mysql, %d in dynamodb", primary.CustomerID, secondary.CustomerID))
+	case secondary.OldQuantity != primary.OldQuantity:
+		d.diverge(ctx, cartID, op, fmt.Sprintf("product %d: quantity before the change was %d in mysql, %d in dynamodb",
+			productID, primary.OldQuantity, secondary.OldQuantity))
+	default:
+		d.mirrored.Add(1)
+	}
+}
+
+// copyCart overwrites DynamoDB's copy of the cart with MySQL's
+func (d *DualWriteStore) copyCart(ctx context.Context, cartID string) error {
+	c, err := d.MySQLStore.GetCart(ctx, cartID)
+	if err != nil {
+		return fmt.Errorf("mysql: %w", err)
+	}
+	if err := mapProjectedCart(ctx, d.MySQLStore, cartID); err != nil {
+		return fmt.Errorf("mysql: %w", err)
+	}
+	if err := d.secondary.PutCart(ctx, c); err != nil {
+		return fmt.Errorf("dynamodb: %w", err)
+	}
+	return nil
+}
+
+// mapProjectedCart tells the projector that DynamoDB cart cartID is MySQL cart
+// cartID, so after the cutover it updates that cart in place instead of
+// projecting a second copy
+func mapProjectedCart(ctx context.Context, s *MySQLStore, cartID string) error {
+	id, err := parseMySQLCartID(cartID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT IGNORE INTO cart_projection (source_cart_id, cart_id, source_version) VALUES (?, ?, 0)
+	`, cartID, id)
+	return err
+}
+
+// diverge records a divergence, then repairs it by copying MySQL's cart over
+func (d *DualWriteStore) diverge(ctx context.Context, cartID, op, detail string) {
+	d.divergences.Add(1)
+	log.Printf("dualwrite: cart %s diverged on %s: %s", cartID, op, detail)
+
+	err := d.copyCart(ctx, cartID)
+	if err != nil {
+		d.repairFailures.Add(1)
+		d.fail(fmt.Errorf("cart %s: repair: %w", cartID, err))
+	}
+	if _, dbErr := d.MySQLStore.db.ExecContext(ctx, `
+		INSERT INTO cart_divergences (cart_id, operation, detail, repaired) VALUES (?, ?, ?, ?)
+	`, cartID, op, truncate(detail, 1024), err == nil); dbErr != nil {
+		d.fail(fmt.Errorf("cart %s: record divergence: %w", cartID, dbErr))
+	}
+}
+
+func (d *DualWriteStore) fail(err error) {
+	log.Printf("dualwrite: %v", err)
+	d.mu.Lock()
+	d.lastError = err.Error()
+	d.mu.Unlock()
+}
+
+// diffCarts describes how b differs from a in customer and items (the order
+// of items does not matter); "" if they agree
+func diffCarts(a, b *Cart) string {
+	if a.CustomerID != b.CustomerID {
+		return fmt.Sprintf("customer_id is %d in mysql, %d in dynamodb", a.CustomerID, b.CustomerID)
+	}
+	qa := make(map[int]int, len(a.Items))
+	for _, it := range a.Items {
+		qa[it.ProductID] = it.Quantity
+	}
+	qb := make(map[int]int, len(b.Items))
+	for _, it := range b.Items {
+		qb[it.ProductID] = it.Quantity
+	}
+	var products []int
+	for p := range qa {
+		products = append(products, p)
+	}
+	for p := range qb {
+		if _, ok := qa[p]; !ok {
+			products = append(products, p)
+		}
+	}
+	slices.Sort(products)
+	for _, p := range products {
+		if qa[p] != qb[p] {
+			return fmt.Sprintf("product %d: quantity is %d in mysql, %d in dynamodb", p, qa[p], qb[p])
+		}
+	}
+	return ""
+}
+
+type cartDivergence struct {
+	ID         int64     `json:"divergence_id"`
+	CartID     string    `json:"cart_id"`
+	Operation  string    `json:"operation"`
+	Detail     string    `json:"detail"`
+	Repaired   bool      `json:"repaired"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+type dualWriteStatsResp struct {
+	Mirrored          int64            `json:"mirrored"`
+	Divergences       int64            `json:"divergences"`
+	RepairFailures    int64            `json:"repair_failures"`
+	LastError         string           `json:"last_error,omitempty"`
+	RecentDivergences []cartDivergence `json:"recent_divergences"`
+	ShadowReads       *shadowStatsResp `json:"shadow_reads,omitempty"`
+}
+
+// GET /migration/dual-write —— this replica's mirror and shadow read counters,
+// plus the latest divergences any replica recorded
+func (d *DualWriteStore) statsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.NotFound(w, req)
+		return
+	}
+	resp := dualWriteStatsResp{
+		Mirrored:          d.mirrored.Load(),
+		Divergences:       d.divergences.Load(),
+		RepairFailures:    d.repairFailures.Load(),
+		RecentDivergences: []cartDivergence{},
+	}
+	if d.shadow != nil {
+		resp.ShadowReads = d.shadow.stats()
+	}
+	d.mu.Lock()
+	resp.LastError = d.lastError
+	d.mu.Unlock()
+
+	rows, err := d.MySQLStore.db.QueryContext(req.Context(), `
+		SELECT divergence_id, cart_id, operation, detail, repaired, detected_at
+		FROM cart_divergences ORDER BY divergence_id DESC LIMIT 20
+	`)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dv cartDivergence
+		if err := rows.Scan(&dv.ID, &dv.CartID, &dv.Operation, &dv.Detail, &dv.Repaired, &dv.DetectedAt); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		resp.RecentDivergences = append(resp.RecentDivergences, dv)
+	}
+	if err := rows.Err(); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	writeJSON(w, 200, resp)
+}
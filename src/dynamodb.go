@@ -2,13 +2,12 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
+	"math/rand"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -20,14 +19,33 @@ import (
 
 // DynamoDB client wrapper
 type DynamoDBClient struct {
-	client    *dynamodb.Client
-	tableName string
+	client         *dynamodb.Client
+	tableName      string
+	ordersTable    string      // orders written by checkout (DYNAMODB_ORDERS_TABLE_NAME)
+	productsTable  string      // product catalog (DYNAMODB_PRODUCTS_TABLE_NAME)
+	inventoryTable string      // warehouse stock (DYNAMODB_INVENTORY_TABLE_NAME)
+	paymentsTable  string      // captured payments, keyed by order (DYNAMODB_PAYMENTS_TABLE_NAME)
+	sagasTable     string      // checkout sagas, keyed by cart (DYNAMODB_SAGAS_TABLE_NAME)
+	outboxTable    string      // events awaiting the outbox relay (DYNAMODB_OUTBOX_TABLE_NAME)
+	ids            IDGenerator // cart_id / order_id generator (Snowflake or ULID)
+	maxRetries     int         // retries of a conflicting conditional write before giving up
 }
 
-// Cart item structure for embedded JSON
-type CartItem struct {
-	ProductID int `json:"product_id" dynamodbav:"product_id"`
-	Quantity  int `json:"quantity" dynamodbav:"quantity"`
+// newDynamoDBAPIClient builds the DynamoDB client from the environment. The
+// default configuration uses the task's IAM role; DYNAMODB_ENDPOINT points it
+// at DynamoDB Local or another stand-in instead of AWS.
+func newDynamoDBAPIClient() (*dynamodb.Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(getenv("AWS_REGION", "us-west-2")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		if endpoint := os.Getenv("DYNAMODB_ENDPOINT"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	}), nil
 }
 
 // DynamoDB cart record with embedded items (single-table design)
@@ -37,6 +55,22 @@ type DynamoCart struct {
 	Items      []CartItem `dynamodbav:"items"`
 	CreatedAt  string     `dynamodbav:"created_at"`
 	UpdatedAt  string     `dynamodbav:"updated_at"`
+	Version    int        `dynamodbav:"version"`            // optimistic concurrency token, bumped on every write
+	Status     string     `dynamodbav:"status,omitempty"`   // set on every write; empty only on records untouched since before checkout existed (= OPEN)
+	OrderID    string     `dynamodbav:"order_id,omitempty"` // set once the cart is checked out
+}
+
+// GSI on the orders table for per-customer order history (newest first)
+const ordersByCustomerIndex = "customer_id-created_at-index"
+
+// DynamoDB order record, created by checkout with a copy of the cart's items
+type DynamoOrder struct {
+	OrderID    string     `dynamodbav:"order_id"`
+	CartID     string     `dynamodbav:"cart_id"`
+	CustomerID int        `dynamodbav:"customer_id"`
+	Status     string     `dynamodbav:"status"`
+	Items      []CartItem `dynamodbav:"items"`
+	CreatedAt  string     `dynamodbav:"created_at"`
 }
 
 // Initialize DynamoDB client from environment variables
@@ -46,53 +80,86 @@ func initDynamoDB() (*DynamoDBClient, error) {
 		return nil, fmt.Errorf("missing DYNAMODB_TABLE_NAME environment variable")
 	}
 
-	// Load AWS SDK configuration from environment (uses IAM role credentials)
-	cfg, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(getenv("AWS_REGION", "us-west-2")),
-	)
+	client, err := newDynamoDBAPIClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		return nil, err
+	}
+	// Optionally check (or create) the tables first; see bootstrap.go
+	if err := bootstrapDynamoDBFromEnv(context.Background(), client); err != nil {
+		return nil, err
+	}
+
+	ids, err := newIDGeneratorFromEnv()
+	if err != nil {
+		return nil, err
 	}
 
 	return &DynamoDBClient{
-		client:    dynamodb.NewFromConfig(cfg),
-		tableName: tableName,
+		client:         client,
+		tableName:      tableName,
+		ordersTable:    os.Getenv("DYNAMODB_ORDERS_TABLE_NAME"),
+		productsTable:  os.Getenv("DYNAMODB_PRODUCTS_TABLE_NAME"),
+		inventoryTable: os.Getenv("DYNAMODB_INVENTORY_TABLE_NAME"),
+		paymentsTable:  os.Getenv("DYNAMODB_PAYMENTS_TABLE_NAME"),
+		sagasTable:     os.Getenv("DYNAMODB_SAGAS_TABLE_NAME"),
+		outboxTable:    os.Getenv("DYNAMODB_OUTBOX_TABLE_NAME"),
+		ids:            ids,
+		maxRetries:     getenvInt("DYNAMODB_MAX_RETRIES", 5),
 	}, nil
 }
 
 // Create a new shopping cart in DynamoDB
 func (ddb *DynamoDBClient) CreateCart(ctx context.Context, customerID int) (string, error) {
-	// Generate cart_id using timestamp to make it sortable and quasi-unique
-	// Format: Unix nano timestamp as string for DynamoDB hash key
-	cartID := fmt.Sprintf("%d", time.Now().UnixNano())
 	now := time.Now().UTC().Format(time.RFC3339)
 
-	cart := DynamoCart{
-		CartID:     cartID,
-		CustomerID: customerID,
-		Items:      []CartItem{}, // Empty items array
-		CreatedAt:  now,
-		UpdatedAt:  now,
-	}
+	for attempt := 0; ; attempt++ {
+		cart := DynamoCart{
+			CartID:     ddb.ids.NewID(),
+			CustomerID: customerID,
+			Items:      []CartItem{}, // Empty items array
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Version:    1,
+			Status:     CartStatusOpen,
+		}
 
-	item, err := attributevalue.MarshalMap(cart)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal cart: %w", err)
+		item, err := attributevalue.MarshalMap(cart)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal cart: %w", err)
+		}
+
+		// Never overwrite an existing cart: an ID collision fails the condition
+		_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(ddb.tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(cart_id)"),
+		})
+		if err == nil {
+			return cart.CartID, nil
+		}
+
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return "", fmt.Errorf("failed to put item: %w", err)
+		}
+		if attempt >= ddb.maxRetries {
+			return "", ErrConflict
+		}
+		// Collision: loop and try again with a fresh ID
 	}
+}
 
-	_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(ddb.tableName),
-		Item:      item,
-	})
+// Get a shopping cart by ID
+func (ddb *DynamoDBClient) GetCart(ctx context.Context, cartID string) (*Cart, error) {
+	cart, err := ddb.getDynamoCart(ctx, cartID)
 	if err != nil {
-		return "", fmt.Errorf("failed to put item: %w", err)
+		return nil, err
 	}
-
-	return cartID, nil
+	return dynamoCartToCart(cart), nil
 }
 
-// Get a shopping cart by ID
-func (ddb *DynamoDBClient) GetCart(ctx context.Context, cartID string) (*DynamoCart, error) {
+// Fetch the raw DynamoDB cart record
+func (ddb *DynamoDBClient) getDynamoCart(ctx context.Context, cartID string) (*DynamoCart, error) {
 	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(ddb.tableName),
 		Key: map[string]types.AttributeValue{
@@ -104,7 +171,7 @@ func (ddb *DynamoDBClient) GetCart(ctx context.Context, cartID string) (*DynamoC
 	}
 
 	if result.Item == nil {
-		return nil, errors.New("cart not found")
+		return nil, ErrCartNotFound
 	}
 
 	var cart DynamoCart
@@ -117,186 +184,1212 @@ func (ddb *DynamoDBClient) GetCart(ctx context.Context, cartID string) (*DynamoC
 }
 
 // Add, update, or remove an item from a cart (quantity=0 removes the item)
-func (ddb *DynamoDBClient) UpdateCartItems(ctx context.Context, cartID string, productID, quantity int) error {
-	// First, get the current cart to modify items
-	cart, err := ddb.GetCart(ctx, cartID)
-	if err != nil {
-		return err
-	}
-
-	// Find and update the item in the embedded items list
-	found := false
-	newItems := []CartItem{}
-	
-	for _, item := range cart.Items {
-		if item.ProductID == productID {
-			found = true
-			if quantity > 0 {
-				// Update quantity
-				newItems = append(newItems, CartItem{ProductID: productID, Quantity: quantity})
+func (ddb *DynamoDBClient) UpdateCartItems(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error) {
+	var change CartItemChange
+	err := ddb.updateCart(ctx, cartID, func(cart *DynamoCart) error {
+		if cartStatus(cart) != CartStatusOpen {
+			return ErrCartCheckedOut
+		}
+		// Re-run on every retry, so this is the cart version that gets written over
+		change = CartItemChange{CustomerID: cart.CustomerID}
+
+		// Find and update the item in the embedded items list
+		found := false
+		newItems := []CartItem{}
+
+		for _, item := range cart.Items {
+			if item.ProductID == productID {
+				found = true
+				change.OldQuantity = item.Quantity
+				if quantity > 0 {
+					// Update quantity
+					newItems = append(newItems, CartItem{ProductID: productID, Quantity: quantity})
+				}
+				// If quantity == 0, skip adding (remove item)
+			} else {
+				newItems = append(newItems, item)
 			}
-			// If quantity == 0, skip adding (remove item)
-		} else {
-			newItems = append(newItems, item)
 		}
-	}
 
-	// If not found and quantity > 0, add new item
-	if !found && quantity > 0 {
-		newItems = append(newItems, CartItem{ProductID: productID, Quantity: quantity})
+		// If not found and quantity > 0, add new item
+		if !found && quantity > 0 {
+			newItems = append(newItems, CartItem{ProductID: productID, Quantity: quantity})
+		}
+
+		cart.Items = newItems
+		return nil
+	})
+	return change, err
+}
+
+// Read-modify-write a cart with optimistic concurrency control.
+// The write only succeeds if the version we read is still current; on a
+// conflicting write we re-read and re-apply mutate, up to maxRetries times.
+func (ddb *DynamoDBClient) updateCart(ctx context.Context, cartID string, mutate func(cart *DynamoCart) error) error {
+	for attempt := 0; ; attempt++ {
+		cart, err := ddb.getDynamoCart(ctx, cartID)
+		if err != nil {
+			return err
+		}
+		// Set before mutate, which may keep a timestamp of its own (PutCart)
+		cart.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		// Records written before checkout existed get their status persisted
+		cart.Status = cartStatus(cart)
+		if err := mutate(cart); err != nil {
+			return err
+		}
+
+		// Records written before versioning have no version attribute (read as 0)
+		expected := cart.Version
+		cart.Version++
+
+		item, err := attributevalue.MarshalMap(cart)
+		if err != nil {
+			return fmt.Errorf("failed to marshal updated cart: %w", err)
+		}
+
+		_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(ddb.tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_exists(cart_id) AND (attribute_not_exists(version) OR version = :v)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)},
+			},
+		})
+		if err == nil {
+			return nil
+		}
+
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return fmt.Errorf("failed to update cart: %w", err)
+		}
+		if attempt >= ddb.maxRetries {
+			return ErrConflict
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
 	}
+}
 
-	// Update the cart with new items list
-	cart.Items = newItems
-	cart.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+// PutCart writes c under its own ID, overwriting the stored cart (with a
+// version bump) or creating it. The dual-write mirror uses it to copy MySQL
+// carts, keeping their IDs and timestamps.
+func (ddb *DynamoDBClient) PutCart(ctx context.Context, c *Cart) error {
+	for attempt := 0; ; attempt++ {
+		err := ddb.updateCart(ctx, c.ID, func(cart *DynamoCart) error {
+			copyToDynamoCart(cart, c)
+			return nil
+		})
+		if !errors.Is(err, ErrCartNotFound) {
+			return err
+		}
+		created, err := ddb.ImportCart(ctx, c)
+		if err != nil || created {
+			return err
+		}
+		// Created by someone else in between: overwrite that one
+		if attempt >= ddb.maxRetries {
+			return ErrConflict
+		}
+	}
+}
 
+// ImportCart creates c under its own ID unless a cart with that ID already
+// exists, and reports whether it did. The backfill uses it so it never
+// overwrites a cart the dual-write mirror has already copied.
+func (ddb *DynamoDBClient) ImportCart(ctx context.Context, c *Cart) (bool, error) {
+	cart := DynamoCart{CartID: c.ID, Version: 1}
+	copyToDynamoCart(&cart, c)
 	item, err := attributevalue.MarshalMap(cart)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated cart: %w", err)
+		return false, fmt.Errorf("failed to marshal cart: %w", err)
 	}
-
 	_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(ddb.tableName),
-		Item:      item,
+		TableName:           aws.String(ddb.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(cart_id)"),
 	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update cart: %w", err)
+		return false, fmt.Errorf("failed to put item: %w", err)
 	}
+	return true, nil
+}
 
-	return nil
+// Everything but the key and version of a DynamoDB cart record, from c
+func copyToDynamoCart(cart *DynamoCart, c *Cart) {
+	cart.CustomerID = c.CustomerID
+	cart.Items = append([]CartItem{}, c.Items...)
+	cart.Status = c.Status
+	cart.OrderID = c.OrderID
+	if !c.CreatedAt.IsZero() {
+		cart.CreatedAt = c.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if !c.UpdatedAt.IsZero() {
+		cart.UpdatedAt = c.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	if cart.UpdatedAt == "" {
+		cart.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if cart.CreatedAt == "" {
+		cart.CreatedAt = cart.UpdatedAt
+	}
 }
 
-// Helper function to convert DynamoCart to the API response format
-func dynamoCartToResponse(cart *DynamoCart) map[string]interface{} {
-	items := make([]map[string]interface{}, len(cart.Items))
-	for i, item := range cart.Items {
-		items[i] = map[string]interface{}{
-			"product_id": item.ProductID,
-			"quantity":   item.Quantity,
+// Back off a little (with jitter) so competing writers spread out
+func backoff(ctx context.Context, attempt int) error {
+	d := time.Duration(10*(attempt+1))*time.Millisecond + time.Duration(rand.Intn(10))*time.Millisecond
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// UpsertItem implements CartStore
+func (ddb *DynamoDBClient) UpsertItem(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error) {
+	return ddb.UpdateCartItems(ctx, cartID, productID, quantity)
+}
+
+// RemoveItem implements CartStore
+func (ddb *DynamoDBClient) RemoveItem(ctx context.Context, cartID string, productID int) (CartItemChange, error) {
+	return ddb.UpdateCartItems(ctx, cartID, productID, 0)
+}
+
+// Checkout flips the cart to CHECKED_OUT and writes the order and its
+// order.placed outbox event in a single DynamoDB transaction. The cart update
+// is conditioned on the version we read, so a concurrent item change (or a
+// second checkout) forces a re-read.
+func (ddb *DynamoDBClient) Checkout(ctx context.Context, cartID string, items []CartItem) (string, error) {
+	if ddb.ordersTable == "" {
+		return "", errors.New("missing DYNAMODB_ORDERS_TABLE_NAME environment variable")
+	}
+	if ddb.outboxTable == "" {
+		return "", errors.New("missing DYNAMODB_OUTBOX_TABLE_NAME environment variable")
+	}
+
+	for attempt := 0; ; attempt++ {
+		cart, err := ddb.getDynamoCart(ctx, cartID)
+		if err != nil {
+			return "", err
+		}
+		if cartStatus(cart) != CartStatusOpen {
+			return "", ErrCartCheckedOut
+		}
+		if len(cart.Items) == 0 {
+			return "", ErrCartEmpty
+		}
+		// The version condition below makes sure these are still the items
+		if !sameItems(cart.Items, items) {
+			return "", ErrCartChanged
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		order := DynamoOrder{
+			OrderID:    ddb.ids.NewID(),
+			CartID:     cart.CartID,
+			CustomerID: cart.CustomerID,
+			Status:     OrderStatusPlaced,
+			Items:      cart.Items,
+			CreatedAt:  now,
+		}
+		orderItem, err := attributevalue.MarshalMap(order)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal order: %w", err)
+		}
+		ev, err := orderPlacedOutboxEvent(dynamoOrderToOrder(&order))
+		if err != nil {
+			return "", err
+		}
+		eventItem, err := ddb.outboxItem(ev)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = ddb.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Update: &types.Update{
+					TableName: aws.String(ddb.tableName),
+					Key: map[string]types.AttributeValue{
+						"cart_id": &types.AttributeValueMemberS{Value: cartID},
+					},
+					UpdateExpression:    aws.String("SET #status = :checked_out, order_id = :order_id, updated_at = :now, version = :next"),
+					ConditionExpression: aws.String("attribute_exists(cart_id) AND (attribute_not_exists(version) OR version = :v)"),
+					// "status" is a DynamoDB reserved word
+					ExpressionAttributeNames: map[string]string{"#status": "status"},
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":checked_out": &types.AttributeValueMemberS{Value: CartStatusCheckedOut},
+						":order_id":    &types.AttributeValueMemberS{Value: order.OrderID},
+						":now":         &types.AttributeValueMemberS{Value: now},
+						":next":        &types.AttributeValueMemberN{Value: strconv.Itoa(cart.Version + 1)},
+						":v":           &types.AttributeValueMemberN{Value: strconv.Itoa(cart.Version)},
+					},
+				}},
+				{Put: &types.Put{
+					TableName:           aws.String(ddb.ordersTable),
+					Item:                orderItem,
+					ConditionExpression: aws.String("attribute_not_exists(order_id)"),
+				}},
+				{Put: &types.Put{
+					TableName: aws.String(ddb.outboxTable),
+					Item:      eventItem,
+				}},
+			},
+		})
+		if err == nil {
+			return order.OrderID, nil
+		}
+
+		// A failed condition on either item cancels the whole transaction
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			return "", fmt.Errorf("failed to checkout cart: %w", err)
+		}
+		if attempt >= ddb.maxRetries {
+			return "", ErrConflict
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return "", err
 		}
 	}
+}
 
+// Records written before checkout existed have no status; they are open
+func cartStatus(cart *DynamoCart) string {
+	if cart.Status == "" {
+		return CartStatusOpen
+	}
+	return cart.Status
+}
+
+// Helper function to convert DynamoCart to the backend-neutral Cart
+func dynamoCartToCart(cart *DynamoCart) *Cart {
 	createdAt, _ := time.Parse(time.RFC3339, cart.CreatedAt)
 	updatedAt, _ := time.Parse(time.RFC3339, cart.UpdatedAt)
 
-	return map[string]interface{}{
-		"cart": map[string]interface{}{
-			"cart_id":     cart.CartID,  // String for DynamoDB
-			"customer_id": cart.CustomerID,
-			"status":      "active",
-			"created_at":  createdAt,
-			"updated_at":  updatedAt,
+	return &Cart{
+		ID:         cart.CartID,
+		CustomerID: cart.CustomerID,
+		Status:     cartStatus(cart),
+		CreatedAt:  createdAt,
+		UpdatedAt:  updatedAt,
+		OrderID:    cart.OrderID,
+		Items:      cart.Items,
+	}
+}
+
+/************ OrderStore ************/
+
+// Get an order by ID
+func (ddb *DynamoDBClient) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	if ddb.ordersTable == "" {
+		return nil, errors.New("missing DYNAMODB_ORDERS_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ddb.ordersTable),
+		Key: map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: orderID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrOrderNotFound
+	}
+
+	var order DynamoOrder
+	if err := attributevalue.UnmarshalMap(result.Item, &order); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal order: %w", err)
+	}
+	return dynamoOrderToOrder(&order), nil
+}
+
+// LastEvaluatedKey of the customer index: table key plus index key
+type dynamoOrderCursor struct {
+	OrderID    string `json:"order_id"`
+	CustomerID int    `json:"customer_id"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// Page through a customer's orders using the customer_id/created_at GSI
+func (ddb *DynamoDBClient) ListCustomerOrders(ctx context.Context, customerID, limit int, cursor string) ([]Order, string, error) {
+	if ddb.ordersTable == "" {
+		return nil, "", errors.New("missing DYNAMODB_ORDERS_TABLE_NAME environment variable")
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ddb.ordersTable),
+		IndexName:              aws.String(ordersByCustomerIndex),
+		KeyConditionExpression: aws.String("customer_id = :c"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":c": &types.AttributeValueMemberN{Value: strconv.Itoa(customerID)},
+		},
+		ScanIndexForward: aws.Bool(false), // newest first
+		Limit:            aws.Int32(int32(limit)),
+	}
+	if cursor != "" {
+		var c dynamoOrderCursor
+		if err := decodeCursor(cursor, &c); err != nil {
+			return nil, "", err
+		}
+		if c.CustomerID != customerID {
+			return nil, "", ErrInvalidCursor
+		}
+		input.ExclusiveStartKey = map[string]types.AttributeValue{
+			"order_id":    &types.AttributeValueMemberS{Value: c.OrderID},
+			"customer_id": &types.AttributeValueMemberN{Value: strconv.Itoa(c.CustomerID)},
+			"created_at":  &types.AttributeValueMemberS{Value: c.CreatedAt},
+		}
+	}
+
+	result, err := ddb.client.Query(ctx, input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to query orders: %w", err)
+	}
+
+	var records []DynamoOrder
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &records); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal orders: %w", err)
+	}
+	orders := make([]Order, 0, len(records))
+	for i := range records {
+		orders = append(orders, *dynamoOrderToOrder(&records[i]))
+	}
+
+	next := ""
+	if len(result.LastEvaluatedKey) > 0 && len(records) > 0 {
+		last := records[len(records)-1]
+		next = encodeCursor(dynamoOrderCursor{OrderID: last.OrderID, CustomerID: last.CustomerID, CreatedAt: last.CreatedAt})
+	}
+	return orders, next, nil
+}
+
+func dynamoOrderToOrder(order *DynamoOrder) *Order {
+	createdAt, _ := time.Parse(time.RFC3339, order.CreatedAt)
+	return &Order{
+		ID:         order.OrderID,
+		CartID:     order.CartID,
+		CustomerID: order.CustomerID,
+		Status:     order.Status,
+		CreatedAt:  createdAt,
+		Items:      order.Items,
+	}
+}
+
+/************ ProductStore ************/
+
+// Get a product by ID
+func (ddb *DynamoDBClient) GetProduct(ctx context.Context, productID int) (*Product, error) {
+	if ddb.productsTable == "" {
+		return nil, errors.New("missing DYNAMODB_PRODUCTS_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ddb.productsTable),
+		Key: map[string]types.AttributeValue{
+			"product_id": &types.AttributeValueMemberN{Value: strconv.Itoa(productID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrProductNotFound
+	}
+
+	var p Product
+	if err := attributevalue.UnmarshalMap(result.Item, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal product: %w", err)
+	}
+	return &p, nil
+}
+
+// Create or replace a product's details
+func (ddb *DynamoDBClient) UpsertProduct(ctx context.Context, p Product) error {
+	if ddb.productsTable == "" {
+		return errors.New("missing DYNAMODB_PRODUCTS_TABLE_NAME environment variable")
+	}
+
+	item, err := attributevalue.MarshalMap(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal product: %w", err)
+	}
+	_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ddb.productsTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put product: %w", err)
+	}
+	return nil
+}
+
+/************ InventoryStore ************/
+
+// DynamoDB inventory record. Holds are embedded in the record, so a reserve,
+// ship, release or expiry is one versioned read-modify-write of a single item
+// and the counters can never drift from the holds (same pattern as carts).
+type DynamoInventory struct {
+	ProductID  int             `dynamodbav:"product_id"`
+	OnHand     int             `dynamodbav:"on_hand"`
+	Reserved   int             `dynamodbav:"reserved"`
+	Shipped    int             `dynamodbav:"shipped"`
+	Holds      []inventoryHold `dynamodbav:"holds"`
+	NextExpiry int64           `dynamodbav:"next_expiry,omitempty"` // earliest hold expiry (unix ms), absent without expiring holds
+	Version    int             `dynamodbav:"version"`
+}
+
+func (ddb *DynamoDBClient) inventoryKey(productID int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"product_id": &types.AttributeValueMemberN{Value: strconv.Itoa(productID)},
+	}
+}
+
+// Get a product's stock levels
+func (ddb *DynamoDBClient) GetInventory(ctx context.Context, productID int) (*Inventory, error) {
+	rec, err := ddb.getDynamoInventory(ctx, productID)
+	if err != nil {
+		return nil, err
+	}
+	return &Inventory{ProductID: rec.ProductID, OnHand: rec.OnHand, Reserved: rec.Reserved, Shipped: rec.Shipped}, nil
+}
+
+func (ddb *DynamoDBClient) getDynamoInventory(ctx context.Context, productID int) (*DynamoInventory, error) {
+	if ddb.inventoryTable == "" {
+		return nil, errors.New("missing DYNAMODB_INVENTORY_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(ddb.inventoryTable),
+		Key:            ddb.inventoryKey(productID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get inventory: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrProductNotFound
+	}
+
+	var rec DynamoInventory
+	if err := attributevalue.UnmarshalMap(result.Item, &rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal inventory: %w", err)
+	}
+	return &rec, nil
+}
+
+// Add on-hand stock, creating the record on first restock. ADD on version
+// makes a concurrent versioned write retry instead of overwriting the restock.
+func (ddb *DynamoDBClient) Restock(ctx context.Context, productID, quantity int) error {
+	if ddb.inventoryTable == "" {
+		return errors.New("missing DYNAMODB_INVENTORY_TABLE_NAME environment variable")
+	}
+
+	_, err := ddb.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(ddb.inventoryTable),
+		Key:              ddb.inventoryKey(productID),
+		UpdateExpression: aws.String("ADD on_hand :q, version :one SET reserved = if_not_exists(reserved, :zero), shipped = if_not_exists(shipped, :zero)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":q":    &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
 		},
-		"items": items,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restock inventory: %w", err)
 	}
+	return nil
 }
 
-// DynamoDB-backed handlers
+// Place a hold on available units
+func (ddb *DynamoDBClient) Reserve(ctx context.Context, productID, quantity int, owner string, ttl time.Duration) (string, error) {
+	id := ddb.ids.NewID()
+	err := ddb.updateInventory(ctx, productID, func(rec *DynamoInventory) (bool, error) {
+		if rec.OnHand-rec.Reserved < quantity {
+			return false, ErrInsufficientInventory
+		}
+		rec.Holds = append(rec.Holds, inventoryHold{
+			ReservationID: id,
+			Owner:         owner,
+			Quantity:      quantity,
+			ExpiresAt:     time.Now().Add(ttl).UnixMilli(),
+		})
+		rec.Reserved += quantity
+		return true, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
 
-// Create shopping cart handler for DynamoDB
-func createShoppingCartHandlerDynamo(ddb *DynamoDBClient) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.NotFound(w, r)
-			return
+// Remove reserved units from the warehouse, consuming holds oldest first
+func (ddb *DynamoDBClient) Ship(ctx context.Context, productID, quantity int, owner string) error {
+	return ddb.updateInventory(ctx, productID, func(rec *DynamoInventory) (bool, error) {
+		holds, ok := takeHolds(rec.Holds, owner, quantity)
+		if !ok {
+			return false, ErrInsufficientReserved
 		}
-		
-		var req createCartReq
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
-			return
+		rec.Holds = holds
+		rec.Reserved -= quantity
+		rec.OnHand -= quantity
+		rec.Shipped += quantity
+		return true, nil
+	})
+}
+
+// Drop all of owner's holds on the product
+func (ddb *DynamoDBClient) Release(ctx context.Context, productID int, owner string) (int, error) {
+	var res ReapResult
+	err := ddb.updateInventory(ctx, productID, func(rec *DynamoInventory) (bool, error) {
+		rec.Holds, res = dropHolds(rec.Holds, func(h inventoryHold) bool { return h.Owner == owner })
+		rec.Reserved -= res.Units
+		return res.Units > 0, nil
+	})
+	return res.Units, err
+}
+
+// Stop owner's holds from expiring
+func (ddb *DynamoDBClient) Confirm(ctx context.Context, productID int, owner string) (int, error) {
+	units := 0
+	err := ddb.updateInventory(ctx, productID, func(rec *DynamoInventory) (bool, error) {
+		expiring := false
+		for _, h := range rec.Holds {
+			expiring = expiring || (h.Owner == owner && h.ExpiresAt != 0)
 		}
-		if req.CustomerID < 1 {
-			writeErr(w, 400, "INVALID_INPUT", "customer_id must be >= 1")
-			return
+		units = confirmHolds(rec.Holds, owner)
+		return expiring, nil
+	})
+	return units, err
+}
+
+// ReapExpired scans for records whose earliest hold has expired and drops
+// their expired holds. The versioned write means two replicas reaping the same
+// product cannot both release a hold: the loser re-reads and finds it gone.
+func (ddb *DynamoDBClient) ReapExpired(ctx context.Context, now time.Time, limit int) (ReapResult, error) {
+	if ddb.inventoryTable == "" {
+		return ReapResult{}, errors.New("missing DYNAMODB_INVENTORY_TABLE_NAME environment variable")
+	}
+
+	cutoff := now.UnixMilli()
+	var total ReapResult
+	pages := dynamodb.NewScanPaginator(ddb.client, &dynamodb.ScanInput{
+		TableName:            aws.String(ddb.inventoryTable),
+		ProjectionExpression: aws.String("product_id"),
+		FilterExpression:     aws.String("next_expiry <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(cutoff, 10)},
+		},
+	})
+	for pages.HasMorePages() && total.Reservations < limit {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return total, fmt.Errorf("failed to scan inventory: %w", err)
 		}
+		for _, item := range page.Items {
+			if total.Reservations >= limit {
+				break
+			}
+			var key struct {
+				ProductID int `dynamodbav:"product_id"`
+			}
+			if err := attributevalue.UnmarshalMap(item, &key); err != nil {
+				return total, fmt.Errorf("failed to unmarshal inventory key: %w", err)
+			}
 
-		cartID, err := ddb.CreateCart(context.Background(), req.CustomerID)
+			var res ReapResult
+			err := ddb.updateInventory(ctx, key.ProductID, func(rec *DynamoInventory) (bool, error) {
+				budget := limit - total.Reservations
+				rec.Holds, res = dropHolds(rec.Holds, func(h inventoryHold) bool {
+					if budget == 0 || !h.expired(cutoff) {
+						return false
+					}
+					budget--
+					return true
+				})
+				rec.Reserved -= res.Units
+				return res.Reservations > 0, nil
+			})
+			if err != nil && !errors.Is(err, ErrProductNotFound) {
+				return total, err
+			}
+			total.Reservations += res.Reservations
+			total.Units += res.Units
+		}
+	}
+	return total, nil
+}
+
+// Optimistic read-modify-write of an inventory record, retried on version
+// conflicts like updateCart. mutate returns false when nothing changed, in
+// which case nothing is written.
+func (ddb *DynamoDBClient) updateInventory(ctx context.Context, productID int, mutate func(rec *DynamoInventory) (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		rec, err := ddb.getDynamoInventory(ctx, productID)
 		if err != nil {
-			writeErr(w, 500, "DYNAMODB_ERROR", err.Error())
-			return
+			return err
+		}
+		changed, err := mutate(rec)
+		if err != nil || !changed {
+			return err
 		}
 
-		// Return cart_id as integer for compatibility with MySQL version
-		// Parse the numeric cart_id back to int64
-		cartIDInt, _ := strconv.ParseInt(cartID, 10, 64)
-		writeJSON(w, 201, createCartResp{ShoppingCartID: int(cartIDInt)})
+		expected := rec.Version
+		rec.Version++
+		rec.NextExpiry = 0
+		for _, h := range rec.Holds {
+			if h.ExpiresAt != 0 && (rec.NextExpiry == 0 || h.ExpiresAt < rec.NextExpiry) {
+				rec.NextExpiry = h.ExpiresAt
+			}
+		}
+
+		item, err := attributevalue.MarshalMap(rec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal inventory: %w", err)
+		}
+
+		_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:           aws.String(ddb.inventoryTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_exists(product_id) AND (attribute_not_exists(version) OR version = :v)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)},
+			},
+		})
+		if err == nil {
+			return nil
+		}
+
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return fmt.Errorf("failed to update inventory: %w", err)
+		}
+		if attempt >= ddb.maxRetries {
+			return ErrConflict
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
+	}
+}
+
+/************ PaymentStore ************/
+
+// Record a captured payment; the condition keeps it to one per order
+func (ddb *DynamoDBClient) SavePayment(ctx context.Context, p Payment) error {
+	if ddb.paymentsTable == "" {
+		return errors.New("missing DYNAMODB_PAYMENTS_TABLE_NAME environment variable")
+	}
+
+	item, err := attributevalue.MarshalMap(p)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment: %w", err)
+	}
+	_, err = ddb.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(ddb.paymentsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(order_id)"),
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to put payment: %w", err)
+	}
+	return nil
+}
+
+// Get the payment of an order
+func (ddb *DynamoDBClient) GetOrderPayment(ctx context.Context, orderID string) (*Payment, error) {
+	if ddb.paymentsTable == "" {
+		return nil, errors.New("missing DYNAMODB_PAYMENTS_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ddb.paymentsTable),
+		Key: map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: orderID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrPaymentNotFound
+	}
+
+	var p Payment
+	if err := attributevalue.UnmarshalMap(result.Item, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payment: %w", err)
 	}
+	return &p, nil
 }
 
-// Add items to cart handler for DynamoDB
-func addItemsToCartHandlerDynamo(ddb *DynamoDBClient) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.NotFound(w, r)
-			return
+/************ RefundStore ************/
+
+// The refund ledger lives inside the payment item, so checking a refund
+// against the captured amount and recording it is one versioned write.
+type DynamoPayment struct {
+	Payment
+	Refunds []Refund `dynamodbav:"refunds"`
+	Version int      `dynamodbav:"version"`
+}
+
+func (ddb *DynamoDBClient) getDynamoPayment(ctx context.Context, orderID string) (*DynamoPayment, error) {
+	if ddb.paymentsTable == "" {
+		return nil, errors.New("missing DYNAMODB_PAYMENTS_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ddb.paymentsTable),
+		Key: map[string]types.AttributeValue{
+			"order_id": &types.AttributeValueMemberS{Value: orderID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrPaymentNotFound
+	}
+
+	var p DynamoPayment
+	if err := attributevalue.UnmarshalMap(result.Item, &p); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payment: %w", err)
+	}
+	return &p, nil
+}
+
+// Record a PENDING refund unless the idempotency key was seen before
+func (ddb *DynamoDBClient) BeginRefund(ctx context.Context, r Refund) (*Refund, error) {
+	var out *Refund
+	err := ddb.updatePayment(ctx, r.OrderID, func(p *DynamoPayment) (bool, string, error) {
+		existing, amount, err := planRefund(p.Refunds, p.AmountCents, r)
+		if err != nil || existing != nil {
+			out = existing
+			return false, "", err
 		}
+		nr := r
+		nr.RefundID = ddb.ids.NewID()
+		nr.AmountCents = amount
+		nr.Status = RefundStatusPending
+		p.Refunds = append(p.Refunds, nr)
+		out = &nr
+		return true, "", nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
 
-		// Parse cart_id from URL path
-		after := strings.TrimPrefix(r.URL.Path, "/shopping-carts/")
-		parts := strings.Split(after, "/")
-		if len(parts) < 2 || parts[1] != "items" {
-			http.NotFound(w, r)
-			return
+// Settle a PENDING refund; a success also moves the order's status
+func (ddb *DynamoDBClient) FinishRefund(ctx context.Context, orderID, refundID, status, processorRef string) (*Refund, string, error) {
+	var out *Refund
+	orderStatus := ""
+	err := ddb.updatePayment(ctx, orderID, func(p *DynamoPayment) (bool, string, error) {
+		out, orderStatus = nil, ""
+		for i := range p.Refunds {
+			if p.Refunds[i].RefundID != refundID {
+				continue
+			}
+			if p.Refunds[i].Status != RefundStatusPending {
+				r := p.Refunds[i]
+				out = &r
+				return false, "", nil
+			}
+			p.Refunds[i].Status = status
+			p.Refunds[i].ProcessorRef = processorRef
+			r := p.Refunds[i]
+			out = &r
+			if status == RefundStatusSucceeded {
+				orderStatus = refundedOrderStatus(p.AmountCents, refundedCents(p.Refunds))
+			}
+			return true, orderStatus, nil
+		}
+		return false, "", ErrRefundNotFound
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if orderStatus == "" {
+		order, err := ddb.GetOrder(ctx, orderID)
+		if err != nil {
+			return nil, "", err
 		}
+		orderStatus = order.Status
+	}
+	return out, orderStatus, nil
+}
 
-		cartID := parts[0]
-		if cartID == "" {
-			writeErr(w, 400, "INVALID_INPUT", "cart_id is required")
-			return
+// Get the refund ledger of an order
+func (ddb *DynamoDBClient) ListRefunds(ctx context.Context, orderID string) ([]Refund, error) {
+	p, err := ddb.getDynamoPayment(ctx, orderID)
+	if errors.Is(err, ErrPaymentNotFound) {
+		// Unpaid orders have an empty ledger; unknown orders are a 404
+		if _, err := ddb.GetOrder(ctx, orderID); err != nil {
+			return nil, err
 		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.Refunds, nil
+}
 
-		var req addItemsReq
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
-			return
+// Versioned read-modify-write of a payment item. When mutate returns an order
+// status, the order is updated in the same transaction.
+func (ddb *DynamoDBClient) updatePayment(ctx context.Context, orderID string, mutate func(p *DynamoPayment) (bool, string, error)) error {
+	if ddb.ordersTable == "" {
+		return errors.New("missing DYNAMODB_ORDERS_TABLE_NAME environment variable")
+	}
+
+	for attempt := 0; ; attempt++ {
+		p, err := ddb.getDynamoPayment(ctx, orderID)
+		if err != nil {
+			return err
 		}
-		if req.ProductID < 1 || req.Quantity < 0 {
-			writeErr(w, 400, "INVALID_INPUT", "product_id must be >=1 and quantity >=0")
-			return
+		changed, orderStatus, err := mutate(p)
+		if err != nil || !changed {
+			return err
 		}
 
-		err := ddb.UpdateCartItems(context.Background(), cartID, req.ProductID, req.Quantity)
+		// Payments saved before refunds existed have no version attribute (read as 0)
+		expected := p.Version
+		p.Version++
+		item, err := attributevalue.MarshalMap(p)
 		if err != nil {
-			if err.Error() == "cart not found" {
-				writeErr(w, 404, "NOT_FOUND", "shopping cart not found")
-				return
-			}
-			writeErr(w, 500, "DYNAMODB_ERROR", err.Error())
-			return
+			return fmt.Errorf("failed to marshal payment: %w", err)
 		}
 
-		w.WriteHeader(204)
+		writes := []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(ddb.paymentsTable),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_exists(order_id) AND (attribute_not_exists(version) OR version = :v)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":v": &types.AttributeValueMemberN{Value: strconv.Itoa(expected)},
+				},
+			}},
+		}
+		if orderStatus != "" {
+			writes = append(writes, types.TransactWriteItem{Update: &types.Update{
+				TableName: aws.String(ddb.ordersTable),
+				Key: map[string]types.AttributeValue{
+					"order_id": &types.AttributeValueMemberS{Value: orderID},
+				},
+				UpdateExpression:         aws.String("SET #status = :status"),
+				ConditionExpression:      aws.String("attribute_exists(order_id)"),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":status": &types.AttributeValueMemberS{Value: orderStatus},
+				},
+			}})
+		}
+
+		_, err = ddb.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		if err == nil {
+			return nil
+		}
+
+		var tce *types.TransactionCanceledException
+		if !errors.As(err, &tce) {
+			return fmt.Errorf("failed to update payment: %w", err)
+		}
+		if attempt >= ddb.maxRetries {
+			return ErrConflict
+		}
+		if err := backoff(ctx, attempt); err != nil {
+			return err
+		}
 	}
 }
 
-// Get shopping cart handler for DynamoDB
-func getShoppingCartHandlerDynamo(ddb *DynamoDBClient) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.NotFound(w, r)
-			return
+/************ SagaStore ************/
+
+// DynamoDB saga record; updated_ms repeats UpdatedAt as a number so the
+// recovery scan can compare it
+type DynamoSaga struct {
+	CheckoutSaga
+	UpdatedMs int64 `dynamodbav:"updated_ms"`
+}
+
+// Get the checkout saga of a cart
+func (ddb *DynamoDBClient) GetSaga(ctx context.Context, cartID string) (*CheckoutSaga, error) {
+	if ddb.sagasTable == "" {
+		return nil, errors.New("missing DYNAMODB_SAGAS_TABLE_NAME environment variable")
+	}
+
+	result, err := ddb.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(ddb.sagasTable),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]types.AttributeValue{
+			"cart_id": &types.AttributeValueMemberS{Value: cartID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get saga: %w", err)
+	}
+	if result.Item == nil {
+		return nil, ErrSagaNotFound
+	}
+
+	var rec DynamoSaga
+	if err := attributevalue.UnmarshalMap(result.Item, &rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal saga: %w", err)
+	}
+	return &rec.CheckoutSaga, nil
+}
+
+// Save a saga if nobody else saved it since it was read; not retried, a
+// conflict means another request or task owns the saga now
+func (ddb *DynamoDBClient) SaveSaga(ctx context.Context, s *CheckoutSaga) error {
+	if ddb.sagasTable == "" {
+		return errors.New("missing DYNAMODB_SAGAS_TABLE_NAME environment variable")
+	}
+
+	rec := DynamoSaga{CheckoutSaga: *s, UpdatedMs: s.UpdatedAt.UnixMilli()}
+	rec.Version++
+	item, err := attributevalue.MarshalMap(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal saga: %w", err)
+	}
+	input := &dynamodb.PutItemInput{
+		TableName:           aws.String(ddb.sagasTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(cart_id)"),
+	}
+	if s.Version > 0 {
+		input.ConditionExpression = aws.String("version = :v")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.Itoa(s.Version)},
 		}
+	}
+	_, err = ddb.client.PutItem(ctx, input)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to put saga: %w", err)
+	}
+	s.Version++
+	return nil
+}
+
+// Scan for RUNNING sagas not saved since before
+func (ddb *DynamoDBClient) ListStaleSagas(ctx context.Context, before time.Time, limit int) ([]CheckoutSaga, error) {
+	if ddb.sagasTable == "" {
+		return nil, errors.New("missing DYNAMODB_SAGAS_TABLE_NAME environment variable")
+	}
 
-		// Parse cart_id from URL path
-		after := strings.TrimPrefix(r.URL.Path, "/shopping-carts/")
-		cartID := after
-		if cartID == "" {
-			writeErr(w, 400, "INVALID_INPUT", "cart_id is required")
-			return
+	var out []CheckoutSaga
+	pages := dynamodb.NewScanPaginator(ddb.client, &dynamodb.ScanInput{
+		TableName:                aws.String(ddb.sagasTable),
+		ConsistentRead:           aws.Bool(true),
+		FilterExpression:         aws.String("#status = :running AND updated_ms < :before"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":running": &types.AttributeValueMemberS{Value: SagaStatusRunning},
+			":before":  &types.AttributeValueMemberN{Value: strconv.FormatInt(before.UnixMilli(), 10)},
+		},
+	})
+	for pages.HasMorePages() && len(out) < limit {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return out, fmt.Errorf("failed to scan sagas: %w", err)
 		}
+		for _, item := range page.Items {
+			if len(out) >= limit {
+				break
+			}
+			var rec DynamoSaga
+			if err := attributevalue.UnmarshalMap(item, &rec); err != nil {
+				return out, fmt.Errorf("failed to unmarshal saga: %w", err)
+			}
+			out = append(out, rec.CheckoutSaga)
+		}
+	}
+	return out, nil
+}
+
+/************ OutboxStore ************/
+
+// GSI on the outbox table over unsent events only: "pending" is set on write
+// and removed once the event is sent, so sent events drop out of the index
+const outboxPendingIndex = "pending-index"
+
+// DynamoDB outbox record; times are epoch milliseconds so the index can range over them
+type DynamoOutboxEvent struct {
+	EventID       string `dynamodbav:"event_id"`
+	EventType     string `dynamodbav:"event_type"`
+	Payload       string `dynamodbav:"payload"`
+	Attempts      int    `dynamodbav:"attempts"`
+	LastError     string `dynamodbav:"last_error"`
+	CreatedMs     int64  `dynamodbav:"created_ms"`
+	NextAttemptMs int64  `dynamodbav:"next_attempt_ms"`
+	Pending       string `dynamodbav:"pending,omitempty"` // "1" until sent
+}
 
-		cart, err := ddb.GetCart(context.Background(), cartID)
+// Build the outbox item for ev, due right away
+func (ddb *DynamoDBClient) outboxItem(ev OutboxEvent) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(DynamoOutboxEvent{
+		EventID:       ddb.ids.NewID(),
+		EventType:     ev.EventType,
+		Payload:       ev.Payload,
+		CreatedMs:     ev.CreatedAt.UnixMilli(),
+		NextAttemptMs: ev.CreatedAt.UnixMilli(),
+		Pending:       "1",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal outbox event: %w", err)
+	}
+	return item, nil
+}
+
+// Query the pending index for events due at now, then claim each one with a
+// conditional update of the next_attempt_ms the query saw: of two relays that
+// saw the same event only one claims it, and an index entry that is behind the
+// table fails the condition. IDs are time-ordered, so the batch is sorted
+// oldest first after the query.
+func (ddb *DynamoDBClient) ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEvent, error) {
+	if ddb.outboxTable == "" {
+		return nil, errors.New("missing DYNAMODB_OUTBOX_TABLE_NAME environment variable")
+	}
+
+	var out []OutboxEvent
+	pages := dynamodb.NewQueryPaginator(ddb.client, &dynamodb.QueryInput{
+		TableName:              aws.String(ddb.outboxTable),
+		IndexName:              aws.String(outboxPendingIndex),
+		KeyConditionExpression: aws.String("pending = :p AND next_attempt_ms <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":p":   &types.AttributeValueMemberS{Value: "1"},
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)},
+		},
+	})
+	for pages.HasMorePages() && len(out) < limit {
+		page, err := pages.NextPage(ctx)
 		if err != nil {
-			if err.Error() == "cart not found" {
-				writeErr(w, 404, "NOT_FOUND", "shopping cart not found")
-				return
+			return out, fmt.Errorf("failed to query outbox: %w", err)
+		}
+		for _, item := range page.Items {
+			if len(out) >= limit {
+				break
+			}
+			var rec DynamoOutboxEvent
+			if err := attributevalue.UnmarshalMap(item, &rec); err != nil {
+				return out, fmt.Errorf("failed to unmarshal outbox event: %w", err)
+			}
+			claimed, err := ddb.claimEvent(ctx, rec, now.Add(lease))
+			if err != nil {
+				return out, err
 			}
-			writeErr(w, 500, "DYNAMODB_ERROR", err.Error())
-			return
+			if !claimed {
+				continue
+			}
+			out = append(out, OutboxEvent{
+				ID:        rec.EventID,
+				EventType: rec.EventType,
+				Payload:   rec.Payload,
+				Attempts:  rec.Attempts,
+				LastError: rec.LastError,
+				CreatedAt: time.UnixMilli(rec.CreatedMs).UTC(),
+			})
 		}
+	}
+	slices.SortFunc(out, func(a, b OutboxEvent) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return out, nil
+}
+
+// claimEvent moves the event's next attempt to until if no one else has
+// claimed (or sent, or rescheduled) it since rec was read
+func (ddb *DynamoDBClient) claimEvent(ctx context.Context, rec DynamoOutboxEvent, until time.Time) (bool, error) {
+	_, err := ddb.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ddb.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"event_id": &types.AttributeValueMemberS{Value: rec.EventID},
+		},
+		UpdateExpression:    aws.String("SET next_attempt_ms = :until"),
+		ConditionExpression: aws.String("attribute_exists(pending) AND next_attempt_ms = :seen"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":until": &types.AttributeValueMemberN{Value: strconv.FormatInt(until.UnixMilli(), 10)},
+			":seen":  &types.AttributeValueMemberN{Value: strconv.FormatInt(rec.NextAttemptMs, 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim outbox event: %w", err)
+	}
+	return true, nil
+}
 
-		resp := dynamoCartToResponse(cart)
-		writeJSON(w, 200, resp)
+// Drop the event out of the pending index; the table's TTL on expires_at
+// (epoch seconds) deletes it once OUTBOX_RETENTION has passed
+func (ddb *DynamoDBClient) MarkEventSent(ctx context.Context, id string) error {
+	if ddb.outboxTable == "" {
+		return errors.New("missing DYNAMODB_OUTBOX_TABLE_NAME environment variable")
 	}
+
+	_, err := ddb.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ddb.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"event_id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("REMOVE pending SET sent_ms = :now, expires_at = :expires"),
+		ConditionExpression: aws.String("attribute_exists(event_id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().UnixMilli(), 10)},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(outboxRetention()).Unix(), 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		return fmt.Errorf("failed to mark outbox event sent: %w", err)
+	}
+	return nil
+}
+
+// Count the failure and push the event's next attempt back to retryAt
+func (ddb *DynamoDBClient) MarkEventFailed(ctx context.Context, id, reason string, retryAt time.Time) error {
+	if ddb.outboxTable == "" {
+		return errors.New("missing DYNAMODB_OUTBOX_TABLE_NAME environment variable")
+	}
+
+	_, err := ddb.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(ddb.outboxTable),
+		Key: map[string]types.AttributeValue{
+			"event_id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("ADD attempts :one SET last_error = :reason, next_attempt_ms = :retry"),
+		ConditionExpression: aws.String("attribute_exists(pending)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":    &types.AttributeValueMemberN{Value: "1"},
+			":reason": &types.AttributeValueMemberS{Value: reason},
+			":retry":  &types.AttributeValueMemberN{Value: strconv.FormatInt(retryAt.UnixMilli(), 10)},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if err != nil && !errors.As(err, &ccf) {
+		return fmt.Errorf("failed to mark outbox event failed: %w", err)
+	}
+	return nil
+}
+
+// DynamoDB's TTL deletes sent events (see MarkEventSent)
+func (ddb *DynamoDBClient) PurgeSentEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	return 0, nil
 }
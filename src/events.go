@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// EventPublisher delivers domain events (JSON) to downstream consumers.
+// Publishing is best effort for now: callers log failures and carry on.
+type EventPublisher interface {
+	Publish(ctx context.Context, eventType string, event any) error
+}
+
+// logPublisher writes every event to the log, one line each
+type logPublisher struct{}
+
+func (logPublisher) Publish(ctx context.Context, eventType string, event any) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("event %s %s", eventType, b)
+	return nil
+}
+
+// discardPublisher drops every event
+type discardPublisher struct{}
+
+func (discardPublisher) Publish(ctx context.Context, eventType string, event any) error {
+	return nil
+}
+
+/************ Cart events ************/
+
+// Cart event types, one per cart handler mutation
+const (
+	cartCreatedEventType     = "cart.created"
+	cartItemAddedEventType   = "cart.item_added"
+	cartItemUpdatedEventType = "cart.item_updated"
+	cartItemRemovedEventType = "cart.item_removed"
+	cartCheckedOutEventType  = "cart.checked_out"
+)
+
+// cartEventVersion is bumped on any incompatible change to CartEvent
+const cartEventVersion = 1
+
+// CartEvent is published by the cart handlers after every successful change,
+// for analytics and recommendations. It is built from what the handler and the
+// CartStore report, so it looks the same whichever backend wrote the change;
+// the schema is documented under components/schemas/CartEvent in api.yaml.
+type CartEvent struct {
+	EventType  string `json:"event_type"`
+	Version    int    `json:"version"`
+	CartID     string `json:"cart_id"`
+	CustomerID int    `json:"customer_id"`
+	*CartItemDelta
+	OrderID    string    `json:"order_id,omitempty"` // cart.checked_out only
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// CartItemDelta is the item part of the item events; absent from the others
+type CartItemDelta struct {
+	ProductID   int `json:"product_id"`
+	OldQuantity int `json:"old_quantity"` // 0 for cart.item_added
+	NewQuantity int `json:"new_quantity"` // 0 for cart.item_removed
+}
+
+func newCartEvent(eventType, cartID string, customerID int) CartEvent {
+	return CartEvent{
+		EventType:  eventType,
+		Version:    cartEventVersion,
+		CartID:     cartID,
+		CustomerID: customerID,
+		OccurredAt: time.Now().UTC(),
+	}
+}
+
+// The event for an item change, or false if nothing changed (removing an
+// absent product, or setting the quantity it already had)
+func cartItemEvent(cartID string, productID, newQuantity int, change CartItemChange) (CartEvent, bool) {
+	var eventType string
+	switch {
+	case change.OldQuantity == newQuantity:
+		return CartEvent{}, false
+	case change.OldQuantity == 0:
+		eventType = cartItemAddedEventType
+	case newQuantity == 0:
+		eventType = cartItemRemovedEventType
+	default:
+		eventType = cartItemUpdatedEventType
+	}
+	ev := newCartEvent(eventType, cartID, change.CustomerID)
+	ev.CartItemDelta = &CartItemDelta{ProductID: productID, OldQuantity: change.OldQuantity, NewQuantity: newQuantity}
+	return ev, true
+}
+
+// Cart events are best effort: the change is already committed, so a failed
+// publish is logged and the request still succeeds
+func publishCartEvent(ctx context.Context, events EventPublisher, ev CartEvent) {
+	if err := events.Publish(ctx, ev.EventType, ev); err != nil {
+		log.Printf("cart events: publish %s for cart %s: %v", ev.EventType, ev.CartID, err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDGenerator produces globally unique, roughly time-ordered string IDs.
+// IDs are opaque strings in the API contract, so any backend can store
+// them without lossy conversions.
+type IDGenerator interface {
+	NewID() string
+}
+
+// Select the ID generator from CART_ID_FORMAT ("snowflake" or "ulid")
+func newIDGeneratorFromEnv() (IDGenerator, error) {
+	switch format := getenv("CART_ID_FORMAT", "snowflake"); format {
+	case "snowflake":
+		return newSnowflakeGenerator(nodeIDFromEnv()), nil
+	case "ulid":
+		return ulidGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown CART_ID_FORMAT %q", format)
+	}
+}
+
+// Node ID for Snowflake IDs: NODE_ID if set, otherwise a hash of the hostname
+// (the ECS task's hostname is unique per task). A clash of derived node IDs is
+// still caught by the conditional write on create.
+func nodeIDFromEnv() int64 {
+	if v := os.Getenv("NODE_ID"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n & snowflakeMaxNode
+		}
+	}
+	host, _ := os.Hostname()
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(host))
+	return int64(h.Sum32()) & snowflakeMaxNode
+}
+
+/************ Snowflake ************/
+
+// 41 bits of milliseconds since snowflakeEpoch | 10 bits node | 12 bits sequence
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type snowflakeGenerator struct {
+	mu     sync.Mutex
+	node   int64
+	lastMs int64
+	seq    int64
+}
+
+func newSnowflakeGenerator(node int64) *snowflakeGenerator {
+	return &snowflakeGenerator{node: node & snowflakeMaxNode}
+}
+
+func (g *snowflakeGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := time.Since(snowflakeEpoch).Milliseconds()
+	if ms < g.lastMs {
+		// Clock moved backwards: keep issuing from the last timestamp
+		ms = g.lastMs
+	}
+	if ms == g.lastMs {
+		g.seq = (g.seq + 1) & snowflakeMaxSeq
+		if g.seq == 0 {
+			// Sequence exhausted for this millisecond; spin to the next one
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+	g.lastMs = ms
+
+	id := ms<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+	return strconv.FormatInt(id, 10)
+}
+
+/************ ULID ************/
+
+// 48-bit millisecond timestamp + 80 random bits, Crockford base32 (26 chars)
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(fmt.Errorf("read random bytes: %w", err))
+	}
+
+	// 128 bits -> 26 base32 chars (the first char only carries 3 bits)
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -25,13 +28,20 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.WriteHeader(status)
 	if v != nil { _ = json.NewEncoder(w).Encode(v) }
 }
+// 所有错误信息统一脱敏，卡号不会出现在响应里
 func writeErr(w http.ResponseWriter, code int, e, msg string) {
-	writeJSON(w, code, apiErr{Error: e, Message: msg})
+	writeJSON(w, code, apiErr{Error: e, Message: redactPANs(msg)})
 }
 func getenv(key, def string) string {
 	if v := os.Getenv(key); v != "" { return v }
 	return def
 }
+func getenvBool(key string, def bool) bool {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil { return b }
+	}
+	return def
+}
 func getenvInt(key string, def int) int {
 	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
 		if n, err := strconv.Atoi(v); err == nil && n > 0 { return n }
@@ -58,38 +68,66 @@ func openMySQLFromEnv() (*sql.DB, error) {
 	return db, nil
 }
 
-func ensureCartSchema(db *sql.DB) error {
-	ddls := []string{
-		`CREATE TABLE IF NOT EXISTS carts (
-			cart_id     INT AUTO_INCREMENT PRIMARY KEY,
-			customer_id INT NOT NULL,
-			status      ENUM('OPEN','CHECKED_OUT') NOT NULL DEFAULT 'OPEN',
-			created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-			updated_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			INDEX idx_carts_customer (customer_id, created_at)
-		) ENGINE=InnoDB;`,
-		`CREATE TABLE IF NOT EXISTS cart_items (
-			cart_id    INT NOT NULL,
-			product_id INT NOT NULL,
-			quantity   INT NOT NULL,
-			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			PRIMARY KEY (cart_id, product_id),
-			CONSTRAINT fk_cart FOREIGN KEY (cart_id) REFERENCES carts(cart_id) ON DELETE CASCADE
-		) ENGINE=InnoDB;`,
-	}
-	for _, s := range ddls {
-		if _, err := db.Exec(s); err != nil { return err }
-	}
-	return nil
+/************ Handlers: STEP I 三个端点 ************/
+
+// 路径中的 {id}：/shopping-carts/{id}[/suffix]，返回 id 与剩余部分
+func cartPathParts(path string) (cartID string, rest []string) {
+	after := strings.TrimPrefix(path, "/shopping-carts/")
+	parts := strings.Split(after, "/")
+	return parts[0], parts[1:]
 }
 
-/************ Handlers: STEP I 三个端点 ************/
+// CartStore 错误 -> HTTP 状态码（所有后端共用一套映射）
+func writeStoreErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrCartNotFound):
+		writeErr(w, 404, "NOT_FOUND", "shopping cart not found")
+	case errors.Is(err, ErrInvalidCartID):
+		writeErr(w, 400, "INVALID_INPUT", "shoppingCartId must be a positive integer")
+	case errors.Is(err, ErrCartCheckedOut):
+		writeErr(w, 400, "INVALID_STATE", "shopping cart is already checked out")
+	case errors.Is(err, ErrCartEmpty):
+		writeErr(w, 400, "INVALID_STATE", "shopping cart is empty")
+	case errors.Is(err, ErrProductNotFound):
+		writeErr(w, 404, "PRODUCT_NOT_FOUND", "product not found")
+	case errors.Is(err, ErrInsufficientInventory):
+		writeErr(w, 400, "INSUFFICIENT_INVENTORY", "insufficient inventory")
+	case errors.Is(err, ErrInsufficientReserved):
+		writeErr(w, 400, "INSUFFICIENT_RESERVED", "insufficient reserved inventory")
+	case errors.Is(err, ErrOrderNotFound):
+		writeErr(w, 404, "NOT_FOUND", "order not found")
+	case errors.Is(err, ErrInvalidOrderID):
+		writeErr(w, 400, "INVALID_INPUT", "orderId is not a valid order id")
+	case errors.Is(err, ErrInvalidCursor):
+		writeErr(w, 400, "INVALID_INPUT", "cursor is invalid")
+	case errors.Is(err, ErrPaymentDeclined):
+		writeErr(w, 402, "PAYMENT_DECLINED", err.Error())
+	case errors.Is(err, ErrPaymentTimeout):
+		writeErr(w, 504, "PAYMENT_TIMEOUT", "payment processor did not answer in time, please retry")
+	case errors.Is(err, ErrPaymentNotFound):
+		writeErr(w, 404, "NOT_FOUND", "payment not found")
+	case errors.Is(err, ErrRefundNotFound):
+		writeErr(w, 404, "NOT_FOUND", "refund not found")
+	case errors.Is(err, ErrRefundExceedsCapture):
+		writeErr(w, 400, "REFUND_EXCEEDS_CAPTURE", "refund exceeds the amount left to refund")
+	case errors.Is(err, ErrIdempotencyConflict):
+		writeErr(w, 409, "IDEMPOTENCY_CONFLICT", "idempotency_key was already used with a different amount")
+	case errors.Is(err, ErrCartChanged):
+		writeErr(w, 409, "CART_CHANGED", "shopping cart items changed during checkout, please retry")
+	case errors.Is(err, ErrCheckoutInProgress):
+		writeErr(w, 409, "CHECKOUT_IN_PROGRESS", "a checkout of this cart is already in progress, please retry")
+	case errors.Is(err, ErrConflict):
+		writeErr(w, 409, "CONFLICT", "shopping cart is being modified concurrently, please retry")
+	default:
+		writeErr(w, 500, "DB_ERROR", err.Error())
+	}
+}
 
 // 1) POST /shopping-carts  —— 创建购物车
 type createCartReq struct{ CustomerID int `json:"customer_id"` }
-type createCartResp struct{ ShoppingCartID int `json:"shopping_cart_id"` }
+type createCartResp struct{ ShoppingCartID string `json:"shopping_cart_id"` } // 不透明字符串 ID，各后端通用
 
-func createShoppingCartHandler(db *sql.DB) http.HandlerFunc {
+func createShoppingCartHandler(store CartStore, events EventPublisher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.NotFound(w, r); return }
 		var req createCartReq
@@ -99,10 +137,10 @@ func createShoppingCartHandler(db *sql.DB) http.HandlerFunc {
 		if req.CustomerID < 1 {
 			writeErr(w, 400, "INVALID_INPUT", "customer_id must be >= 1"); return
 		}
-		res, err := db.Exec(`INSERT INTO carts (customer_id) VALUES (?)`, req.CustomerID)
-		if err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-		id64, _ := res.LastInsertId()
-		writeJSON(w, 201, createCartResp{ShoppingCartID: int(id64)})
+		cartID, err := store.CreateCart(r.Context(), req.CustomerID)
+		if err != nil { writeStoreErr(w, err); return }
+		publishCartEvent(r.Context(), events, newCartEvent(cartCreatedEventType, cartID, req.CustomerID))
+		writeJSON(w, 201, createCartResp{ShoppingCartID: cartID})
 	}
 }
 
@@ -111,16 +149,14 @@ type addItemsReq struct {
 	ProductID int `json:"product_id"`
 	Quantity  int `json:"quantity"`
 }
-func addItemsToCartHandler(db *sql.DB) http.HandlerFunc {
+// products == nil 时跳过商品存在性校验（CART_VALIDATE_PRODUCTS=false，压测用合成 product_id）
+func addItemsToCartHandler(store CartStore, products ProductStore, events EventPublisher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost { http.NotFound(w, r); return }
-		after := strings.TrimPrefix(r.URL.Path, "/shopping-carts/")
-		parts := strings.Split(after, "/")
-		if len(parts) < 2 || parts[1] != "items" { http.NotFound(w, r); return }
-
-		cartID, err := strconv.Atoi(parts[0])
-		if err != nil || cartID < 1 {
-			writeErr(w, 400, "INVALID_INPUT", "shoppingCartId must be a positive integer"); return
+		cartID, rest := cartPathParts(r.URL.Path)
+		if len(rest) != 1 || rest[0] != "items" { http.NotFound(w, r); return }
+		if cartID == "" {
+			writeErr(w, 400, "INVALID_INPUT", "shoppingCartId is required"); return
 		}
 		var req addItemsReq
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -129,97 +165,100 @@ func addItemsToCartHandler(db *sql.DB) http.HandlerFunc {
 		if req.ProductID < 1 || req.Quantity < 0 {
 			writeErr(w, 400, "INVALID_INPUT", "product_id must be >=1 and quantity >=0"); return
 		}
-
-		tx, err := db.Begin()
-		if err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-		defer tx.Rollback()
-
-		// cart 存在性检查（避免向不存在购物车写入）
-		var ok int
-		if err := tx.QueryRow(`SELECT 1 FROM carts WHERE cart_id=?`, cartID).Scan(&ok); err != nil {
-			if errors.Is(err, sql.ErrNoRows) { writeErr(w, 404, "NOT_FOUND", "shopping cart not found"); return }
-			writeErr(w, 500, "DB_ERROR", err.Error()); return
+		// 只校验加购/改数量；删除不存在的商品本身就是 no-op
+		if products != nil && req.Quantity > 0 {
+			if _, err := products.GetProduct(r.Context(), req.ProductID); err != nil { writeStoreErr(w, err); return }
 		}
 
-		// quantity==0 -> 删除该商品
+		var change CartItemChange
+		var err error
 		if req.Quantity == 0 {
-			if _, err := tx.Exec(`DELETE FROM cart_items WHERE cart_id=? AND product_id=?`, cartID, req.ProductID); err != nil {
-				writeErr(w, 500, "DB_ERROR", err.Error()); return
-			}
-			if _, err := tx.Exec(`UPDATE carts SET updated_at=NOW() WHERE cart_id=?`, cartID); err != nil {
-				writeErr(w, 500, "DB_ERROR", err.Error()); return
-			}
-			if err := tx.Commit(); err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-			w.WriteHeader(204)
-			return
+			// quantity==0 -> 删除该商品
+			change, err = store.RemoveItem(r.Context(), cartID, req.ProductID)
+		} else {
+			change, err = store.UpsertItem(r.Context(), cartID, req.ProductID, req.Quantity)
 		}
-
-		// upsert：并发安全 & 幂等更新
-		if _, err := tx.Exec(`
-			INSERT INTO cart_items (cart_id, product_id, quantity)
-			VALUES (?, ?, ?)
-			ON DUPLICATE KEY UPDATE quantity=VALUES(quantity)
-		`, cartID, req.ProductID, req.Quantity); err != nil {
-			writeErr(w, 500, "DB_ERROR", err.Error()); return
-		}
-		if _, err := tx.Exec(`UPDATE carts SET updated_at=NOW() WHERE cart_id=?`, cartID); err != nil {
-			writeErr(w, 500, "DB_ERROR", err.Error()); return
-		}
-		if err := tx.Commit(); err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
+		if err != nil { writeStoreErr(w, err); return }
+		// 数量没变（删除不存在的商品 / 设成原数量）不发事件
+		if ev, ok := cartItemEvent(cartID, req.ProductID, req.Quantity, change); ok { publishCartEvent(r.Context(), events, ev) }
 		w.WriteHeader(204)
 	}
 }
 
-// 3) GET /shopping-carts/{id}  —— 高效整单查询（两次定点查询，<50ms）
+// 3) GET /shopping-carts/{id}  —— 整单查询
+// 所有后端同一份响应（api.yaml ShoppingCart）：cart_id 为字符串，status 为 OPEN / CHECKED_OUT，
+// 时间统一为 UTC、精确到秒的 RFC3339，items 按 product_id 升序；contract_test.go 校验
 type cartDTO struct {
-	CartID     int       `json:"cart_id"`
+	CartID     string    `json:"cart_id"`
 	CustomerID int       `json:"customer_id"`
 	Status     string    `json:"status"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
-}
-type cartItemDTO struct {
-	ProductID int `json:"product_id"`
-	Quantity  int `json:"quantity"`
+	OrderID    string    `json:"order_id,omitempty"` // checkout 之后才有
 }
 type getCartResp struct {
-	Cart  cartDTO       `json:"cart"`
-	Items []cartItemDTO `json:"items"`
+	Cart  cartDTO    `json:"cart"`
+	Items []CartItem `json:"items"`
 }
-func getShoppingCartHandler(db *sql.DB) http.HandlerFunc {
+func newGetCartResp(c *Cart) getCartResp {
+	items := append([]CartItem{}, c.Items...)
+	slices.SortFunc(items, func(a, b CartItem) int { return a.ProductID - b.ProductID })
+	return getCartResp{
+		Cart:  cartDTO{CartID: c.ID, CustomerID: c.CustomerID, Status: c.Status, CreatedAt: cartTimestamp(c.CreatedAt), UpdatedAt: cartTimestamp(c.UpdatedAt), OrderID: c.OrderID},
+		Items: items,
+	}
+}
+// MySQL TIMESTAMP 与 DynamoDB 的 RFC3339 字符串都只到秒，内存后端也截到秒
+func cartTimestamp(t time.Time) time.Time { return t.UTC().Truncate(time.Second) }
+func getShoppingCartHandler(store CartStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet { http.NotFound(w, r); return }
-		after := strings.TrimPrefix(r.URL.Path, "/shopping-carts/")
-		if after == "" || strings.Contains(after, "/") { http.NotFound(w, r); return }
-
-		cartID, err := strconv.Atoi(after)
-		if err != nil || cartID < 1 {
-			writeErr(w, 400, "INVALID_INPUT", "shoppingCartId must be positive int"); return
-		}
+		cartID, rest := cartPathParts(r.URL.Path)
+		if cartID == "" || len(rest) != 0 { http.NotFound(w, r); return }
 
-		// 1) 主键查 cart
-		var c cartDTO
-		err = db.QueryRow(`SELECT cart_id, customer_id, status, created_at, updated_at FROM carts WHERE cart_id=?`, cartID).
-			Scan(&c.CartID, &c.CustomerID, &c.Status, &c.CreatedAt, &c.UpdatedAt)
-		if errors.Is(err, sql.ErrNoRows) { writeErr(w, 404, "NOT_FOUND", "cart not found"); return }
-		if err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
+		c, err := store.GetCart(r.Context(), cartID)
+		if err != nil { writeStoreErr(w, err); return }
+		writeJSON(w, 200, newGetCartResp(c))
+	}
+}
 
-		// 2) 覆盖索引/主键查 items（最多 50）
-		rows, err := db.Query(`SELECT product_id, quantity FROM cart_items WHERE cart_id=? LIMIT 50`, cartID)
-		if err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-		defer rows.Close()
+// 4) POST /shopping-carts/{id}/checkout  —— 付款结账：与 /payments/checkout 走同一个 saga（预留 → 扣款 → 下单），
+// 没有不付款就生成订单的路径
+type checkoutReq struct{ CreditCardNumber string `json:"credit_card_number"` }
 
-		items := make([]cartItemDTO, 0, 16)
-		for rows.Next() {
-			var it cartItemDTO
-			if err := rows.Scan(&it.ProductID, &it.Quantity); err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-			items = append(items, it)
+func checkoutCartHandler(checkout *paidCheckout) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost { http.NotFound(w, r); return }
+		cartID, rest := cartPathParts(r.URL.Path)
+		if len(rest) != 1 || rest[0] != "checkout" { http.NotFound(w, r); return }
+		if cartID == "" {
+			writeErr(w, 400, "INVALID_INPUT", "shoppingCartId is required"); return
+		}
+		var req checkoutReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON"); return
 		}
-		if err := rows.Err(); err != nil { writeErr(w, 500, "DB_ERROR", err.Error()); return }
-		writeJSON(w, 200, getCartResp{Cart: c, Items: items})
+		if resp := checkout.pay(w, r, cartID, req.CreditCardNumber); resp != nil { writeJSON(w, 200, resp) }
 	}
 }
 
+// 所有购物车路由只注册一次，后端通过 CartStore 注入；每次修改后经 events 发布 CartEvent，结账经 checkout（付款 saga）
+func registerCartRoutes(mux *http.ServeMux, store CartStore, products ProductStore, events EventPublisher, checkout *paidCheckout) {
+	mux.HandleFunc("/shopping-carts", createShoppingCartHandler(store, events)) // POST
+	mux.HandleFunc("/shopping-carts/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/shopping-carts/"), "/"):
+			getShoppingCartHandler(store)(w, r); return
+		case strings.HasSuffix(r.URL.Path, "/items"):
+			addItemsToCartHandler(store, products, events)(w, r); return
+		case strings.HasSuffix(r.URL.Path, "/checkout"):
+			checkoutCartHandler(checkout)(w, r); return
+		default:
+			http.NotFound(w, r); return
+		}
+	})
+}
+
 /************ 健康检查 ************/
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -227,47 +266,119 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 /************ main ************/
+
+// 根据 DB_BACKEND 选择 Store 实现
+func newStore(backend string) (Store, error) {
+	switch backend {
+	case "dynamodb":
+		ddb, err := initDynamoDB()
+		if err != nil { return nil, fmt.Errorf("init DynamoDB: %w", err) }
+		return ddb, nil
+	case "dualwrite":
+		// 迁移期：MySQL 为主，购物车写入同步镜像到 DynamoDB，不一致记入 cart_divergences
+		primary, err := initMySQL()
+		if err != nil { return nil, err }
+		secondary, err := initDynamoDB()
+		if err != nil { return nil, fmt.Errorf("init DynamoDB: %w", err) }
+		return newDualWriteStore(primary, secondary), nil
+	case "memory":
+		// 本地开发 / CI：无需 RDS 或 DynamoDB，进程重启即清空
+		return newMemoryStore(), nil
+	default:
+		// mysql；其它取值与以前一样回落到 MySQL
+		if backend != "mysql" { log.Printf("unknown DB_BACKEND %q, using mysql", backend) }
+		s, err := initMySQL()
+		if err != nil { return nil, err }
+		return s, nil
+	}
+}
+
 func main() {
+	// 日志统一经过卡号脱敏
+	log.SetOutput(redactingWriter{w: os.Stderr})
+
+	// 子命令 ./app dlq：查看 / 重放订单队列的死信，不需要存储
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		if err := runDLQ(os.Args[2:], os.Stdout); err != nil { log.Fatal(err) }
+		return
+	}
+
+	// 子命令 ./app projector：把 DynamoDB 购物车表的 stream 投影到 MySQL（报表用）；DB_BACKEND=dualwrite 时拒绝运行
+	if len(os.Args) > 1 && os.Args[1] == "projector" {
+		if err := runProjector(); err != nil { log.Fatal(err) }
+		return
+	}
+
+	// 子命令 ./app dynamodb-bootstrap [-check]：检查 / 创建 DynamoDB 表与 GSI（DynamoDB Local 等空环境用）
+	if len(os.Args) > 1 && os.Args[1] == "dynamodb-bootstrap" {
+		if err := runDynamoDBBootstrap(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+
+	// 子命令 ./app migrate up/down/status：手动执行 / 回滚 / 查看 MySQL schema 迁移（平时每个任务启动时自动 up）
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil { log.Fatal(err) }
+		return
+	}
+
+	// 子命令 ./app backfill：把 MySQL 已有的购物车复制到 DynamoDB（迁移用，配合 DB_BACKEND=dualwrite）
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		if err := runBackfill(os.Args[2:], os.Stdout); err != nil { log.Fatal(err) }
+		return
+	}
+
 	// Check DB_BACKEND environment variable to determine which backend to use
 	backend := getenv("DB_BACKEND", "mysql") // default to mysql for backward compatibility
-	
+	store, err := newStore(backend)
+	if err != nil { panic(err) }
+	// 子命令 ./app processor：订单队列消费者（ECS processor 任务），不起 HTTP 服务
+	if len(os.Args) > 1 && os.Args[1] == "processor" {
+		if err := runProcessor(store); err != nil { log.Fatal(err) }
+		return
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", healthHandler)
+	var products ProductStore = store
+	if !getenvBool("CART_VALIDATE_PRODUCTS", true) { products = nil }
+	// 事件：QUEUE_BACKEND=log（默认，只打日志）/ aws（SNS → SQS）/ memory（进程内队列，processor 也跑在本进程）
+	pub, queue, dlq, err := newQueueFromEnv()
+	if err != nil { panic(err) }
+	var events EventPublisher = logPublisher{}
+	if pub != nil { events = queuePublisher{pub: pub} }
+	// 购物车事件走同一个 publisher；CART_EVENTS=false 时丢弃（压测时避免每次修改都发 SNS / 打日志）
+	var cartEvents EventPublisher = events
+	if !getenvBool("CART_EVENTS", true) { cartEvents = discardPublisher{} }
+	processor, err := newPaymentProcessorFromEnv()
+	if err != nil { panic(err) }
+	tokenizer, err := newCardTokenizerFromEnv()
+	if err != nil { panic(err) }
+	// 支付结账 saga：预留 → 扣款 → 下单；两个结账端点都只走它，崩溃遗留的 saga 由恢复任务补偿或继续
+	orchestrator := newCheckoutOrchestrator(store, processor)
+	go orchestrator.Recover(context.Background())
+	checkout := newPaidCheckout(store, orchestrator, tokenizer, cartEvents)
+	registerCartRoutes(mux, store, products, cartEvents, checkout)
+	registerPaymentRoutes(mux, checkout)
+	registerProductRoutes(mux, store)
+	// 过期预留回收：每个副本各跑一个，store 保证并发安全
+	reaper := newReservationReaper(store)
+	go reaper.Run(context.Background())
+	registerWarehouseRoutes(mux, store, reaper)
+	if _, ok := queue.(*memoryQueue); ok { startProcessor(context.Background(), store, processor, queue, dlq) }
+	// 发件箱 relay：把随结账事务写入的 order.placed 发布出去；每个副本各跑一个，至少一次投递
+	relay := newOutboxRelay(store, events)
+	go relay.Run(context.Background())
+	mux.HandleFunc("/outbox/relay", relay.statsHandler)
+	registerOrderRoutes(mux, store, refundsHandler(store, store, store, processor, events))
+	if dw, ok := store.(*DualWriteStore); ok { mux.HandleFunc("/migration/dual-write", dw.statsHandler) }
 
-	if backend == "dynamodb" {
-		// DynamoDB backend initialization
-		ddb, err := initDynamoDB()
-		if err != nil { panic(fmt.Errorf("init DynamoDB: %w", err)) }
-		
-		mux.HandleFunc("/shopping-carts", createShoppingCartHandlerDynamo(ddb)) // POST
-		mux.HandleFunc("/shopping-carts/", func(w http.ResponseWriter, r *http.Request) {
-			switch {
-			case r.Method == http.MethodGet && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/shopping-carts/"), "/"):
-				getShoppingCartHandlerDynamo(ddb)(w, r); return
-			case strings.HasSuffix(r.URL.Path, "/items"):
-				addItemsToCartHandlerDynamo(ddb)(w, r); return
-			default:
-				http.NotFound(w, r); return
-			}
-		})
-	} else {
-		// MySQL backend initialization (default)
-		db, err := openMySQLFromEnv()
-		if err != nil { panic(fmt.Errorf("open DB: %w", err)) }
-		if err := ensureCartSchema(db); err != nil { panic(fmt.Errorf("ensure schema: %w", err)) }
-		
-		mux.HandleFunc("/shopping-carts", createShoppingCartHandler(db)) // POST
-		mux.HandleFunc("/shopping-carts/", func(w http.ResponseWriter, r *http.Request) {
-			switch {
-			case r.Method == http.MethodGet && !strings.Contains(strings.TrimPrefix(r.URL.Path, "/shopping-carts/"), "/"):
-				getShoppingCartHandler(db)(w, r); return
-			case strings.HasSuffix(r.URL.Path, "/items"):
-				addItemsToCartHandler(db)(w, r); return
-			default:
-				http.NotFound(w, r); return
-			}
-		})
-	}
+	// 运维监听（ADMIN_ADDR，默认只绑本机）：补货、释放任意 owner 的预留；ALB 与安全组都不放行，用 ECS Exec 在任务内调用
+	admin := http.NewServeMux()
+	registerWarehouseAdminRoutes(admin, store)
+	adminSrv := &http.Server{ Addr: getenv("ADMIN_ADDR", "127.0.0.1:8081"), Handler: admin }
+	go func() {
+		if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) { panic(err) }
+	}()
 
 	port := getenvInt("PORT", 8080)
 	srv := &http.Server{ Addr: fmt.Sprintf(":%d", port), Handler: mux }
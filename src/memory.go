@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process Store for local development and CI.
+// It follows the same semantics as the MySQL backend (numeric cart IDs,
+// quantity=0 removes, upsert of existing products) but keeps everything in
+// a map guarded by a mutex, so nothing survives a restart.
+type MemoryStore struct {
+	mu            sync.Mutex
+	nextID        int
+	nextOrderID   int
+	nextReserveID int
+	nextRefundID  int
+	nextEventID   int
+	carts         map[string]*Cart
+	orders        map[string]*Order
+	products      map[int]Product
+	inventory     map[int]*Inventory
+	holds         map[int][]inventoryHold // product ID -> live reservations, oldest first
+	payments      map[string]Payment      // order ID -> payment
+	refunds       map[string][]Refund     // order ID -> refund ledger, oldest first
+	sagas         map[string]CheckoutSaga // cart ID -> checkout saga
+	outbox        []memoryOutboxEvent     // unsent events, oldest first
+}
+
+type memoryOutboxEvent struct {
+	OutboxEvent
+	dueAt time.Time
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		carts:     make(map[string]*Cart),
+		orders:    make(map[string]*Order),
+		products:  make(map[int]Product),
+		inventory: make(map[int]*Inventory),
+		holds:     make(map[int][]inventoryHold),
+		payments:  make(map[string]Payment),
+		refunds:   make(map[string][]Refund),
+		sagas:     make(map[string]CheckoutSaga),
+	}
+}
+
+func (m *MemoryStore) CreateCart(ctx context.Context, customerID int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := strconv.Itoa(m.nextID)
+	now := time.Now().UTC()
+	m.carts[id] = &Cart{
+		ID:         id,
+		CustomerID: customerID,
+		Status:     CartStatusOpen,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Items:      []CartItem{},
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) GetCart(ctx context.Context, cartID string) (*Cart, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.lookup(cartID)
+	if err != nil {
+		return nil, err
+	}
+	// Hand out a copy so callers can't mutate the store without the lock
+	cp := *c
+	cp.Items = append([]CartItem(nil), c.Items...)
+	return &cp, nil
+}
+
+func (m *MemoryStore) UpsertItem(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.lookupOpen(cartID)
+	if err != nil {
+		return CartItemChange{}, err
+	}
+	change := CartItemChange{CustomerID: c.CustomerID}
+	c.UpdatedAt = time.Now().UTC()
+	for i := range c.Items {
+		if c.Items[i].ProductID == productID {
+			change.OldQuantity = c.Items[i].Quantity
+			c.Items[i].Quantity = quantity
+			return change, nil
+		}
+	}
+	c.Items = append(c.Items, CartItem{ProductID: productID, Quantity: quantity})
+	return change, nil
+}
+
+func (m *MemoryStore) RemoveItem(ctx context.Context, cartID string, productID int) (CartItemChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.lookupOpen(cartID)
+	if err != nil {
+		return CartItemChange{}, err
+	}
+	change := CartItemChange{CustomerID: c.CustomerID}
+	c.UpdatedAt = time.Now().UTC()
+	for i := range c.Items {
+		if c.Items[i].ProductID == productID {
+			change.OldQuantity = c.Items[i].Quantity
+			c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			break
+		}
+	}
+	return change, nil
+}
+
+func (m *MemoryStore) Checkout(ctx context.Context, cartID string, items []CartItem) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, err := m.lookupOpen(cartID)
+	if err != nil {
+		return "", err
+	}
+	if len(c.Items) == 0 {
+		return "", ErrCartEmpty
+	}
+	if !sameItems(c.Items, items) {
+		return "", ErrCartChanged
+	}
+
+	m.nextOrderID++
+	id := strconv.Itoa(m.nextOrderID)
+	now := time.Now().UTC()
+	m.orders[id] = &Order{
+		ID:         id,
+		CartID:     c.ID,
+		CustomerID: c.CustomerID,
+		Status:     OrderStatusPlaced,
+		CreatedAt:  now,
+		Items:      append([]CartItem(nil), c.Items...),
+	}
+	ev, err := orderPlacedOutboxEvent(m.orders[id])
+	if err != nil {
+		delete(m.orders, id)
+		return "", err
+	}
+	m.nextEventID++
+	ev.ID = strconv.Itoa(m.nextEventID)
+	m.outbox = append(m.outbox, memoryOutboxEvent{OutboxEvent: ev, dueAt: now})
+	c.Status = CartStatusCheckedOut
+	c.OrderID = id
+	c.UpdatedAt = now
+	return id, nil
+}
+
+// lookupOpen is lookup plus the OPEN check every mutation needs; callers must hold m.mu
+func (m *MemoryStore) lookupOpen(cartID string) (*Cart, error) {
+	c, err := m.lookup(cartID)
+	if err != nil {
+		return nil, err
+	}
+	if c.Status != CartStatusOpen {
+		return nil, ErrCartCheckedOut
+	}
+	return c, nil
+}
+
+// lookup validates the ID like the MySQL backend does; callers must hold m.mu
+func (m *MemoryStore) lookup(cartID string) (*Cart, error) {
+	if id, err := strconv.Atoi(cartID); err != nil || id < 1 {
+		return nil, ErrInvalidCartID
+	}
+	c, ok := m.carts[cartID]
+	if !ok {
+		return nil, ErrCartNotFound
+	}
+	return c, nil
+}
+
+/************ OrderStore ************/
+
+func (m *MemoryStore) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, err := strconv.Atoi(orderID); err != nil || id < 1 {
+		return nil, ErrInvalidOrderID
+	}
+	o, ok := m.orders[orderID]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	return copyOrder(o), nil
+}
+
+// Order IDs are issued in increasing order, so "newest first" is "highest ID first"
+// and the cursor is simply the last ID of the previous page.
+type memoryOrderCursor struct {
+	OrderID int `json:"id"`
+}
+
+func (m *MemoryStore) ListCustomerOrders(ctx context.Context, customerID, limit int, cursor string) ([]Order, string, error) {
+	before := int(^uint(0) >> 1)
+	if cursor != "" {
+		var c memoryOrderCursor
+		if err := decodeCursor(cursor, &c); err != nil {
+			return nil, "", err
+		}
+		before = c.OrderID
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for _, o := range m.orders {
+		id, _ := strconv.Atoi(o.ID)
+		if o.CustomerID == customerID && id < before {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = encodeCursor(memoryOrderCursor{OrderID: ids[limit-1]})
+	}
+	orders := make([]Order, 0, len(ids))
+	for _, id := range ids {
+		orders = append(orders, *copyOrder(m.orders[strconv.Itoa(id)]))
+	}
+	return orders, next, nil
+}
+
+func copyOrder(o *Order) *Order {
+	cp := *o
+	cp.Items = append([]CartItem(nil), o.Items...)
+	return &cp
+}
+
+/************ ProductStore ************/
+
+func (m *MemoryStore) GetProduct(ctx context.Context, productID int) (*Product, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.products[productID]
+	if !ok {
+		return nil, ErrProductNotFound
+	}
+	return &p, nil
+}
+
+func (m *MemoryStore) UpsertProduct(ctx context.Context, p Product) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.products[p.ProductID] = p
+	return nil
+}
+
+/************ InventoryStore ************/
+
+func (m *MemoryStore) GetInventory(ctx context.Context, productID int) (*Inventory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[productID]
+	if !ok {
+		return nil, ErrProductNotFound
+	}
+	cp := *inv
+	return &cp, nil
+}
+
+func (m *MemoryStore) Restock(ctx context.Context, productID, quantity int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[productID]
+	if !ok {
+		inv = &Inventory{ProductID: productID}
+		m.inventory[productID] = inv
+	}
+	inv.OnHand += quantity
+	return nil
+}
+
+func (m *MemoryStore) Reserve(ctx context.Context, productID, quantity int, owner string, ttl time.Duration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[productID]
+	if !ok {
+		return "", ErrProductNotFound
+	}
+	if inv.Available() < quantity {
+		return "", ErrInsufficientInventory
+	}
+	m.nextReserveID++
+	id := strconv.Itoa(m.nextReserveID)
+	m.holds[productID] = append(m.holds[productID], inventoryHold{
+		ReservationID: id,
+		Owner:         owner,
+		Quantity:      quantity,
+		ExpiresAt:     time.Now().Add(ttl).UnixMilli(),
+	})
+	inv.Reserved += quantity
+	return id, nil
+}
+
+func (m *MemoryStore) Ship(ctx context.Context, productID, quantity int, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[productID]
+	if !ok {
+		return ErrProductNotFound
+	}
+	holds, ok := takeHolds(m.holds[productID], owner, quantity)
+	if !ok {
+		return ErrInsufficientReserved
+	}
+	m.holds[productID] = holds
+	inv.Reserved -= quantity
+	inv.OnHand -= quantity
+	inv.Shipped += quantity
+	return nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, productID int, owner string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.inventory[productID]
+	if !ok {
+		return 0, ErrProductNotFound
+	}
+	holds, res := dropHolds(m.holds[productID], func(h inventoryHold) bool { return h.Owner == owner })
+	m.holds[productID] = holds
+	inv.Reserved -= res.Units
+	return res.Units, nil
+}
+
+func (m *MemoryStore) Confirm(ctx context.Context, productID int, owner string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.inventory[productID]; !ok {
+		return 0, ErrProductNotFound
+	}
+	return confirmHolds(m.holds[productID], owner), nil
+}
+
+func (m *MemoryStore) ReapExpired(ctx context.Context, now time.Time, limit int) (ReapResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total ReapResult
+	cutoff := now.UnixMilli()
+	for productID, holds := range m.holds {
+		remaining, res := dropHolds(holds, func(h inventoryHold) bool {
+			if total.Reservations >= limit || !h.expired(cutoff) {
+				return false
+			}
+			total.Reservations++
+			return true
+		})
+		m.holds[productID] = remaining
+		m.inventory[productID].Reserved -= res.Units
+		total.Units += res.Units
+	}
+	return total, nil
+}
+
+/************ PaymentStore ************/
+
+func (m *MemoryStore) SavePayment(ctx context.Context, p Payment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[p.OrderID]; !ok {
+		return ErrOrderNotFound
+	}
+	if _, ok := m.payments[p.OrderID]; ok {
+		return ErrConflict
+	}
+	m.payments[p.OrderID] = p
+	return nil
+}
+
+func (m *MemoryStore) GetOrderPayment(ctx context.Context, orderID string) (*Payment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[orderID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	return &p, nil
+}
+
+/************ RefundStore ************/
+
+func (m *MemoryStore) BeginRefund(ctx context.Context, r Refund) (*Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[r.OrderID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	existing, amount, err := planRefund(m.refunds[r.OrderID], p.AmountCents, r)
+	if err != nil || existing != nil {
+		return existing, err
+	}
+	m.nextRefundID++
+	r.RefundID = strconv.Itoa(m.nextRefundID)
+	r.AmountCents = amount
+	r.Status = RefundStatusPending
+	m.refunds[r.OrderID] = append(m.refunds[r.OrderID], r)
+	return &r, nil
+}
+
+func (m *MemoryStore) FinishRefund(ctx context.Context, orderID, refundID, status, processorRef string) (*Refund, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.payments[orderID]
+	if !ok {
+		return nil, "", ErrPaymentNotFound
+	}
+	o := m.orders[orderID]
+	ledger := m.refunds[orderID]
+	for i := range ledger {
+		if ledger[i].RefundID != refundID {
+			continue
+		}
+		if ledger[i].Status == RefundStatusPending {
+			ledger[i].Status = status
+			ledger[i].ProcessorRef = processorRef
+			if status == RefundStatusSucceeded {
+				o.Status = refundedOrderStatus(p.AmountCents, refundedCents(ledger))
+			}
+		}
+		r := ledger[i]
+		return &r, o.Status, nil
+	}
+	return nil, "", ErrRefundNotFound
+}
+
+func (m *MemoryStore) ListRefunds(ctx context.Context, orderID string) ([]Refund, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[orderID]; !ok {
+		return nil, ErrOrderNotFound
+	}
+	return append([]Refund(nil), m.refunds[orderID]...), nil
+}
+
+/************ SagaStore ************/
+
+func (m *MemoryStore) GetSaga(ctx context.Context, cartID string) (*CheckoutSaga, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sagas[cartID]
+	if !ok {
+		return nil, ErrSagaNotFound
+	}
+	s.Items = append([]CartItem(nil), s.Items...)
+	return &s, nil
+}
+
+func (m *MemoryStore) SaveSaga(ctx context.Context, s *CheckoutSaga) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sagas[s.CartID].Version != s.Version { // stored versions start at 1
+		return ErrConflict
+	}
+	s.Version++
+	stored := *s
+	stored.Items = append([]CartItem(nil), s.Items...)
+	m.sagas[s.CartID] = stored
+	return nil
+}
+
+func (m *MemoryStore) ListStaleSagas(ctx context.Context, before time.Time, limit int) ([]CheckoutSaga, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []CheckoutSaga
+	for _, s := range m.sagas {
+		if len(out) == limit {
+			break
+		}
+		if s.Status == SagaStatusRunning && s.UpdatedAt.Before(before) {
+			s.Items = append([]CartItem(nil), s.Items...)
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+/************ OutboxStore ************/
+
+func (m *MemoryStore) ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []OutboxEvent
+	for i := range m.outbox {
+		if len(out) == limit {
+			break
+		}
+		if !m.outbox[i].dueAt.After(now) {
+			m.outbox[i].dueAt = now.Add(lease)
+			out = append(out, m.outbox[i].OutboxEvent)
+		}
+	}
+	return out, nil
+}
+
+// Sent events are dropped: nothing reads them afterwards
+func (m *MemoryStore) MarkEventSent(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.outbox = slices.DeleteFunc(m.outbox, func(ev memoryOutboxEvent) bool { return ev.ID == id })
+	return nil
+}
+
+func (m *MemoryStore) MarkEventFailed(ctx context.Context, id, reason string, retryAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.outbox {
+		if m.outbox[i].ID == id {
+			m.outbox[i].Attempts++
+			m.outbox[i].LastError = reason
+			m.outbox[i].dueAt = retryAt
+		}
+	}
+	return nil
+}
+
+// Sent events are deleted as soon as they are marked
+func (m *MemoryStore) PurgeSentEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	return 0, nil
+}
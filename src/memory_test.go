@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestMemoryStoreCartLifecycle(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryStore()
+
+	id, err := m.CreateCart(ctx, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := m.GetCart(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != id || c.CustomerID != 7 || c.Status != CartStatusOpen || len(c.Items) != 0 || c.OrderID != "" {
+		t.Fatalf("new cart = %+v", c)
+	}
+
+	steps := []struct {
+		productID, quantity int // quantity 0 removes
+		oldQuantity         int
+	}{
+		{productID: 3, quantity: 2, oldQuantity: 0},
+		{productID: 1, quantity: 1, oldQuantity: 0},
+		{productID: 3, quantity: 5, oldQuantity: 2},
+		{productID: 1, quantity: 0, oldQuantity: 1},
+		{productID: 9, quantity: 0, oldQuantity: 0}, // not in the cart: no-op
+	}
+	for _, s := range steps {
+		var change CartItemChange
+		if s.quantity == 0 {
+			change, err = m.RemoveItem(ctx, id, s.productID)
+		} else {
+			change, err = m.UpsertItem(ctx, id, s.productID, s.quantity)
+		}
+		if err != nil {
+			t.Fatalf("set product %d to %d: %v", s.productID, s.quantity, err)
+		}
+		if want := (CartItemChange{CustomerID: 7, OldQuantity: s.oldQuantity}); change != want {
+			t.Errorf("set product %d to %d: change = %+v, want %+v", s.productID, s.quantity, change, want)
+		}
+	}
+	c, _ = m.GetCart(ctx, id)
+	if want := []CartItem{{ProductID: 3, Quantity: 5}}; !slices.Equal(c.Items, want) {
+		t.Fatalf("items = %v, want %v", c.Items, want)
+	}
+
+	// The caller's copy is not the store's
+	c.Items[0].Quantity = 99
+	if again, _ := m.GetCart(ctx, id); again.Items[0].Quantity != 5 {
+		t.Fatalf("mutating a GetCart result changed the store: %v", again.Items)
+	}
+}
+
+func TestMemoryStoreLookupErrors(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryStore()
+
+	for _, tt := range []struct {
+		cartID string
+		want   error
+	}{
+		{"abc", ErrInvalidCartID},
+		{"0", ErrInvalidCartID},
+		{"", ErrInvalidCartID},
+		{"12345", ErrCartNotFound},
+	} {
+		if _, err := m.GetCart(ctx, tt.cartID); !errors.Is(err, tt.want) {
+			t.Errorf("GetCart(%q) = %v, want %v", tt.cartID, err, tt.want)
+		}
+		if _, err := m.UpsertItem(ctx, tt.cartID, 1, 1); !errors.Is(err, tt.want) {
+			t.Errorf("UpsertItem(%q) = %v, want %v", tt.cartID, err, tt.want)
+		}
+		if _, err := m.Checkout(ctx, tt.cartID, nil); !errors.Is(err, tt.want) {
+			t.Errorf("Checkout(%q) = %v, want %v", tt.cartID, err, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreCheckout(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryStore()
+	id, _ := m.CreateCart(ctx, 7)
+
+	if _, err := m.Checkout(ctx, id, nil); !errors.Is(err, ErrCartEmpty) {
+		t.Fatalf("checkout of an empty cart: %v, want %v", err, ErrCartEmpty)
+	}
+	m.UpsertItem(ctx, id, 1, 2)
+	m.UpsertItem(ctx, id, 2, 1)
+
+	// Only the items the caller expects may be checked out
+	if _, err := m.Checkout(ctx, id, []CartItem{{ProductID: 1, Quantity: 2}}); !errors.Is(err, ErrCartChanged) {
+		t.Fatalf("checkout with other items: %v, want %v", err, ErrCartChanged)
+	}
+	items := []CartItem{{ProductID: 2, Quantity: 1}, {ProductID: 1, Quantity: 2}} // any order
+	orderID, err := m.Checkout(ctx, id, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := m.GetCart(ctx, id)
+	if c.Status != CartStatusCheckedOut || c.OrderID != orderID {
+		t.Fatalf("checked-out cart = %+v, want CHECKED_OUT with order %s", c, orderID)
+	}
+	o, err := m.GetOrder(ctx, orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.CartID != id || o.CustomerID != 7 || o.Status != OrderStatusPlaced || !sameItems(o.Items, items) {
+		t.Fatalf("order = %+v", o)
+	}
+	if got, _ := m.ClaimEvents(ctx, o.CreatedAt, 0, 10); len(got) != 1 || got[0].EventType != orderPlacedEventType {
+		t.Fatalf("outbox = %+v, want one %s", got, orderPlacedEventType)
+	}
+
+	if _, err := m.Checkout(ctx, id, items); !errors.Is(err, ErrCartCheckedOut) {
+		t.Errorf("second checkout: %v, want %v", err, ErrCartCheckedOut)
+	}
+	if _, err := m.UpsertItem(ctx, id, 3, 1); !errors.Is(err, ErrCartCheckedOut) {
+		t.Errorf("add to a checked-out cart: %v, want %v", err, ErrCartCheckedOut)
+	}
+	if _, err := m.RemoveItem(ctx, id, 1); !errors.Is(err, ErrCartCheckedOut) {
+		t.Errorf("remove from a checked-out cart: %v, want %v", err, ErrCartCheckedOut)
+	}
+}
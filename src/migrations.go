@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// The MySQL schema is the ordered list of migrations below. Applied versions
+// are recorded in schema_migrations; up applies the missing ones in version
+// order and down reverts the latest. Every task runs up at startup
+// (DB_AUTO_MIGRATE=false only checks that nothing is pending), and ./app
+// migrate runs them by hand. A MySQL named lock keeps tasks that start
+// together from migrating at the same time.
+//
+// MySQL commits DDL implicitly, so a migration that fails half way is not
+// rolled back: its statements must be safe to run again (IF NOT EXISTS / IF
+// EXISTS), and it is retried as a whole. Never edit a migration once it has
+// shipped; add a new one. Versions 1-8 are the tables the service used to
+// create with CREATE TABLE IF NOT EXISTS at startup, so on an existing
+// database they change nothing and are only recorded.
+
+type migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "carts_and_orders",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS carts (
+				cart_id     INT AUTO_INCREMENT PRIMARY KEY,
+				customer_id INT NOT NULL,
+				status      ENUM('OPEN','CHECKED_OUT') NOT NULL DEFAULT 'OPEN',
+				created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				INDEX idx_carts_customer (customer_id, created_at)
+			) ENGINE=InnoDB;`,
+			`CREATE TABLE IF NOT EXISTS cart_items (
+				cart_id    INT NOT NULL,
+				product_id INT NOT NULL,
+				quantity   INT NOT NULL,
+				updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				PRIMARY KEY (cart_id, product_id),
+				CONSTRAINT fk_cart FOREIGN KEY (cart_id) REFERENCES carts(cart_id) ON DELETE CASCADE
+			) ENGINE=InnoDB;`,
+			// checkout 生成的订单：一个 cart 最多一个 order
+			`CREATE TABLE IF NOT EXISTS orders (
+				order_id    INT AUTO_INCREMENT PRIMARY KEY,
+				cart_id     INT NOT NULL,
+				customer_id INT NOT NULL,
+				status      VARCHAR(32) NOT NULL DEFAULT 'PLACED',
+				created_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at  TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				UNIQUE KEY uq_orders_cart (cart_id),
+				INDEX idx_orders_customer (customer_id, created_at),
+				CONSTRAINT fk_order_cart FOREIGN KEY (cart_id) REFERENCES carts(cart_id)
+			) ENGINE=InnoDB;`,
+			`CREATE TABLE IF NOT EXISTS order_items (
+				order_id   INT NOT NULL,
+				product_id INT NOT NULL,
+				quantity   INT NOT NULL,
+				PRIMARY KEY (order_id, product_id),
+				CONSTRAINT fk_order FOREIGN KEY (order_id) REFERENCES orders(order_id) ON DELETE CASCADE
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS order_items;`,
+			`DROP TABLE IF EXISTS orders;`,
+			`DROP TABLE IF EXISTS cart_items;`,
+			`DROP TABLE IF EXISTS carts;`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "products",
+		Up: []string{
+			// 商品目录（api.yaml Product schema）
+			`CREATE TABLE IF NOT EXISTS products (
+				product_id    INT PRIMARY KEY,
+				sku           VARCHAR(100) NOT NULL,
+				manufacturer  VARCHAR(200) NOT NULL,
+				category_id   INT NOT NULL,
+				weight        INT NOT NULL,
+				some_other_id INT NOT NULL,
+				updated_at    TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS products;`,
+		},
+	},
+	{
+		Version: 3,
+		Name:    "inventory",
+		Up: []string{
+			// 仓库库存：reserved <= on_hand，所有计数不可为负
+			`CREATE TABLE IF NOT EXISTS inventory (
+				product_id INT PRIMARY KEY,
+				on_hand    INT NOT NULL DEFAULT 0,
+				reserved   INT NOT NULL DEFAULT 0,
+				shipped    INT NOT NULL DEFAULT 0,
+				updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				CONSTRAINT chk_inventory CHECK (reserved >= 0 AND reserved <= on_hand AND shipped >= 0)
+			) ENGINE=InnoDB;`,
+			// 每一笔预留（hold）：inventory.reserved = 所有 HELD 行的 quantity 之和；expires_at 为 NULL 表示已确认，不再过期
+			`CREATE TABLE IF NOT EXISTS reservations (
+				reservation_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				product_id     INT NOT NULL,
+				owner          VARCHAR(64) NOT NULL DEFAULT '',
+				quantity       INT NOT NULL,
+				status         ENUM('HELD','SHIPPED','RELEASED','EXPIRED') NOT NULL DEFAULT 'HELD',
+				expires_at     TIMESTAMP(3) NULL,
+				created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				INDEX idx_reservations_product (product_id, status, reservation_id),
+				INDEX idx_reservations_owner (owner, status),
+				INDEX idx_reservations_expiry (status, expires_at),
+				CONSTRAINT fk_reservation_inventory FOREIGN KEY (product_id) REFERENCES inventory(product_id)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS reservations;`,
+			`DROP TABLE IF EXISTS inventory;`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "payments",
+		Up: []string{
+			// 已扣款的支付：一个订单最多一笔；卡只存 token / 后四位 / 品牌，绝不存完整卡号
+			`CREATE TABLE IF NOT EXISTS payments (
+				order_id       INT PRIMARY KEY,
+				transaction_id VARCHAR(64) NOT NULL,
+				cart_id        INT NOT NULL,
+				customer_id    INT NOT NULL,
+				amount_cents   BIGINT NOT NULL,
+				status         VARCHAR(32) NOT NULL,
+				card_token     VARCHAR(64) NOT NULL,
+				card_last4     CHAR(4) NOT NULL,
+				card_brand     VARCHAR(16) NOT NULL,
+				created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				UNIQUE KEY uq_payments_txn (transaction_id),
+				CONSTRAINT fk_payment_order FOREIGN KEY (order_id) REFERENCES orders(order_id)
+			) ENGINE=InnoDB;`,
+			// 退款流水：同一订单内 idempotency_key 唯一；PENDING 也占用可退金额
+			`CREATE TABLE IF NOT EXISTS refunds (
+				refund_id       BIGINT AUTO_INCREMENT PRIMARY KEY,
+				order_id        INT NOT NULL,
+				idempotency_key VARCHAR(64) NOT NULL,
+				amount_cents    BIGINT NOT NULL,
+				reason          VARCHAR(255) NOT NULL DEFAULT '',
+				status          ENUM('PENDING','SUCCEEDED','FAILED') NOT NULL DEFAULT 'PENDING',
+				processor_ref   VARCHAR(64) NOT NULL DEFAULT '',
+				created_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+				updated_at      TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+				UNIQUE KEY uq_refunds_key (order_id, idempotency_key),
+				CONSTRAINT fk_refund_payment FOREIGN KEY (order_id) REFERENCES payments(order_id)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS refunds;`,
+			`DROP TABLE IF EXISTS payments;`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "outbox",
+		Up: []string{
+			// 发件箱：与业务变更同一事务写入的事件，由 relay 发布后标记 sent_at；next_attempt_at 控制失败重试的退避
+			`CREATE TABLE IF NOT EXISTS outbox (
+				event_id        BIGINT AUTO_INCREMENT PRIMARY KEY,
+				event_type      VARCHAR(64) NOT NULL,
+				payload         TEXT NOT NULL,
+				attempts        INT NOT NULL DEFAULT 0,
+				last_error      VARCHAR(255) NOT NULL DEFAULT '',
+				created_at      TIMESTAMP(3) NOT NULL,
+				next_attempt_at TIMESTAMP(3) NOT NULL,
+				sent_at         TIMESTAMP(3) NULL,
+				INDEX idx_outbox_pending (sent_at, next_attempt_at)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS outbox;`,
+		},
+	},
+	{
+		Version: 6,
+		Name:    "checkout_sagas",
+		Up: []string{
+			// 结账 saga：每个购物车一行；items 为 JSON 快照；version 做乐观锁，恢复任务据 (status, updated_at) 找卡住的 saga
+			`CREATE TABLE IF NOT EXISTS checkout_sagas (
+				cart_id        INT PRIMARY KEY,
+				customer_id    INT NOT NULL,
+				attempt        INT NOT NULL,
+				status         ENUM('RUNNING','COMPLETED','ABORTED') NOT NULL,
+				step           VARCHAR(16) NOT NULL,
+				items          TEXT NOT NULL,
+				amount_cents   BIGINT NOT NULL,
+				card_token     VARCHAR(64) NOT NULL,
+				card_last4     CHAR(4) NOT NULL,
+				card_brand     VARCHAR(16) NOT NULL,
+				transaction_id VARCHAR(64) NOT NULL DEFAULT '',
+				order_id       VARCHAR(32) NOT NULL DEFAULT '',
+				failure        VARCHAR(255) NOT NULL DEFAULT '',
+				version        INT NOT NULL,
+				created_at     TIMESTAMP(3) NOT NULL,
+				updated_at     TIMESTAMP(3) NOT NULL,
+				INDEX idx_sagas_stale (status, updated_at),
+				CONSTRAINT fk_saga_cart FOREIGN KEY (cart_id) REFERENCES carts(cart_id)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS checkout_sagas;`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "cart_projection",
+		Up: []string{
+			// DynamoDB → MySQL 投影：DynamoDB 购物车 ID 到本库 cart_id 的映射与已应用的 version（乱序 / 重复投递时旧版本被忽略）；removed 为删除墓碑
+			`CREATE TABLE IF NOT EXISTS cart_projection (
+				source_cart_id  VARCHAR(64) PRIMARY KEY,
+				cart_id         INT NULL,
+				source_version  INT NOT NULL,
+				source_order_id VARCHAR(64) NOT NULL DEFAULT '',
+				removed         BOOLEAN NOT NULL DEFAULT FALSE,
+				updated_at      TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+				UNIQUE KEY uq_projection_cart (cart_id),
+				CONSTRAINT fk_projection_cart FOREIGN KEY (cart_id) REFERENCES carts(cart_id) ON DELETE SET NULL
+			) ENGINE=InnoDB;`,
+			// 每个 stream shard 的消费进度；finished 表示 shard 已关闭且读完
+			`CREATE TABLE IF NOT EXISTS stream_checkpoints (
+				stream_arn      VARCHAR(255) NOT NULL,
+				shard_id        VARCHAR(128) NOT NULL,
+				sequence_number VARCHAR(64) NOT NULL DEFAULT '',
+				finished        BOOLEAN NOT NULL DEFAULT FALSE,
+				updated_at      TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+				PRIMARY KEY (stream_arn, shard_id)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS stream_checkpoints;`,
+			`DROP TABLE IF EXISTS cart_projection;`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "cart_divergences",
+		Up: []string{
+			// 双写迁移（DB_BACKEND=dualwrite）：MySQL 与 DynamoDB 副本不一致的记录，每次发现一行
+			`CREATE TABLE IF NOT EXISTS cart_divergences (
+				divergence_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+				cart_id       VARCHAR(64) NOT NULL,
+				operation     VARCHAR(32) NOT NULL,
+				detail        VARCHAR(1024) NOT NULL,
+				repaired      BOOLEAN NOT NULL DEFAULT FALSE,
+				detected_at   TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+				INDEX idx_divergences_cart (cart_id)
+			) ENGINE=InnoDB;`,
+		},
+		Down: []string{
+			`DROP TABLE IF EXISTS cart_divergences;`,
+		},
+	},
+}
+
+const schemaMigrationsDDL = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INT PRIMARY KEY,
+	name       VARCHAR(128) NOT NULL,
+	applied_at TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3)
+) ENGINE=InnoDB;`
+
+// Name of the MySQL lock (GET_LOCK) held while migrating
+const migrationLockName = "schema_migrations"
+
+// migrator runs migrations on one connection, which holds the migration lock
+type migrator struct {
+	conn *sql.Conn
+}
+
+// lockMigrations waits up to MIGRATE_LOCK_TIMEOUT (default 60s) for the
+// migration lock; Close releases it
+func lockMigrations(ctx context.Context, db *sql.DB) (*migrator, error) {
+	timeout, err := time.ParseDuration(getenv("MIGRATE_LOCK_TIMEOUT", "60s"))
+	if err != nil || timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+	// The lock belongs to the session, so everything runs on this connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLockName, int(timeout.Seconds())).Scan(&got); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("take migration lock: %w", err)
+	}
+	if got.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("migration lock still held by another task after %s", timeout)
+	}
+	m := &migrator{conn: conn}
+	if _, err := conn.ExecContext(ctx, schemaMigrationsDDL); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *migrator) Close() {
+	// Close only hands the session back to the pool, which would keep the lock
+	_, _ = m.conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrationLockName)
+	m.conn.Close()
+}
+
+type appliedMigration struct {
+	Name      string
+	AppliedAt time.Time
+}
+
+func (m *migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := m.conn.QueryContext(ctx, `SELECT version, name, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var v int
+		var a appliedMigration
+		if err := rows.Scan(&v, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[v] = a
+	}
+	return applied, rows.Err()
+}
+
+// up applies every migration up to version target (0 = all) that is not
+// applied yet, in order, and returns how many it applied
+func (m *migrator) up(ctx context.Context, target int) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, mg := range migrations {
+		if target > 0 && mg.Version > target {
+			break
+		}
+		if _, ok := applied[mg.Version]; ok {
+			continue
+		}
+		if err := m.run(ctx, mg.Up); err != nil {
+			return n, fmt.Errorf("migration %d %s: %w", mg.Version, mg.Name, err)
+		}
+		if _, err := m.conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, mg.Version, mg.Name); err != nil {
+			return n, fmt.Errorf("migration %d %s: record: %w", mg.Version, mg.Name, err)
+		}
+		log.Printf("migrate: applied %d %s", mg.Version, mg.Name)
+		n++
+	}
+	return n, nil
+}
+
+// down reverts the applied migrations above version target, newest first, and
+// returns how many it reverted
+func (m *migrator) down(ctx context.Context, target int) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, mg := range slices.Backward(migrations) {
+		if mg.Version <= target {
+			break
+		}
+		if _, ok := applied[mg.Version]; !ok {
+			continue
+		}
+		if err := m.run(ctx, mg.Down); err != nil {
+			return n, fmt.Errorf("revert migration %d %s: %w", mg.Version, mg.Name, err)
+		}
+		if _, err := m.conn.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version=?`, mg.Version); err != nil {
+			return n, fmt.Errorf("revert migration %d %s: record: %w", mg.Version, mg.Name, err)
+		}
+		log.Printf("migrate: reverted %d %s", mg.Version, mg.Name)
+		n++
+	}
+	return n, nil
+}
+
+func (m *migrator) run(ctx context.Context, stmts []string) error {
+	for _, s := range stmts {
+		if _, err := m.conn.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pending lists the migrations not applied yet
+func (m *migrator) pending(ctx context.Context) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, mg := range migrations {
+		if _, ok := applied[mg.Version]; !ok {
+			pending = append(pending, mg)
+		}
+	}
+	return pending, nil
+}
+
+// migrateOnStartup brings the schema up to date, or with DB_AUTO_MIGRATE=false
+// fails if it is not
+func migrateOnStartup(db *sql.DB) error {
+	ctx := context.Background()
+	m, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if getenvBool("DB_AUTO_MIGRATE", true) {
+		_, err := m.up(ctx, 0)
+		return err
+	}
+	pending, err := m.pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d schema migration(s) pending, starting with %d %s (run ./app migrate up)",
+			len(pending), pending[0].Version, pending[0].Name)
+	}
+	return nil
+}
+
+/************ ./app migrate ************/
+
+const migrateUsage = `usage:
+  app migrate up [-to VERSION]       apply pending migrations (all, or up to VERSION)
+  app migrate down [-to VERSION]     revert migrations above VERSION (default: the latest one)
+  app migrate status                 list migrations and whether they are applied`
+
+// runMigrate is the migrate subcommand; args follow "migrate". It needs the
+// MySQL environment (DB_HOST/DB_USER/DB_PASS/DB_NAME).
+func runMigrate(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	to := fs.Int("to", -1, "target version")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := openMySQLFromEnv()
+	if err != nil {
+		return fmt.Errorf("open DB: %w", err)
+	}
+	defer db.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	m, err := lockMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		n, err := m.up(ctx, max(*to, 0))
+		fmt.Fprintf(stdout, "%d migration(s) applied\n", n)
+		return err
+	case "down":
+		target := *to
+		if target < 0 {
+			// One step: down to the newest applied version below the latest
+			applied, err := m.applied(ctx)
+			if err != nil {
+				return err
+			}
+			versions := slices.Sorted(maps.Keys(applied))
+			target = 0
+			if len(versions) > 1 {
+				target = versions[len(versions)-2]
+			}
+		}
+		n, err := m.down(ctx, target)
+		fmt.Fprintf(stdout, "%d migration(s) reverted\n", n)
+		return err
+	case "status":
+		return migrationStatus(ctx, m, stdout)
+	default:
+		return errors.New(migrateUsage)
+	}
+}
+
+func migrationStatus(ctx context.Context, m *migrator, stdout io.Writer) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	known := map[int]bool{}
+	pending := 0
+	for _, mg := range migrations {
+		known[mg.Version] = true
+		at := "pending"
+		if a, ok := applied[mg.Version]; ok {
+			at = a.AppliedAt.UTC().Format(time.RFC3339)
+		} else {
+			pending++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", mg.Version, mg.Name, at)
+	}
+	// Applied by a newer build than this one
+	for _, v := range slices.Sorted(maps.Keys(applied)) {
+		if !known[v] {
+			fmt.Fprintf(tw, "%d\t%s\t%s (unknown to this build)\n", v, applied[v].Name, applied[v].AppliedAt.UTC().Format(time.RFC3339))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%d pending\n", pending)
+	return nil
+}
@@ -0,0 +1,1008 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/************ MySQL CartStore ************/
+
+// MySQLStore implements Store on top of the carts/cart_items,
+// orders/order_items, products, inventory/reservations, payments/refunds,
+// checkout_sagas and outbox tables.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// Open the MySQL connection from environment variables and bring the schema up to date
+func initMySQL() (*MySQLStore, error) {
+	db, err := openMySQLFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("open DB: %w", err)
+	}
+	if err := migrateOnStartup(db); err != nil {
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+	return &MySQLStore{db: db}, nil
+}
+
+// MySQL cart IDs are AUTO_INCREMENT integers; anything else can never exist
+func parseMySQLCartID(cartID string) (int, error) {
+	id, err := strconv.Atoi(cartID)
+	if err != nil || id < 1 {
+		return 0, ErrInvalidCartID
+	}
+	return id, nil
+}
+
+func (s *MySQLStore) CreateCart(ctx context.Context, customerID int) (string, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO carts (customer_id) VALUES (?)`, customerID)
+	if err != nil {
+		return "", err
+	}
+	id64, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id64, 10), nil
+}
+
+// 高效整单查询（两次定点查询，<50ms）
+func (s *MySQLStore) GetCart(ctx context.Context, cartID string) (*Cart, error) {
+	id, err := parseMySQLCartID(cartID)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1) 主键查 cart
+	var c Cart
+	var rawID int
+	var orderID sql.NullInt64
+	err = s.db.QueryRowContext(ctx, `
+		SELECT c.cart_id, c.customer_id, c.status, c.created_at, c.updated_at, o.order_id
+		FROM carts c LEFT JOIN orders o ON o.cart_id = c.cart_id
+		WHERE c.cart_id=?
+	`, id).Scan(&rawID, &c.CustomerID, &c.Status, &c.CreatedAt, &c.UpdatedAt, &orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCartNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.ID = strconv.Itoa(rawID)
+	if orderID.Valid {
+		c.OrderID = strconv.FormatInt(orderID.Int64, 10)
+	}
+
+	// 2) 主键查全部 items，按 product_id 排序（saga / 回填 / GET 契约都要完整的购物车）
+	rows, err := s.db.QueryContext(ctx, `SELECT product_id, quantity FROM cart_items WHERE cart_id=? ORDER BY product_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	c.Items = make([]CartItem, 0, 16)
+	for rows.Next() {
+		var it CartItem
+		if err := rows.Scan(&it.ProductID, &it.Quantity); err != nil {
+			return nil, err
+		}
+		c.Items = append(c.Items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// upsert：并发安全 & 幂等更新
+func (s *MySQLStore) UpsertItem(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error) {
+	return s.mutateCart(ctx, cartID, productID, func(tx *sql.Tx, id int) error {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO cart_items (cart_id, product_id, quantity)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE quantity=VALUES(quantity)
+		`, id, productID, quantity)
+		return err
+	})
+}
+
+func (s *MySQLStore) RemoveItem(ctx context.Context, cartID string, productID int) (CartItemChange, error) {
+	return s.mutateCart(ctx, cartID, productID, func(tx *sql.Tx, id int) error {
+		_, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE cart_id=? AND product_id=?`, id, productID)
+		return err
+	})
+}
+
+// mutateCart runs fn in a transaction after locking the cart row and checking
+// that it exists and is still OPEN, then bumps carts.updated_at. It reports
+// the product's quantity as it was before fn.
+func (s *MySQLStore) mutateCart(ctx context.Context, cartID string, productID int, fn func(tx *sql.Tx, id int) error) (CartItemChange, error) {
+	var change CartItemChange
+	id, err := parseMySQLCartID(cartID)
+	if err != nil {
+		return change, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return change, err
+	}
+	defer tx.Rollback()
+
+	// cart 存在性 & 状态检查；FOR UPDATE 与 checkout 串行化
+	var status string
+	if err := tx.QueryRowContext(ctx, `SELECT status, customer_id FROM carts WHERE cart_id=? FOR UPDATE`, id).Scan(&status, &change.CustomerID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return change, ErrCartNotFound
+		}
+		return change, err
+	}
+	if status != CartStatusOpen {
+		return change, ErrCartCheckedOut
+	}
+	// 购物车行锁已串行化同一购物车的修改，这里读到的就是修改前的数量
+	err = tx.QueryRowContext(ctx, `SELECT quantity FROM cart_items WHERE cart_id=? AND product_id=?`, id, productID).Scan(&change.OldQuantity)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return change, err
+	}
+
+	if err := fn(tx, id); err != nil {
+		return change, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE carts SET updated_at=NOW() WHERE cart_id=?`, id); err != nil {
+		return change, err
+	}
+	return change, tx.Commit()
+}
+
+// Checkout locks the cart row, snapshots its items into orders/order_items and
+// flips the cart to CHECKED_OUT, all in one transaction.
+func (s *MySQLStore) Checkout(ctx context.Context, cartID string, expected []CartItem) (string, error) {
+	id, err := parseMySQLCartID(cartID)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var customerID int
+	var status string
+	err = tx.QueryRowContext(ctx, `SELECT customer_id, status FROM carts WHERE cart_id=? FOR UPDATE`, id).Scan(&customerID, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrCartNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if status != CartStatusOpen {
+		return "", ErrCartCheckedOut
+	}
+
+	items, err := queryCartItems(ctx, tx, id)
+	if err != nil {
+		return "", err
+	}
+	if len(items) == 0 {
+		return "", ErrCartEmpty
+	}
+	// The cart row lock keeps the items as they are until we commit
+	if !sameItems(items, expected) {
+		return "", ErrCartChanged
+	}
+
+	res, err := tx.ExecContext(ctx, `INSERT INTO orders (cart_id, customer_id, status) VALUES (?, ?, ?)`, id, customerID, OrderStatusPlaced)
+	if err != nil {
+		return "", err
+	}
+	orderID, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	for _, it := range items {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO order_items (order_id, product_id, quantity) VALUES (?, ?, ?)`, orderID, it.ProductID, it.Quantity); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE carts SET status=? WHERE cart_id=?`, CartStatusCheckedOut, id); err != nil {
+		return "", err
+	}
+	// The event commits (or rolls back) with the order
+	ev, err := orderPlacedOutboxEvent(&Order{
+		ID:         strconv.FormatInt(orderID, 10),
+		CartID:     strconv.Itoa(id),
+		CustomerID: customerID,
+		Status:     OrderStatusPlaced,
+		CreatedAt:  time.Now().UTC(),
+		Items:      items,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := insertOutboxEvent(ctx, tx, ev); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(orderID, 10), nil
+}
+
+// All items of a cart (checkout copies every line, so no LIMIT here)
+func queryCartItems(ctx context.Context, tx *sql.Tx, id int) ([]CartItem, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT product_id, quantity FROM cart_items WHERE cart_id=? ORDER BY product_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []CartItem
+	for rows.Next() {
+		var it CartItem
+		if err := rows.Scan(&it.ProductID, &it.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+/************ MySQL OrderStore ************/
+
+func (s *MySQLStore) GetOrder(ctx context.Context, orderID string) (*Order, error) {
+	id, err := strconv.Atoi(orderID)
+	if err != nil || id < 1 {
+		return nil, ErrInvalidOrderID
+	}
+
+	var o Order
+	var rawID, cartID int
+	err = s.db.QueryRowContext(ctx, `SELECT order_id, cart_id, customer_id, status, created_at FROM orders WHERE order_id=?`, id).
+		Scan(&rawID, &cartID, &o.CustomerID, &o.Status, &o.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.ID = strconv.Itoa(rawID)
+	o.CartID = strconv.Itoa(cartID)
+
+	orders := []Order{o}
+	if err := s.loadOrderItems(ctx, orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+// Keyset position of the last order on a page
+type mysqlOrderCursor struct {
+	CreatedAt time.Time `json:"t"`
+	OrderID   int       `json:"id"`
+}
+
+// Newest first; keyset pagination on (created_at, order_id) uses idx_orders_customer
+func (s *MySQLStore) ListCustomerOrders(ctx context.Context, customerID, limit int, cursor string) ([]Order, string, error) {
+	q := `SELECT order_id, cart_id, customer_id, status, created_at FROM orders WHERE customer_id=?`
+	args := []any{customerID}
+	if cursor != "" {
+		var c mysqlOrderCursor
+		if err := decodeCursor(cursor, &c); err != nil {
+			return nil, "", err
+		}
+		q += ` AND (created_at < ? OR (created_at = ? AND order_id < ?))`
+		args = append(args, c.CreatedAt, c.CreatedAt, c.OrderID)
+	}
+	q += ` ORDER BY created_at DESC, order_id DESC LIMIT ?`
+	args = append(args, limit+1) // one extra row tells us whether there is a next page
+
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	var ids []int
+	for rows.Next() {
+		var o Order
+		var rawID, cartID int
+		if err := rows.Scan(&rawID, &cartID, &o.CustomerID, &o.Status, &o.CreatedAt); err != nil {
+			return nil, "", err
+		}
+		o.ID = strconv.Itoa(rawID)
+		o.CartID = strconv.Itoa(cartID)
+		orders = append(orders, o)
+		ids = append(ids, rawID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		next = encodeCursor(mysqlOrderCursor{CreatedAt: last.CreatedAt, OrderID: ids[limit-1]})
+	}
+	if err := s.loadOrderItems(ctx, orders); err != nil {
+		return nil, "", err
+	}
+	return orders, next, nil
+}
+
+// Fill in the items of a page of orders with a single IN query
+func (s *MySQLStore) loadOrderItems(ctx context.Context, orders []Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Order, len(orders))
+	args := make([]any, 0, len(orders))
+	for i := range orders {
+		orders[i].Items = []CartItem{}
+		byID[orders[i].ID] = &orders[i]
+		args = append(args, orders[i].ID)
+	}
+
+	q := `SELECT order_id, product_id, quantity FROM order_items WHERE order_id IN (?` + strings.Repeat(",?", len(orders)-1) + `) ORDER BY order_id, product_id`
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderID int
+		var it CartItem
+		if err := rows.Scan(&orderID, &it.ProductID, &it.Quantity); err != nil {
+			return err
+		}
+		if o := byID[strconv.Itoa(orderID)]; o != nil {
+			o.Items = append(o.Items, it)
+		}
+	}
+	return rows.Err()
+}
+
+/************ MySQL ProductStore ************/
+
+func (s *MySQLStore) GetProduct(ctx context.Context, productID int) (*Product, error) {
+	var p Product
+	err := s.db.QueryRowContext(ctx, `SELECT product_id, sku, manufacturer, category_id, weight, some_other_id FROM products WHERE product_id=?`, productID).
+		Scan(&p.ProductID, &p.SKU, &p.Manufacturer, &p.CategoryID, &p.Weight, &p.SomeOtherID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *MySQLStore) UpsertProduct(ctx context.Context, p Product) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO products (product_id, sku, manufacturer, category_id, weight, some_other_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE sku=VALUES(sku), manufacturer=VALUES(manufacturer),
+			category_id=VALUES(category_id), weight=VALUES(weight), some_other_id=VALUES(some_other_id)
+	`, p.ProductID, p.SKU, p.Manufacturer, p.CategoryID, p.Weight, p.SomeOtherID)
+	return err
+}
+
+/************ MySQL InventoryStore ************/
+
+func (s *MySQLStore) GetInventory(ctx context.Context, productID int) (*Inventory, error) {
+	var inv Inventory
+	err := s.db.QueryRowContext(ctx, `SELECT product_id, on_hand, reserved, shipped FROM inventory WHERE product_id=?`, productID).
+		Scan(&inv.ProductID, &inv.OnHand, &inv.Reserved, &inv.Shipped)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (s *MySQLStore) Restock(ctx context.Context, productID, quantity int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO inventory (product_id, on_hand) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE on_hand=on_hand+VALUES(on_hand)
+	`, productID, quantity)
+	return err
+}
+
+// Every reservation change runs in inventoryTx: the inventory row is locked
+// first, so the counters and the reservations rows always move together and
+// concurrent writers on the same product queue up instead of deadlocking.
+func (s *MySQLStore) inventoryTx(ctx context.Context, productID int, fn func(tx *sql.Tx, inv *Inventory) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inv := Inventory{ProductID: productID}
+	err = tx.QueryRowContext(ctx, `SELECT on_hand, reserved, shipped FROM inventory WHERE product_id=? FOR UPDATE`, productID).
+		Scan(&inv.OnHand, &inv.Reserved, &inv.Shipped)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(tx, &inv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MySQLStore) Reserve(ctx context.Context, productID, quantity int, owner string, ttl time.Duration) (string, error) {
+	var id int64
+	err := s.inventoryTx(ctx, productID, func(tx *sql.Tx, inv *Inventory) error {
+		if inv.Available() < quantity {
+			return ErrInsufficientInventory
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE inventory SET reserved=reserved+? WHERE product_id=?`, quantity, productID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `INSERT INTO reservations (product_id, owner, quantity, expires_at) VALUES (?, ?, ?, ?)`,
+			productID, owner, quantity, time.Now().UTC().Add(ttl))
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// Ship consumes HELD reservations oldest first; a partly used hold keeps its
+// remaining quantity, a fully used one becomes SHIPPED.
+func (s *MySQLStore) Ship(ctx context.Context, productID, quantity int, owner string) error {
+	return s.inventoryTx(ctx, productID, func(tx *sql.Tx, inv *Inventory) error {
+		q := `SELECT reservation_id, quantity FROM reservations WHERE product_id=? AND status='HELD'`
+		args := []any{productID}
+		if owner != "" {
+			q += ` AND owner=?`
+			args = append(args, owner)
+		}
+		rows, err := tx.QueryContext(ctx, q+` ORDER BY reservation_id FOR UPDATE`, args...)
+		if err != nil {
+			return err
+		}
+		type hold struct{ id, quantity int64 }
+		var holds []hold
+		held := 0
+		for rows.Next() {
+			var h hold
+			if err := rows.Scan(&h.id, &h.quantity); err != nil {
+				rows.Close()
+				return err
+			}
+			holds = append(holds, h)
+			held += int(h.quantity)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if held < quantity {
+			return ErrInsufficientReserved
+		}
+
+		left := int64(quantity)
+		for _, h := range holds {
+			if left == 0 {
+				break
+			}
+			if h.quantity <= left {
+				_, err = tx.ExecContext(ctx, `UPDATE reservations SET status='SHIPPED' WHERE reservation_id=?`, h.id)
+				left -= h.quantity
+			} else {
+				_, err = tx.ExecContext(ctx, `UPDATE reservations SET quantity=quantity-? WHERE reservation_id=?`, left, h.id)
+				left = 0
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE inventory SET reserved=reserved-?, on_hand=on_hand-?, shipped=shipped+?
+			WHERE product_id=?
+		`, quantity, quantity, quantity, productID)
+		return err
+	})
+}
+
+func (s *MySQLStore) Release(ctx context.Context, productID int, owner string) (int, error) {
+	var units int
+	err := s.inventoryTx(ctx, productID, func(tx *sql.Tx, inv *Inventory) error {
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(quantity), 0) FROM reservations
+			WHERE product_id=? AND owner=? AND status='HELD' FOR UPDATE
+		`, productID, owner).Scan(&units); err != nil {
+			return err
+		}
+		if units == 0 {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE reservations SET status='RELEASED' WHERE product_id=? AND owner=? AND status='HELD'`, productID, owner); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE inventory SET reserved=reserved-? WHERE product_id=?`, units, productID)
+		return err
+	})
+	return units, err
+}
+
+// Confirmed holds have no expires_at, so the reaper never selects them
+func (s *MySQLStore) Confirm(ctx context.Context, productID int, owner string) (int, error) {
+	var units int
+	err := s.inventoryTx(ctx, productID, func(tx *sql.Tx, inv *Inventory) error {
+		if err := tx.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(quantity), 0) FROM reservations
+			WHERE product_id=? AND owner=? AND status='HELD' FOR UPDATE
+		`, productID, owner).Scan(&units); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE reservations SET expires_at=NULL WHERE product_id=? AND owner=? AND status='HELD'`, productID, owner)
+		return err
+	})
+	return units, err
+}
+
+// ReapExpired finds candidates without locking, then expires each one in its
+// own transaction. The status='HELD' re-check under the inventory lock makes
+// the race between replicas (or with Ship/Release) harmless: whoever comes
+// second finds nothing to do.
+func (s *MySQLStore) ReapExpired(ctx context.Context, now time.Time, limit int) (ReapResult, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT reservation_id, product_id FROM reservations
+		WHERE status='HELD' AND expires_at <= ?
+		ORDER BY expires_at LIMIT ?
+	`, now.UTC(), limit)
+	if err != nil {
+		return ReapResult{}, err
+	}
+	type candidate struct {
+		id        int64
+		productID int
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.productID); err != nil {
+			rows.Close()
+			return ReapResult{}, err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return ReapResult{}, err
+	}
+
+	var res ReapResult
+	for _, c := range candidates {
+		quantity := 0
+		err := s.inventoryTx(ctx, c.productID, func(tx *sql.Tx, inv *Inventory) error {
+			err := tx.QueryRowContext(ctx, `SELECT quantity FROM reservations WHERE reservation_id=? AND status='HELD' FOR UPDATE`, c.id).Scan(&quantity)
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE reservations SET status='EXPIRED' WHERE reservation_id=?`, c.id); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE inventory SET reserved=reserved-? WHERE product_id=?`, quantity, c.productID)
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+		if quantity > 0 {
+			res.Reservations++
+			res.Units += quantity
+		}
+	}
+	return res, nil
+}
+
+/************ MySQL PaymentStore ************/
+
+func (s *MySQLStore) SavePayment(ctx context.Context, p Payment) error {
+	orderID, err := strconv.Atoi(p.OrderID)
+	if err != nil || orderID < 1 {
+		return ErrInvalidOrderID
+	}
+	cartID, err := parseMySQLCartID(p.CartID)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO payments (order_id, transaction_id, cart_id, customer_id, amount_cents, status, card_token, card_last4, card_brand, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, orderID, p.TransactionID, cartID, p.CustomerID, p.AmountCents, p.Status, p.CardToken, p.CardLast4, p.CardBrand, p.CreatedAt)
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && me.Number == 1062 { // duplicate key: the order is already paid
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *MySQLStore) GetOrderPayment(ctx context.Context, orderID string) (*Payment, error) {
+	id, err := strconv.Atoi(orderID)
+	if err != nil || id < 1 {
+		return nil, ErrInvalidOrderID
+	}
+	var p Payment
+	var rawOrderID, rawCartID int
+	err = s.db.QueryRowContext(ctx, `
+		SELECT order_id, transaction_id, cart_id, customer_id, amount_cents, status, card_token, card_last4, card_brand, created_at
+		FROM payments WHERE order_id=?
+	`, id).Scan(&rawOrderID, &p.TransactionID, &rawCartID, &p.CustomerID, &p.AmountCents, &p.Status, &p.CardToken, &p.CardLast4, &p.CardBrand, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPaymentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.OrderID = strconv.Itoa(rawOrderID)
+	p.CartID = strconv.Itoa(rawCartID)
+	return &p, nil
+}
+
+/************ MySQL RefundStore ************/
+
+// Both refund steps lock the payments row first, so the ledger of an order is
+// only ever changed by one transaction at a time.
+func (s *MySQLStore) refundTx(ctx context.Context, orderID string, fn func(tx *sql.Tx, id int, captured int64) error) error {
+	id, err := strconv.Atoi(orderID)
+	if err != nil || id < 1 {
+		return ErrInvalidOrderID
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var captured int64
+	err = tx.QueryRowContext(ctx, `SELECT amount_cents FROM payments WHERE order_id=? FOR UPDATE`, id).Scan(&captured)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrPaymentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(tx, id, captured); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *MySQLStore) BeginRefund(ctx context.Context, r Refund) (*Refund, error) {
+	var out *Refund
+	err := s.refundTx(ctx, r.OrderID, func(tx *sql.Tx, id int, captured int64) error {
+		ledger, err := queryRefunds(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		existing, amount, err := planRefund(ledger, captured, r)
+		if err != nil || existing != nil {
+			out = existing
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO refunds (order_id, idempotency_key, amount_cents, reason, status, created_at)
+			VALUES (?, ?, ?, ?, 'PENDING', ?)
+		`, id, r.IdempotencyKey, amount, r.Reason, r.CreatedAt)
+		if err != nil {
+			return err
+		}
+		refundID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		r.RefundID = strconv.FormatInt(refundID, 10)
+		r.AmountCents = amount
+		r.Status = RefundStatusPending
+		out = &r
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *MySQLStore) FinishRefund(ctx context.Context, orderID, refundID, status, processorRef string) (*Refund, string, error) {
+	var out *Refund
+	var orderStatus string
+	err := s.refundTx(ctx, orderID, func(tx *sql.Tx, id int, captured int64) error {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE refunds SET status=?, processor_ref=?
+			WHERE refund_id=? AND order_id=? AND status='PENDING'
+		`, status, processorRef, refundID, id)
+		if err != nil {
+			return err
+		}
+		changed, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		ledger, err := queryRefunds(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		for i := range ledger {
+			if ledger[i].RefundID == refundID {
+				out = &ledger[i]
+			}
+		}
+		if out == nil {
+			return ErrRefundNotFound
+		}
+		if changed > 0 && status == RefundStatusSucceeded {
+			if _, err := tx.ExecContext(ctx, `UPDATE orders SET status=? WHERE order_id=?`,
+				refundedOrderStatus(captured, refundedCents(ledger)), id); err != nil {
+				return err
+			}
+		}
+		return tx.QueryRowContext(ctx, `SELECT status FROM orders WHERE order_id=?`, id).Scan(&orderStatus)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return out, orderStatus, nil
+}
+
+func (s *MySQLStore) ListRefunds(ctx context.Context, orderID string) ([]Refund, error) {
+	id, err := strconv.Atoi(orderID)
+	if err != nil || id < 1 {
+		return nil, ErrInvalidOrderID
+	}
+	var exists int
+	err = s.db.QueryRowContext(ctx, `SELECT 1 FROM orders WHERE order_id=?`, id).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return queryRefunds(ctx, s.db, id)
+}
+
+// queryRefunds loads an order's ledger through the DB or an open transaction
+func queryRefunds(ctx context.Context, q interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}, orderID int) ([]Refund, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT refund_id, idempotency_key, amount_cents, reason, status, processor_ref, created_at
+		FROM refunds WHERE order_id=? ORDER BY refund_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ledger []Refund
+	for rows.Next() {
+		var r Refund
+		var refundID int64
+		if err := rows.Scan(&refundID, &r.IdempotencyKey, &r.AmountCents, &r.Reason, &r.Status, &r.ProcessorRef, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		r.RefundID = strconv.FormatInt(refundID, 10)
+		r.OrderID = strconv.Itoa(orderID)
+		ledger = append(ledger, r)
+	}
+	return ledger, rows.Err()
+}
+
+/************ MySQL SagaStore ************/
+
+const sagaColumns = `cart_id, customer_id, attempt, status, step, items, amount_cents, card_token, card_last4, card_brand,
+	transaction_id, order_id, failure, version, created_at, updated_at`
+
+func (s *MySQLStore) GetSaga(ctx context.Context, cartID string) (*CheckoutSaga, error) {
+	id, err := parseMySQLCartID(cartID)
+	if err != nil {
+		return nil, err
+	}
+	saga, err := scanSaga(s.db.QueryRowContext(ctx, `SELECT `+sagaColumns+` FROM checkout_sagas WHERE cart_id=?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSagaNotFound
+	}
+	return saga, err
+}
+
+func (s *MySQLStore) SaveSaga(ctx context.Context, saga *CheckoutSaga) error {
+	id, err := parseMySQLCartID(saga.CartID)
+	if err != nil {
+		return err
+	}
+	items, err := json.Marshal(saga.Items)
+	if err != nil {
+		return err
+	}
+	args := []any{saga.CustomerID, saga.Attempt, saga.Status, saga.Step, string(items), saga.AmountCents,
+		saga.CardToken, saga.CardLast4, saga.CardBrand, saga.TransactionID, saga.OrderID, saga.Failure,
+		saga.Version + 1, saga.CreatedAt, saga.UpdatedAt}
+
+	if saga.Version == 0 {
+		_, err = s.db.ExecContext(ctx, `
+			INSERT INTO checkout_sagas (customer_id, attempt, status, step, items, amount_cents, card_token, card_last4, card_brand,
+				transaction_id, order_id, failure, version, created_at, updated_at, cart_id)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, append(args, id)...)
+		var me *mysql.MySQLError
+		if errors.As(err, &me) && me.Number == 1062 { // another request started a saga first
+			return ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		res, err := s.db.ExecContext(ctx, `
+			UPDATE checkout_sagas SET customer_id=?, attempt=?, status=?, step=?, items=?, amount_cents=?, card_token=?, card_last4=?, card_brand=?,
+				transaction_id=?, order_id=?, failure=?, version=?, created_at=?, updated_at=?
+			WHERE cart_id=? AND version=?
+		`, append(args, id, saga.Version)...)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrConflict
+		}
+	}
+	saga.Version++
+	return nil
+}
+
+func (s *MySQLStore) ListStaleSagas(ctx context.Context, before time.Time, limit int) ([]CheckoutSaga, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+sagaColumns+` FROM checkout_sagas
+		WHERE status='RUNNING' AND updated_at < ? ORDER BY updated_at LIMIT ?
+	`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []CheckoutSaga
+	for rows.Next() {
+		saga, err := scanSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *saga)
+	}
+	return out, rows.Err()
+}
+
+// scanSaga reads one row selected with sagaColumns
+func scanSaga(row interface{ Scan(dest ...any) error }) (*CheckoutSaga, error) {
+	var saga CheckoutSaga
+	var cartID int
+	var items string
+	err := row.Scan(&cartID, &saga.CustomerID, &saga.Attempt, &saga.Status, &saga.Step, &items, &saga.AmountCents,
+		&saga.CardToken, &saga.CardLast4, &saga.CardBrand, &saga.TransactionID, &saga.OrderID, &saga.Failure,
+		&saga.Version, &saga.CreatedAt, &saga.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	saga.CartID = strconv.Itoa(cartID)
+	if err := json.Unmarshal([]byte(items), &saga.Items); err != nil {
+		return nil, fmt.Errorf("checkout saga %d: decode items: %w", cartID, err)
+	}
+	return &saga, nil
+}
+
+/************ MySQL OutboxStore ************/
+
+// insertOutboxEvent records ev inside the caller's transaction
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, ev OutboxEvent) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO outbox (event_type, payload, created_at, next_attempt_at) VALUES (?, ?, ?, ?)
+	`, ev.EventType, ev.Payload, ev.CreatedAt, ev.CreatedAt)
+	return err
+}
+
+// The claim pushes next_attempt_at out to the end of the lease. SKIP LOCKED
+// lets a relay claiming at the same moment take the next events instead of
+// waiting for these.
+func (s *MySQLStore) ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEvent, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT event_id, event_type, payload, attempts, last_error, created_at
+		FROM outbox WHERE sent_at IS NULL AND next_attempt_at <= ? ORDER BY event_id LIMIT ?
+		FOR UPDATE SKIP LOCKED
+	`, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []OutboxEvent
+	var ids []any
+	for rows.Next() {
+		var ev OutboxEvent
+		var id int64
+		if err := rows.Scan(&id, &ev.EventType, &ev.Payload, &ev.Attempts, &ev.LastError, &ev.CreatedAt); err != nil {
+			return nil, err
+		}
+		ev.ID = strconv.FormatInt(id, 10)
+		out = append(out, ev)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := append([]any{now.Add(lease).UTC()}, ids...)
+	if _, err := tx.ExecContext(ctx, `UPDATE outbox SET next_attempt_at=? WHERE event_id IN (`+placeholders+`)`, args...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *MySQLStore) MarkEventSent(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE outbox SET sent_at=CURRENT_TIMESTAMP(3) WHERE event_id=? AND sent_at IS NULL`, id)
+	return err
+}
+
+func (s *MySQLStore) MarkEventFailed(ctx context.Context, id, reason string, retryAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE outbox SET attempts=attempts+1, last_error=?, next_attempt_at=? WHERE event_id=? AND sent_at IS NULL
+	`, reason, retryAt.UTC(), id)
+	return err
+}
+
+// idx_outbox_pending leads with sent_at, so the delete ranges over the index
+func (s *MySQLStore) PurgeSentEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ? ORDER BY sent_at LIMIT ?
+	`, before.UTC(), limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
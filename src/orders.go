@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned by OrderStore implementations
+var (
+	ErrOrderNotFound  = errors.New("order not found")
+	ErrInvalidOrderID = errors.New("invalid order id")
+	ErrInvalidCursor  = errors.New("invalid cursor")
+)
+
+// OrderStore reads the orders written by CartStore.Checkout.
+type OrderStore interface {
+	// GetOrder returns one order with its items, or ErrOrderNotFound.
+	GetOrder(ctx context.Context, orderID string) (*Order, error)
+	// ListCustomerOrders pages through a customer's orders, newest first.
+	// cursor is "" for the first page; the returned cursor is "" after the last page.
+	ListCustomerOrders(ctx context.Context, customerID, limit int, cursor string) ([]Order, string, error)
+}
+
+// Page size bounds for GET /customers/{customerId}/orders
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+// Cursors are opaque to clients: base64(JSON) of a backend-specific position
+func encodeCursor(v any) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+/************ Events ************/
+
+// OrderPlacedEvent announces a new order. Checkout records it in the store's
+// outbox together with the order (see OutboxRelay); the order processor ships
+// the order once it is paid.
+type OrderPlacedEvent struct {
+	EventType   string     `json:"event_type"`
+	Version     int        `json:"version"`
+	OrderID     string     `json:"order_id"`
+	CartID      string     `json:"cart_id"`
+	CustomerID  int        `json:"customer_id"`
+	Items       []CartItem `json:"items"`
+	AmountCents int64      `json:"amount_cents"`
+	OccurredAt  time.Time  `json:"occurred_at"`
+}
+
+const orderPlacedEventType = "order.placed"
+
+// The outbox entry a checkout writes with order o
+func orderPlacedOutboxEvent(o *Order) (OutboxEvent, error) {
+	return newOutboxEvent(orderPlacedEventType, OrderPlacedEvent{
+		EventType:   orderPlacedEventType,
+		Version:     1,
+		OrderID:     o.ID,
+		CartID:      o.CartID,
+		CustomerID:  o.CustomerID,
+		Items:       o.Items,
+		AmountCents: cartAmountCents(&Cart{Items: o.Items}),
+		OccurredAt:  o.CreatedAt,
+	}, o.CreatedAt)
+}
+
+/************ Handlers ************/
+
+type orderDTO struct {
+	OrderID    string     `json:"order_id"`
+	CartID     string     `json:"cart_id"`
+	CustomerID int        `json:"customer_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Items      []CartItem `json:"items"`
+}
+
+type listOrdersResp struct {
+	Orders     []orderDTO `json:"orders"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+func orderToDTO(o *Order) orderDTO {
+	items := o.Items
+	if items == nil {
+		items = []CartItem{}
+	}
+	return orderDTO{
+		OrderID:    o.ID,
+		CartID:     o.CartID,
+		CustomerID: o.CustomerID,
+		Status:     o.Status,
+		CreatedAt:  o.CreatedAt,
+		Items:      items,
+	}
+}
+
+// GET /orders/{orderId}
+func getOrderHandler(store OrderStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		orderID := strings.TrimPrefix(r.URL.Path, "/orders/")
+		if orderID == "" || strings.Contains(orderID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		o, err := store.GetOrder(r.Context(), orderID)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		writeJSON(w, 200, orderToDTO(o))
+	}
+}
+
+// GET /customers/{customerId}/orders?limit=&cursor=
+func listCustomerOrdersHandler(store OrderStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/customers/"), "/")
+		if len(parts) != 2 || parts[1] != "orders" {
+			http.NotFound(w, r)
+			return
+		}
+		customerID, err := strconv.Atoi(parts[0])
+		if err != nil || customerID < 1 {
+			writeErr(w, 400, "INVALID_INPUT", "customerId must be a positive integer")
+			return
+		}
+
+		limit := defaultOrderPageSize
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxOrderPageSize {
+				writeErr(w, 400, "INVALID_INPUT", "limit must be between 1 and 100")
+				return
+			}
+			limit = n
+		}
+
+		orders, next, err := store.ListCustomerOrders(r.Context(), customerID, limit, r.URL.Query().Get("cursor"))
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		resp := listOrdersResp{Orders: make([]orderDTO, 0, len(orders)), NextCursor: next}
+		for i := range orders {
+			resp.Orders = append(resp.Orders, orderToDTO(&orders[i]))
+		}
+		writeJSON(w, 200, resp)
+	}
+}
+
+// refunds serves /orders/{orderId}/refunds, which shares the /orders/ prefix
+func registerOrderRoutes(mux *http.ServeMux, store OrderStore, refunds http.HandlerFunc) {
+	mux.HandleFunc("/orders/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/refunds") {
+			refunds(w, r)
+			return
+		}
+		getOrderHandler(store)(w, r)
+	})
+	mux.HandleFunc("/customers/", listCustomerOrdersHandler(store))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Events that must not be lost (order.placed) are not published by the code
+// that makes the change. The store records them in the same transaction as the
+// change, and OutboxRelay publishes them afterwards, so a crash in between
+// delays an event instead of losing it. Every replica runs a relay; each one
+// claims the events it publishes, so an event goes out once however many
+// replicas there are. Delivery is still at least once: a relay can publish an
+// event and die before marking it sent, and its claim then runs out.
+
+// OutboxEvent is an event recorded with the change it describes
+type OutboxEvent struct {
+	ID        string
+	EventType string
+	Payload   string // the event as JSON, published as is
+	Attempts  int    // failed publishes so far
+	LastError string
+	CreatedAt time.Time
+}
+
+// OutboxStore gives the relay access to the recorded events.
+type OutboxStore interface {
+	// ClaimEvents claims and returns up to limit unsent events that are due
+	// (not waiting out a retry delay or another relay's claim) at now, oldest
+	// first. A claimed event is not due again until now+lease, unless it is
+	// marked failed sooner; concurrent callers never get the same event.
+	ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]OutboxEvent, error)
+	// MarkEventSent records that the event was published.
+	MarkEventSent(ctx context.Context, id string) error
+	// MarkEventFailed records a failed publish; the event is due again at retryAt.
+	MarkEventFailed(ctx context.Context, id, reason string, retryAt time.Time) error
+	// PurgeSentEvents deletes up to limit events sent before before and returns
+	// how many it deleted. Backends that drop sent events on their own return 0.
+	PurgeSentEvents(ctx context.Context, before time.Time, limit int) (int, error)
+}
+
+// Build the outbox entry for event
+func newOutboxEvent(eventType string, event any, at time.Time) (OutboxEvent, error) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	return OutboxEvent{EventType: eventType, Payload: string(b), CreatedAt: at}, nil
+}
+
+// Failed publishes are retried after 1s, 2s, 4s, ... up to 5 minutes
+func outboxRetryDelay(attempts int) time.Duration {
+	if attempts >= 8 {
+		return 5 * time.Minute
+	}
+	return time.Second << attempts
+}
+
+/************ Relay ************/
+
+// Events published per ClaimEvents call; a full batch triggers another pass right away
+const outboxBatchSize = 100
+
+// How long a claimed batch is ours; it must outlast publishing the batch. A
+// batch not finished by then may be published by another relay as well.
+const outboxClaimLease = time.Minute
+
+// Sent events are kept OUTBOX_RETENTION (default 7 days) for debugging and
+// replays, then purged in batches of outboxPurgeBatch every outboxPurgeEvery
+const (
+	outboxPurgeBatch = 500
+	outboxPurgeEvery = 10 * time.Minute
+)
+
+func outboxRetention() time.Duration {
+	d, err := time.ParseDuration(getenv("OUTBOX_RETENTION", "168h"))
+	if err != nil || d <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return d
+}
+
+// OutboxRelay publishes recorded events. Every replica runs one; the claims
+// keep them off each other's events.
+type OutboxRelay struct {
+	store     OutboxStore
+	events    EventPublisher
+	interval  time.Duration
+	retention time.Duration
+	purgedAt  time.Time // last purge; only runOnce touches it
+
+	runs      atomic.Int64
+	published atomic.Int64
+	failed    atomic.Int64
+	purged    atomic.Int64
+	lagMs     atomic.Int64 // age of the oldest due event at the last run
+
+	mu        sync.Mutex
+	lastRunAt time.Time
+	lastError string
+}
+
+func newOutboxRelay(store OutboxStore, events EventPublisher) *OutboxRelay {
+	interval, err := time.ParseDuration(getenv("OUTBOX_RELAY_INTERVAL", "1s"))
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+	return &OutboxRelay{store: store, events: events, interval: interval, retention: outboxRetention()}
+}
+
+// Run relays until ctx is cancelled
+func (r *OutboxRelay) Run(ctx context.Context) {
+	for {
+		r.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *OutboxRelay) runOnce(ctx context.Context) {
+	r.runs.Add(1)
+	var runErr error
+	var lag time.Duration
+	for first := true; ; first = false {
+		now := time.Now()
+		batch, err := r.store.ClaimEvents(ctx, now, outboxClaimLease, outboxBatchSize)
+		if err != nil {
+			runErr = err
+			break
+		}
+		if first && len(batch) > 0 {
+			lag = now.Sub(batch[0].CreatedAt)
+		}
+		for _, ev := range batch {
+			if err := r.events.Publish(ctx, ev.EventType, json.RawMessage(ev.Payload)); err != nil {
+				r.failed.Add(1)
+				log.Printf("outbox relay: publish %s %s (attempt %d): %v", ev.EventType, ev.ID, ev.Attempts+1, err)
+				if err := r.store.MarkEventFailed(ctx, ev.ID, truncate(err.Error(), 255), time.Now().Add(outboxRetryDelay(ev.Attempts))); err != nil {
+					runErr = err
+				}
+				continue
+			}
+			r.published.Add(1)
+			if err := r.store.MarkEventSent(ctx, ev.ID); err != nil {
+				// Published but not marked: it goes out again on the next run
+				runErr = err
+			}
+		}
+		if runErr != nil || len(batch) < outboxBatchSize {
+			break
+		}
+	}
+	r.lagMs.Store(lag.Milliseconds())
+	if runErr == nil && time.Since(r.purgedAt) >= outboxPurgeEvery {
+		runErr = r.purge(ctx)
+	}
+
+	r.mu.Lock()
+	r.lastRunAt = time.Now().UTC()
+	r.lastError = ""
+	if runErr != nil {
+		r.lastError = runErr.Error()
+	}
+	r.mu.Unlock()
+
+	if runErr != nil {
+		log.Printf("outbox relay: %v", runErr)
+	}
+}
+
+// purge deletes the events sent more than r.retention ago, a batch at a time
+// so no single delete holds locks for long
+func (r *OutboxRelay) purge(ctx context.Context) error {
+	before := time.Now().Add(-r.retention)
+	for {
+		n, err := r.store.PurgeSentEvents(ctx, before, outboxPurgeBatch)
+		r.purged.Add(int64(n))
+		if err != nil {
+			return err
+		}
+		if n < outboxPurgeBatch {
+			break
+		}
+	}
+	r.purgedAt = time.Now()
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+type outboxStatsResp struct {
+	IntervalSeconds float64    `json:"interval_seconds"`
+	Runs            int64      `json:"runs"`
+	Published       int64      `json:"published"`
+	Failed          int64      `json:"failed"`
+	Purged          int64      `json:"purged"`
+	LagMs           int64      `json:"lag_ms"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// GET /outbox/relay —— counters of this replica's relay; lag_ms is how old the
+// oldest unpublished event was when the relay last looked
+func (r *OutboxRelay) statsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.NotFound(w, req)
+		return
+	}
+	resp := outboxStatsResp{
+		IntervalSeconds: r.interval.Seconds(),
+		Runs:            r.runs.Load(),
+		Published:       r.published.Load(),
+		Failed:          r.failed.Load(),
+		Purged:          r.purged.Load(),
+		LagMs:           r.lagMs.Load(),
+	}
+	r.mu.Lock()
+	if !r.lastRunAt.IsZero() {
+		t := r.lastRunAt
+		resp.LastRunAt = &t
+	}
+	resp.LastError = r.lastError
+	r.mu.Unlock()
+	writeJSON(w, 200, resp)
+}
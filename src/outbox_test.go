@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingPublisher counts the events published per order
+type countingPublisher struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func (p *countingPublisher) Publish(ctx context.Context, eventType string, event any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count[string(event.(json.RawMessage))]++
+	return nil
+}
+
+func TestOutboxRelaysPublishEachEventOnce(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	const events = 250
+	for i := range events {
+		ev, err := newOutboxEvent(orderPlacedEventType, map[string]int{"n": i}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.mu.Lock()
+		store.nextEventID++
+		ev.ID = strconv.Itoa(store.nextEventID)
+		store.outbox = append(store.outbox, memoryOutboxEvent{OutboxEvent: ev, dueAt: ev.CreatedAt})
+		store.mu.Unlock()
+	}
+
+	pub := &countingPublisher{count: map[string]int{}}
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newOutboxRelay(store, pub).runOnce(ctx)
+		}()
+	}
+	wg.Wait()
+
+	if len(pub.count) != events {
+		t.Fatalf("published %d distinct events, want %d", len(pub.count), events)
+	}
+	for payload, n := range pub.count {
+		if n != 1 {
+			t.Errorf("event %s published %d times", payload, n)
+		}
+	}
+}
+
+func TestOutboxClaimExpires(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	ev, _ := newOutboxEvent(orderPlacedEventType, map[string]int{"n": 1}, time.Now())
+	ev.ID = "1"
+	store.outbox = append(store.outbox, memoryOutboxEvent{OutboxEvent: ev, dueAt: ev.CreatedAt})
+
+	now := time.Now()
+	if got, _ := store.ClaimEvents(ctx, now, time.Minute, 10); len(got) != 1 {
+		t.Fatalf("first claim got %d events, want 1", len(got))
+	}
+	if got, _ := store.ClaimEvents(ctx, now.Add(30*time.Second), time.Minute, 10); len(got) != 0 {
+		t.Fatalf("claim during the lease got %d events, want 0", len(got))
+	}
+	// The first relay died without marking it: it is due again after the lease
+	if got, _ := store.ClaimEvents(ctx, now.Add(time.Minute), time.Minute, 10); len(got) != 1 {
+		t.Fatalf("claim after the lease got %d events, want 1", len(got))
+	}
+}
+
+// purgeRecorder deletes a full batch twice, then a partial one
+type purgeRecorder struct {
+	*MemoryStore
+	before []time.Time
+}
+
+func (s *purgeRecorder) PurgeSentEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	s.before = append(s.before, before)
+	if len(s.before) <= 2 {
+		return limit, nil
+	}
+	return 7, nil
+}
+
+func TestOutboxRelayPurgesSentEvents(t *testing.T) {
+	t.Setenv("OUTBOX_RETENTION", "48h")
+	store := &purgeRecorder{MemoryStore: newMemoryStore()}
+	relay := newOutboxRelay(store, &countingPublisher{count: map[string]int{}})
+
+	start := time.Now()
+	relay.runOnce(context.Background())
+	if len(store.before) != 3 {
+		t.Fatalf("purged in %d batches, want 3", len(store.before))
+	}
+	if cutoff := store.before[0]; cutoff.Before(start.Add(-48*time.Hour)) || cutoff.After(time.Now().Add(-48*time.Hour)) {
+		t.Errorf("purged events sent before %v, want 48h ago", cutoff)
+	}
+	if got, want := relay.purged.Load(), int64(2*outboxPurgeBatch+7); got != want {
+		t.Errorf("purged = %d, want %d", got, want)
+	}
+
+	// Not again until outboxPurgeEvery has passed
+	relay.runOnce(context.Background())
+	if len(store.before) != 3 {
+		t.Errorf("purged again right away (%d batches)", len(store.before))
+	}
+}
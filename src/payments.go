@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Errors returned by PaymentProcessor and PaymentStore implementations
+var (
+	ErrPaymentDeclined = errors.New("payment declined")
+	ErrPaymentTimeout  = errors.New("payment processor timed out")
+	ErrPaymentNotFound = errors.New("payment not found")
+)
+
+// Payment statuses
+const (
+	PaymentStatusCaptured = "CAPTURED"
+)
+
+// Payment is a captured charge, linked to the order its cart's checkout created.
+// An order has at most one payment. The card is only known by its token.
+type Payment struct {
+	TransactionID string    `json:"transaction_id" dynamodbav:"transaction_id"`
+	OrderID       string    `json:"order_id" dynamodbav:"order_id"`
+	CartID        string    `json:"cart_id" dynamodbav:"cart_id"`
+	CustomerID    int       `json:"customer_id" dynamodbav:"customer_id"`
+	AmountCents   int64     `json:"amount_cents" dynamodbav:"amount_cents"`
+	Status        string    `json:"status" dynamodbav:"status"`
+	CardToken     string    `json:"card_token" dynamodbav:"card_token"`
+	CardLast4     string    `json:"card_last4" dynamodbav:"card_last4"`
+	CardBrand     string    `json:"card_brand" dynamodbav:"card_brand"`
+	CreatedAt     time.Time `json:"created_at" dynamodbav:"created_at"`
+}
+
+// PaymentStore persists captured payments.
+type PaymentStore interface {
+	// SavePayment records a captured payment; a second payment for the same
+	// order fails with ErrConflict.
+	SavePayment(ctx context.Context, p Payment) error
+	// GetOrderPayment returns the payment of an order, or ErrPaymentNotFound.
+	GetOrderPayment(ctx context.Context, orderID string) (*Payment, error)
+}
+
+// ChargeRequest is one charge sent to a PaymentProcessor
+type ChargeRequest struct {
+	IdempotencyKey string // same key => same transaction, never a second charge
+	AmountCents    int64
+	CardNumber     string
+}
+
+// PaymentProcessor is the card gateway. Declines are reported as
+// ErrPaymentDeclined (wrapped with the reason), gateway timeouts as ErrPaymentTimeout.
+type PaymentProcessor interface {
+	// Charge captures the amount and returns the gateway's transaction ID.
+	Charge(ctx context.Context, req ChargeRequest) (string, error)
+	// Lookup finds the live (not voided) charge made with an idempotency key,
+	// for when a crash or timeout hid Charge's outcome. ErrPaymentNotFound if none.
+	Lookup(ctx context.Context, idempotencyKey string) (string, error)
+	// Void cancels a captured charge whose checkout could not be completed.
+	Void(ctx context.Context, transactionID string) error
+	// Refund pays back part of a captured charge and returns the gateway's
+	// refund ID. Retrying with the same idempotency key never refunds twice.
+	Refund(ctx context.Context, transactionID string, amountCents int64, idempotencyKey string) (string, error)
+}
+
+// Select the processor from PAYMENT_PROCESSOR; only the local fake exists so far
+func newPaymentProcessorFromEnv() (PaymentProcessor, error) {
+	switch name := getenv("PAYMENT_PROCESSOR", "fake"); name {
+	case "fake":
+		return newFakeProcessor(), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROCESSOR %q", name)
+	}
+}
+
+// The catalog has no prices yet, so every unit costs PAYMENT_UNIT_PRICE_CENTS
+func cartAmountCents(c *Cart) int64 {
+	unit := int64(getenvInt("PAYMENT_UNIT_PRICE_CENTS", 1000))
+	var total int64
+	for _, it := range c.Items {
+		total += int64(it.Quantity) * unit
+	}
+	return total
+}
+
+/************ Fake processor ************/
+
+// Test cards understood by fakeProcessor; every other Luhn-valid number is approved.
+var fakeDeclines = map[string]string{
+	"4000000000000002": "card_declined",
+	"4000000000009995": "insufficient_funds",
+	"4000000000000069": "expired_card",
+}
+
+// Charging this card blocks until the caller's deadline, like a hung gateway
+const fakeTimeoutCard = "4000000000000119"
+
+// fakeProcessor is a deterministic in-process gateway for local runs and load tests.
+type fakeProcessor struct {
+	mu       sync.Mutex
+	issued   int
+	charges  map[string]string // idempotency key -> transaction ID
+	amounts  map[string]int64  // transaction ID -> captured amount
+	refunded map[string]int64  // transaction ID -> refunded so far
+	refunds  map[string]string // refund idempotency key -> refund ID
+	voided   map[string]bool
+}
+
+func newFakeProcessor() *fakeProcessor {
+	return &fakeProcessor{
+		charges:  make(map[string]string),
+		amounts:  make(map[string]int64),
+		refunded: make(map[string]int64),
+		refunds:  make(map[string]string),
+		voided:   make(map[string]bool),
+	}
+}
+
+func (f *fakeProcessor) Charge(ctx context.Context, req ChargeRequest) (string, error) {
+	if req.CardNumber == fakeTimeoutCard {
+		<-ctx.Done()
+		return "", ErrPaymentTimeout
+	}
+	if reason, ok := fakeDeclines[req.CardNumber]; ok {
+		return "", fmt.Errorf("%w: %s", ErrPaymentDeclined, reason)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.charges[req.IdempotencyKey]; ok && !f.voided[id] {
+		return id, nil
+	}
+	f.issued++
+	id := fmt.Sprintf("fake_txn_%08d", f.issued)
+	f.charges[req.IdempotencyKey] = id
+	f.amounts[id] = req.AmountCents
+	return id, nil
+}
+
+// Refunds of unknown or voided transactions, or beyond the captured amount, are declined
+func (f *fakeProcessor) Refund(ctx context.Context, transactionID string, amountCents int64, idempotencyKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.refunds[idempotencyKey]; ok {
+		return id, nil
+	}
+	captured, ok := f.amounts[transactionID]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("%w: unknown_transaction", ErrPaymentDeclined)
+	case f.voided[transactionID]:
+		return "", fmt.Errorf("%w: transaction_voided", ErrPaymentDeclined)
+	case f.refunded[transactionID]+amountCents > captured:
+		return "", fmt.Errorf("%w: amount_exceeds_capture", ErrPaymentDeclined)
+	}
+	f.issued++
+	id := fmt.Sprintf("fake_rfnd_%08d", f.issued)
+	f.refunds[idempotencyKey] = id
+	f.refunded[transactionID] += amountCents
+	return id, nil
+}
+
+func (f *fakeProcessor) Lookup(ctx context.Context, idempotencyKey string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id, ok := f.charges[idempotencyKey]; ok && !f.voided[id] {
+		return id, nil
+	}
+	return "", ErrPaymentNotFound
+}
+
+func (f *fakeProcessor) Void(ctx context.Context, transactionID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.voided[transactionID] = true
+	return nil
+}
+
+/************ Handlers ************/
+
+type paymentReq struct {
+	CreditCardNumber string `json:"credit_card_number"`
+	ShoppingCartID   string `json:"shopping_cart_id"`
+}
+
+type paymentResp struct {
+	Success       bool   `json:"success"`
+	TransactionID string `json:"transaction_id"`
+	OrderID       string `json:"order_id"`
+}
+
+// Processor call timeout (PAYMENT_TIMEOUT, e.g. "5s")
+func paymentTimeout() time.Duration {
+	if d, err := time.ParseDuration(getenv("PAYMENT_TIMEOUT", "5s")); err == nil && d > 0 {
+		return d
+	}
+	return 5 * time.Second
+}
+
+// paidCheckout pays for a cart and checks it out: reserve the cart's stock,
+// charge the card, then check the cart out and record the payment against the
+// new order. The steps run as a CheckoutOrchestrator saga: a decline releases
+// the stock, a failure after the charge voids it, and one cart can only be
+// paid once. A completed checkout publishes cart.checked_out to events. Both
+// POST /payments/checkout and POST /shopping-carts/{id}/checkout go through it.
+type paidCheckout struct {
+	carts     CartStore
+	payments  PaymentStore
+	checkout  *CheckoutOrchestrator
+	tokenizer CardTokenizer
+	events    EventPublisher
+}
+
+func newPaidCheckout(store Store, checkout *CheckoutOrchestrator, tokenizer CardTokenizer, events EventPublisher) *paidCheckout {
+	return &paidCheckout{carts: store, payments: store, checkout: checkout, tokenizer: tokenizer, events: events}
+}
+
+// pay checks out cartID paying with pan. On failure it has written the error
+// response and returns nil.
+func (p *paidCheckout) pay(w http.ResponseWriter, r *http.Request, cartID, pan string) *paymentResp {
+	if !validCardNumber(pan) {
+		writeErr(w, 400, "INVALID_INPUT", "credit_card_number must be 13-19 digits with a valid check digit")
+		return nil
+	}
+
+	cart, err := p.carts.GetCart(r.Context(), cartID)
+	if err != nil {
+		writeStoreErr(w, err)
+		return nil
+	}
+	if cart.Status != CartStatusOpen {
+		// Already paid: answer the retry with the original payment
+		if cart.OrderID != "" {
+			if paid, err := p.payments.GetOrderPayment(r.Context(), cart.OrderID); err == nil {
+				return &paymentResp{Success: true, TransactionID: paid.TransactionID, OrderID: paid.OrderID}
+			}
+		}
+		writeStoreErr(w, ErrCartCheckedOut)
+		return nil
+	}
+	if len(cart.Items) == 0 {
+		writeStoreErr(w, ErrCartEmpty)
+		return nil
+	}
+
+	card, err := p.tokenizer.Tokenize(r.Context(), pan)
+	if err != nil {
+		writeStoreErr(w, err)
+		return nil
+	}
+
+	// A client hanging up must not leave the saga half way
+	saga, err := p.checkout.Run(context.WithoutCancel(r.Context()), cart, card, pan)
+	if err != nil {
+		writeStoreErr(w, err)
+		return nil
+	}
+	ev := newCartEvent(cartCheckedOutEventType, cart.ID, cart.CustomerID)
+	ev.OrderID = saga.OrderID
+	publishCartEvent(r.Context(), p.events, ev)
+	return &paymentResp{Success: true, TransactionID: saga.TransactionID, OrderID: saga.OrderID}
+}
+
+// POST /payments/checkout —— paidCheckout for the cart named in the body
+func processPaymentHandler(p *paidCheckout) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var req paymentReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
+			return
+		}
+		if req.ShoppingCartID == "" {
+			writeErr(w, 400, "INVALID_INPUT", "shopping_cart_id is required")
+			return
+		}
+		if resp := p.pay(w, r, req.ShoppingCartID, req.CreditCardNumber); resp != nil {
+			writeJSON(w, 200, resp)
+		}
+	}
+}
+
+func registerPaymentRoutes(mux *http.ServeMux, p *paidCheckout) {
+	mux.HandleFunc("/payments/checkout", processPaymentHandler(p))
+}
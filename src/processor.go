@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The order processor is the ECS "processor" task (./app processor). It
+// long-polls the order queue, which the order events topic fans out to, and
+// ships every paid order: one whose checkout saga completed and whose payment
+// is recorded. A real gateway is also asked whether the charge still stands.
+// With QUEUE_BACKEND=memory the service runs it in-process instead.
+
+// A received batch is handled concurrently, each message under this timeout
+// counted from the receive, so the whole batch finishes well inside the
+// queue's 30s visibility timeout; otherwise SQS hands its later messages to
+// another worker while we are still on them
+const messageTimeout = 20 * time.Second
+
+/************ Order processor ************/
+
+// OrderProcessor ships paid orders. At most PAYMENT_PERMITS gateway calls are
+// in flight at once, however many workers are polling.
+type OrderProcessor struct {
+	orders    OrderStore
+	sagas     SagaStore
+	payments  PaymentStore
+	inventory InventoryStore
+	processor PaymentProcessor // nil: the recorded payment is the proof
+	permits   chan struct{}
+}
+
+func newOrderProcessor(store Store, processor PaymentProcessor) *OrderProcessor {
+	return &OrderProcessor{
+		orders:    store,
+		sagas:     store,
+		payments:  store,
+		inventory: store,
+		processor: processor,
+		permits:   make(chan struct{}, getenvInt("PAYMENT_PERMITS", 15)),
+	}
+}
+
+// snsEnvelope wraps messages the topic delivers to the queue (no raw delivery)
+type snsEnvelope struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// Handle processes one message body. A nil error means the message is done
+// with (processed, or deliberately skipped) and may be deleted; redelivery of
+// a processed message is harmless.
+func (p *OrderProcessor) Handle(ctx context.Context, body string) error {
+	var env snsEnvelope
+	if err := json.Unmarshal([]byte(body), &env); err == nil && env.Type == "Notification" {
+		body = env.Message
+	}
+	var event OrderPlacedEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return fmt.Errorf("decode message: %w", err)
+	}
+	if event.EventType != orderPlacedEventType {
+		return nil // other events on the topic are not ours
+	}
+	if event.OrderID == "" {
+		return fmt.Errorf("order.placed without order_id")
+	}
+
+	order, err := p.orders.GetOrder(ctx, event.OrderID)
+	if err != nil {
+		return fmt.Errorf("order %s: %w", event.OrderID, err)
+	}
+	if order.Status != OrderStatusPlaced {
+		log.Printf("processor: order %s is %s, not shipping", order.ID, order.Status)
+		return nil
+	}
+	// The event is recorded at checkout, which the payment saga reaches before it finishes
+	saga, err := p.sagas.GetSaga(ctx, order.CartID)
+	if errors.Is(err, ErrSagaNotFound) {
+		log.Printf("processor: order %s was checked out without payment, not shipping", order.ID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("order %s: %w", order.ID, err)
+	}
+	if saga.Status == SagaStatusRunning {
+		return fmt.Errorf("order %s: payment still in progress", order.ID)
+	}
+	if saga.Status != SagaStatusCompleted || saga.OrderID != order.ID {
+		log.Printf("processor: order %s has no completed payment, not shipping", order.ID)
+		return nil
+	}
+
+	// The saga records the payment before it completes
+	payment, err := p.payments.GetOrderPayment(ctx, order.ID)
+	if errors.Is(err, ErrPaymentNotFound) || (err == nil && payment.TransactionID != saga.TransactionID) {
+		log.Printf("processor: order %s: charge %s is not recorded, not shipping", order.ID, saga.TransactionID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("order %s: %w", order.ID, err)
+	}
+	if p.processor != nil {
+		// The gateway has the last word on whether the charge still stands
+		txnID, err := p.lookupCharge(ctx, saga.chargeKey())
+		if errors.Is(err, ErrPaymentNotFound) || (err == nil && txnID != saga.TransactionID) {
+			log.Printf("processor: order %s: charge %s is not live at the gateway, not shipping", order.ID, saga.TransactionID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("order %s: look up charge: %w", order.ID, err)
+		}
+	}
+
+	for _, it := range order.Items {
+		err := p.inventory.Ship(ctx, it.ProductID, it.Quantity, saga.owner())
+		if errors.Is(err, ErrInsufficientReserved) {
+			// Paid holds never expire, so the line already shipped on an earlier delivery
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("order %s: ship product %d: %w", order.ID, it.ProductID, err)
+		}
+	}
+	log.Printf("processor: order %s shipped", order.ID)
+	return nil
+}
+
+func (p *OrderProcessor) lookupCharge(ctx context.Context, key string) (string, error) {
+	select {
+	case p.permits <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-p.permits }()
+
+	ctx, cancel := context.WithTimeout(ctx, paymentTimeout())
+	defer cancel()
+	return p.processor.Lookup(ctx, key)
+}
+
+/************ Workers ************/
+
+// runWorkers polls the queue from n goroutines until ctx is cancelled; each
+// handles the messages of a batch concurrently. A message is deleted only after
+// handle succeeds; otherwise it becomes visible again when its visibility
+// timeout runs out and is retried. A message that fails on
+// its QUEUE_MAX_RECEIVES-th delivery is moved to dlq with the error instead
+// (without a dlq the queue's redrive policy moves it, without the error).
+// Messages already received when ctx is cancelled are still handled before
+// runWorkers returns.
+func runWorkers(ctx context.Context, n int, queue Consumer, dlq DeadLetterQueue, handle func(ctx context.Context, body string) error) {
+	maxReceives := queueMaxReceives()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				msgs, err := queue.Receive(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("processor: receive: %v", err)
+						sleepCtx(ctx, time.Second)
+					}
+					continue
+				}
+				// Shutdown must not cut a message off half way
+				bctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), messageTimeout)
+				var batch sync.WaitGroup
+				for _, m := range msgs {
+					batch.Add(1)
+					go func() {
+						defer batch.Done()
+						processMessage(bctx, queue, dlq, maxReceives, m, handle)
+					}()
+				}
+				batch.Wait()
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Handle one delivery, then delete it if it was handled or dead-lettered
+func processMessage(ctx context.Context, queue Consumer, dlq DeadLetterQueue, maxReceives int, m QueueMessage, handle func(ctx context.Context, body string) error) {
+	if err := handle(ctx, m.Body); err != nil {
+		log.Printf("processor: message %s (delivery %d): %v", m.ID, m.ReceiveCount, err)
+		if dlq == nil || m.ReceiveCount < maxReceives {
+			return
+		}
+		if err := dlq.Bury(ctx, m, err.Error()); err != nil {
+			log.Printf("processor: dead-letter %s: %v", m.ID, err)
+			return
+		}
+		log.Printf("processor: message %s moved to the dead-letter queue", m.ID)
+	}
+	if err := queue.Delete(ctx, m); err != nil {
+		log.Printf("processor: delete %s: %v", m.ID, err)
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// runProcessor is the processor subcommand; it returns after SIGTERM (ECS
+// stop) or SIGINT once the in-flight messages are finished
+func runProcessor(store Store) error {
+	if getenv("QUEUE_BACKEND", "log") != "aws" {
+		return errors.New("the processor subcommand needs QUEUE_BACKEND=aws (memory runs the processor inside the service)")
+	}
+	_, queue, dlq, err := newQueueFromEnv()
+	if err != nil {
+		return err
+	}
+	// The fake gateway's charges live in the memory of the service task that
+	// made them; a fake of our own would know none of them
+	var processor PaymentProcessor
+	if getenv("PAYMENT_PROCESSOR", "fake") == "fake" {
+		log.Printf("processor: PAYMENT_PROCESSOR=fake, shipping on the recorded payments alone")
+	} else if processor, err = newPaymentProcessorFromEnv(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	startProcessor(ctx, store, processor, queue, dlq).Wait()
+	log.Printf("processor: stopped")
+	return nil
+}
+
+// startProcessor runs WORKER_GOROUTINES workers handling order events from
+// queue (dead-lettering to dlq, which may be nil) until ctx is cancelled; wait
+// on the result for them to finish. processor is the gateway the charges were
+// made at, or nil if it cannot be reached from here.
+func startProcessor(ctx context.Context, store Store, processor PaymentProcessor, queue Consumer, dlq DeadLetterQueue) *sync.WaitGroup {
+	workers := getenvInt("WORKER_GOROUTINES", 1)
+	orders := newOrderProcessor(store, processor)
+	log.Printf("processor: %d workers, %d payment permits", workers, cap(orders.permits))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runWorkers(ctx, workers, queue, dlq, orders.Handle)
+	}()
+	return &wg
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A batch takes as long as its slowest message, not the sum of them: handled
+// one by one, the later messages of a batch outlive their visibility timeout
+// and another worker receives them too
+func TestRunWorkersHandleABatchWithinTheVisibilityTimeout(t *testing.T) {
+	t.Setenv("MEMORY_QUEUE_VISIBILITY", "300ms")
+	t.Setenv("MEMORY_QUEUE_WAIT", "50ms")
+	q := newMemoryQueue()
+	const n = 5
+	for i := range n {
+		q.Publish(context.Background(), strconv.Itoa(i), nil)
+	}
+
+	var mu sync.Mutex
+	handled := make(map[string]int)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	runWorkers(ctx, 2, q, nil, func(ctx context.Context, body string) error {
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		handled[body]++
+		mu.Unlock()
+		return nil
+	})
+
+	if len(handled) != n {
+		t.Fatalf("handled %d of %d messages", len(handled), n)
+	}
+	for body, times := range handled {
+		if times != 1 {
+			t.Errorf("message %s handled %d times", body, times)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrProductNotFound = errors.New("product not found")
+
+// Product catalog entry (components.schemas.Product in api.yaml)
+type Product struct {
+	ProductID    int    `json:"product_id" dynamodbav:"product_id"`
+	SKU          string `json:"sku" dynamodbav:"sku"`
+	Manufacturer string `json:"manufacturer" dynamodbav:"manufacturer"`
+	CategoryID   int    `json:"category_id" dynamodbav:"category_id"`
+	Weight       int    `json:"weight" dynamodbav:"weight"`
+	SomeOtherID  int    `json:"some_other_id" dynamodbav:"some_other_id"`
+}
+
+// ProductStore persists the product catalog.
+type ProductStore interface {
+	// GetProduct returns the product, or ErrProductNotFound.
+	GetProduct(ctx context.Context, productID int) (*Product, error)
+	// UpsertProduct creates the product or replaces its details.
+	UpsertProduct(ctx context.Context, p Product) error
+}
+
+// Validation rules from the Product schema; returns "" when p is valid
+func validateProduct(p Product) string {
+	switch {
+	case p.ProductID < 1:
+		return "product_id must be >= 1"
+	case utf8.RuneCountInString(p.SKU) < 1 || utf8.RuneCountInString(p.SKU) > 100:
+		return "sku length must be between 1 and 100"
+	case utf8.RuneCountInString(p.Manufacturer) < 1 || utf8.RuneCountInString(p.Manufacturer) > 200:
+		return "manufacturer length must be between 1 and 200"
+	case p.CategoryID < 1:
+		return "category_id must be >= 1"
+	case p.Weight < 0:
+		return "weight must be >= 0"
+	case p.SomeOtherID < 1:
+		return "some_other_id must be >= 1"
+	}
+	return ""
+}
+
+/************ Handlers ************/
+
+// /products/{productId}[/suffix] -> productId and the remaining segments
+func productPathParts(path string) (int, []string, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/products/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id < 1 {
+		return 0, parts[1:], errors.New("productId must be a positive integer")
+	}
+	return id, parts[1:], nil
+}
+
+// GET /products/{productId}
+func getProductHandler(store ProductStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, rest, err := productPathParts(r.URL.Path)
+		if len(rest) != 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			writeErr(w, 400, "INVALID_INPUT", err.Error())
+			return
+		}
+
+		p, err := store.GetProduct(r.Context(), productID)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		writeJSON(w, 200, p)
+	}
+}
+
+// POST /products/{productId}/details
+func addProductDetailsHandler(store ProductStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		productID, rest, err := productPathParts(r.URL.Path)
+		if len(rest) != 1 || rest[0] != "details" {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			writeErr(w, 400, "INVALID_INPUT", err.Error())
+			return
+		}
+
+		var p Product
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
+			return
+		}
+		if p.ProductID != productID {
+			writeErr(w, 400, "INVALID_INPUT", "product_id in body must match productId in path")
+			return
+		}
+		if msg := validateProduct(p); msg != "" {
+			writeErr(w, 400, "INVALID_INPUT", msg)
+			return
+		}
+
+		if err := store.UpsertProduct(r.Context(), p); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+func registerProductRoutes(mux *http.ServeMux, store ProductStore) {
+	mux.HandleFunc("/products/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			getProductHandler(store)(w, r)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/details"):
+			addProductDetailsHandler(store)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
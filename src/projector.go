@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+	streamtypes "github.com/aws/aws-sdk-go-v2/service/dynamodbstreams/types"
+)
+
+// The cart projector is the ECS "projector" task (./app projector). It reads
+// the DynamoDB carts table's stream and keeps a copy of every cart in the
+// MySQL carts/cart_items tables (DB_HOST etc.), so the carts can be queried
+// with SQL while the service runs on DB_BACKEND=dynamodb.
+//
+// Stream records are at least once and a cart's records can be seen out of
+// order (a retried batch, a shard split), so each record is applied as the
+// cart's full state and only if its version is newer than the one projected.
+// Whatever order the records arrive in, the last version wins and MySQL ends
+// up in the same state as DynamoDB. Progress is checkpointed per shard in
+// stream_checkpoints.
+
+// Records read per GetRecords call, and calls per shard before the projector
+// moves on to the next shard
+const (
+	projectorBatchSize     = 1000
+	projectorBatchesPerRun = 10
+)
+
+/************ Stream records ************/
+
+// cartChange is one stream record of the carts table
+type cartChange struct {
+	CartID  string
+	Removed bool
+	Cart    DynamoCart // the new image; for a removal, the old one
+}
+
+func cartChangeFromRecord(rec streamtypes.Record) (cartChange, error) {
+	if rec.Dynamodb == nil {
+		return cartChange{}, errors.New("stream record without data")
+	}
+	image := rec.Dynamodb.NewImage
+	change := cartChange{Removed: rec.EventName == streamtypes.OperationTypeRemove}
+	if change.Removed {
+		image = rec.Dynamodb.OldImage
+	}
+	if key, ok := rec.Dynamodb.Keys["cart_id"].(*streamtypes.AttributeValueMemberS); ok {
+		change.CartID = key.Value
+	}
+	if change.CartID == "" {
+		return cartChange{}, errors.New("stream record without cart_id")
+	}
+	if image == nil {
+		return cartChange{}, fmt.Errorf("stream record of cart %s has no image (the stream must be NEW_AND_OLD_IMAGES)", change.CartID)
+	}
+	av, err := attributevalue.FromDynamoDBStreamsMap(image)
+	if err != nil {
+		return cartChange{}, fmt.Errorf("convert image of cart %s: %w", change.CartID, err)
+	}
+	if err := attributevalue.UnmarshalMap(av, &change.Cart); err != nil {
+		return cartChange{}, fmt.Errorf("unmarshal cart %s: %w", change.CartID, err)
+	}
+	return change, nil
+}
+
+/************ MySQL projection ************/
+
+// cartProjection writes carts into MySQL. cart_projection maps each DynamoDB
+// cart ID to its MySQL cart_id and remembers the version last applied.
+type cartProjection struct {
+	db *sql.DB
+}
+
+// apply writes c unless a newer version of the cart is already projected;
+// it reports whether c was applied
+func (p *cartProjection) apply(ctx context.Context, c cartChange) (bool, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var cartID sql.NullInt64
+	var version int
+	var removed bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT cart_id, source_version, removed FROM cart_projection WHERE source_cart_id=? FOR UPDATE
+	`, c.CartID).Scan(&cartID, &version, &removed)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if exists {
+		// A removal carries the last version it removed, so it wins a tie
+		if removed || c.Cart.Version < version || (!c.Removed && c.Cart.Version == version) {
+			return false, nil
+		}
+	}
+
+	switch {
+	case c.Removed && !exists:
+		// Removed before we saw it: leave a tombstone so late records stay out
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO cart_projection (source_cart_id, cart_id, source_version, removed) VALUES (?, NULL, ?, TRUE)
+		`, c.CartID, c.Cart.Version)
+	case c.Removed:
+		if cartID.Valid {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM carts WHERE cart_id=?`, cartID.Int64); err != nil {
+				return false, err
+			}
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE cart_projection SET cart_id=NULL, source_version=?, removed=TRUE WHERE source_cart_id=?
+		`, c.Cart.Version, c.CartID)
+	default:
+		err = p.upsert(ctx, tx, c, cartID, exists)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Write the cart row and replace its items
+func (p *cartProjection) upsert(ctx context.Context, tx *sql.Tx, c cartChange, cartID sql.NullInt64, exists bool) error {
+	cart := dynamoCartToCart(&c.Cart)
+	now := time.Now().UTC()
+	if cart.CreatedAt.IsZero() {
+		cart.CreatedAt = now
+	}
+	if cart.UpdatedAt.IsZero() {
+		cart.UpdatedAt = cart.CreatedAt
+	}
+
+	if cartID.Valid {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE carts SET customer_id=?, status=?, created_at=?, updated_at=? WHERE cart_id=?
+		`, cart.CustomerID, cart.Status, cart.CreatedAt, cart.UpdatedAt, cartID.Int64); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM cart_items WHERE cart_id=?`, cartID.Int64); err != nil {
+			return err
+		}
+	} else {
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO carts (customer_id, status, created_at, updated_at) VALUES (?, ?, ?, ?)
+		`, cart.CustomerID, cart.Status, cart.CreatedAt, cart.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		if cartID.Int64, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		cartID.Valid = true
+	}
+
+	for _, it := range cart.Items {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO cart_items (cart_id, product_id, quantity) VALUES (?, ?, ?)
+		`, cartID.Int64, it.ProductID, it.Quantity); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if exists {
+		_, err = tx.ExecContext(ctx, `
+			UPDATE cart_projection SET cart_id=?, source_version=?, source_order_id=? WHERE source_cart_id=?
+		`, cartID.Int64, c.Cart.Version, cart.OrderID, c.CartID)
+	} else {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO cart_projection (source_cart_id, cart_id, source_version, source_order_id) VALUES (?, ?, ?, ?)
+		`, c.CartID, cartID.Int64, c.Cart.Version, cart.OrderID)
+	}
+	return err
+}
+
+// shardCheckpoint is how far a shard has been applied
+type shardCheckpoint struct {
+	SequenceNumber string // last applied record; empty if none yet
+	Finished       bool   // the shard is closed and fully applied
+}
+
+func (p *cartProjection) checkpoints(ctx context.Context, streamARN string) (map[string]shardCheckpoint, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT shard_id, sequence_number, finished FROM stream_checkpoints WHERE stream_arn=?
+	`, streamARN)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := make(map[string]shardCheckpoint)
+	for rows.Next() {
+		var shardID string
+		var cp shardCheckpoint
+		if err := rows.Scan(&shardID, &cp.SequenceNumber, &cp.Finished); err != nil {
+			return nil, err
+		}
+		out[shardID] = cp
+	}
+	return out, rows.Err()
+}
+
+func (p *cartProjection) saveCheckpoint(ctx context.Context, streamARN, shardID string, cp shardCheckpoint) error {
+	_, err := p.db.ExecContext(ctx, `
+		INSERT INTO stream_checkpoints (stream_arn, shard_id, sequence_number, finished) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE sequence_number=VALUES(sequence_number), finished=VALUES(finished)
+	`, streamARN, shardID, cp.SequenceNumber, cp.Finished)
+	return err
+}
+
+/************ Stream reader ************/
+
+// StreamProjector reads every shard of the stream into the projection
+type StreamProjector struct {
+	streams   *dynamodbstreams.Client
+	streamARN string
+	proj      *cartProjection
+	interval  time.Duration // pause once every shard is caught up
+}
+
+// Run projects until ctx is cancelled
+func (sp *StreamProjector) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := sp.runOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("projector: %v", err)
+		}
+		sleepCtx(ctx, sp.interval)
+	}
+}
+
+// One pass over the open shards. A child shard (after a split) waits until its
+// parent is finished, so a cart's records are applied in stream order; the
+// version check keeps the projection right even when they are not.
+func (sp *StreamProjector) runOnce(ctx context.Context) error {
+	shards, err := sp.listShards(ctx)
+	if err != nil {
+		return err
+	}
+	cps, err := sp.proj.checkpoints(ctx, sp.streamARN)
+	if err != nil {
+		return fmt.Errorf("load checkpoints: %w", err)
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		listed[aws.ToString(s.ShardId)] = true
+	}
+
+	for _, s := range shards {
+		id, parent := aws.ToString(s.ShardId), aws.ToString(s.ParentShardId)
+		if cps[id].Finished {
+			continue
+		}
+		// A parent that aged out of the stream is no longer listed
+		if parent != "" && listed[parent] && !cps[parent].Finished {
+			continue
+		}
+		if err := sp.drainShard(ctx, id, cps[id]); err != nil {
+			return fmt.Errorf("shard %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (sp *StreamProjector) listShards(ctx context.Context) ([]streamtypes.Shard, error) {
+	var shards []streamtypes.Shard
+	var start *string
+	for {
+		out, err := sp.streams.DescribeStream(ctx, &dynamodbstreams.DescribeStreamInput{
+			StreamArn:             aws.String(sp.streamARN),
+			ExclusiveStartShardId: start,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describe stream: %w", err)
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+		start = out.StreamDescription.LastEvaluatedShardId
+		if start == nil {
+			return shards, nil
+		}
+	}
+}
+
+// Apply the shard's records after the checkpoint until it is caught up (or
+// projectorBatchesPerRun batches are done), checkpointing after every batch
+func (sp *StreamProjector) drainShard(ctx context.Context, shardID string, cp shardCheckpoint) error {
+	iter, err := sp.shardIterator(ctx, shardID, cp.SequenceNumber)
+	var trimmed *streamtypes.TrimmedDataAccessException
+	if errors.As(err, &trimmed) {
+		// Checkpoint older than the stream's 24h retention: changes were missed
+		log.Printf("projector: shard %s: checkpoint %s was trimmed from the stream, restarting at the oldest record; run a backfill to recover missed changes", shardID, cp.SequenceNumber)
+		iter, err = sp.shardIterator(ctx, shardID, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	for batch := 0; batch < projectorBatchesPerRun && iter != nil; batch++ {
+		out, err := sp.streams.GetRecords(ctx, &dynamodbstreams.GetRecordsInput{
+			ShardIterator: iter,
+			Limit:         aws.Int32(projectorBatchSize),
+		})
+		var expired *streamtypes.ExpiredIteratorException
+		if errors.As(err, &expired) {
+			return nil // the next pass starts over from the checkpoint
+		}
+		if err != nil {
+			return fmt.Errorf("get records: %w", err)
+		}
+
+		var applied, stale int
+		for _, rec := range out.Records {
+			var seq string
+			if rec.Dynamodb != nil {
+				seq = aws.ToString(rec.Dynamodb.SequenceNumber)
+			}
+			change, err := cartChangeFromRecord(rec)
+			if err != nil {
+				// A record we cannot read would stop the shard for good; skip it loudly
+				log.Printf("projector: shard %s: skipping record %s: %v", shardID, seq, err)
+				cp.SequenceNumber = seq
+				continue
+			}
+			ok, err := sp.proj.apply(ctx, change)
+			if err != nil {
+				// Not checkpointed: the batch is read again on the next pass
+				return fmt.Errorf("apply cart %s: %w", change.CartID, err)
+			}
+			if ok {
+				applied++
+			} else {
+				stale++
+			}
+			cp.SequenceNumber = seq
+		}
+		iter = out.NextShardIterator
+		cp.Finished = iter == nil
+		if len(out.Records) > 0 || cp.Finished {
+			if err := sp.proj.saveCheckpoint(ctx, sp.streamARN, shardID, cp); err != nil {
+				return fmt.Errorf("save checkpoint: %w", err)
+			}
+		}
+		if len(out.Records) > 0 {
+			log.Printf("projector: shard %s: applied %d, skipped %d stale", shardID, applied, stale)
+		}
+		if cp.Finished {
+			log.Printf("projector: shard %s finished", shardID)
+		}
+		if len(out.Records) == 0 {
+			return nil // caught up
+		}
+	}
+	return nil
+}
+
+// Iterator just after seq, or at the oldest record if seq is empty
+func (sp *StreamProjector) shardIterator(ctx context.Context, shardID, seq string) (*string, error) {
+	in := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(sp.streamARN),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: streamtypes.ShardIteratorTypeTrimHorizon,
+	}
+	if seq != "" {
+		in.ShardIteratorType = streamtypes.ShardIteratorTypeAfterSequenceNumber
+		in.SequenceNumber = aws.String(seq)
+	}
+	out, err := sp.streams.GetShardIterator(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("get shard iterator: %w", err)
+	}
+	return out.ShardIterator, nil
+}
+
+// runProjector is the projector subcommand. The stream is DYNAMODB_STREAM_ARN,
+// or the current stream of DYNAMODB_TABLE_NAME; the projection goes to the
+// MySQL database of DB_HOST/DB_USER/DB_PASS/DB_NAME. It refuses to run with
+// DB_BACKEND=dualwrite: MySQL is the primary then, and projecting its DynamoDB
+// mirror back would overwrite it with lagging copies.
+func runProjector() error {
+	if getenv("DB_BACKEND", "mysql") == "dualwrite" {
+		return errors.New("the projector must not run while DB_BACKEND=dualwrite (MySQL is the primary)")
+	}
+	mysql, err := initMySQL()
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(),
+		config.WithRegion(getenv("AWS_REGION", "us-west-2")),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS config: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	streamARN := os.Getenv("DYNAMODB_STREAM_ARN")
+	if streamARN == "" {
+		tableName := os.Getenv("DYNAMODB_TABLE_NAME")
+		if tableName == "" {
+			return errors.New("the projector needs DYNAMODB_STREAM_ARN or DYNAMODB_TABLE_NAME")
+		}
+		out, err := dynamodb.NewFromConfig(cfg).DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return fmt.Errorf("describe table %s: %w", tableName, err)
+		}
+		if streamARN = aws.ToString(out.Table.LatestStreamArn); streamARN == "" {
+			return fmt.Errorf("table %s has no stream enabled", tableName)
+		}
+	}
+
+	interval, err := time.ParseDuration(getenv("PROJECTOR_POLL_INTERVAL", "1s"))
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+	sp := &StreamProjector{
+		streams:   dynamodbstreams.NewFromConfig(cfg),
+		streamARN: streamARN,
+		proj:      &cartProjection{db: mysql.db},
+		interval:  interval,
+	}
+	log.Printf("projector: projecting %s into MySQL every %s", streamARN, interval)
+	sp.Run(ctx)
+	log.Printf("projector: stopped")
+	return nil
+}
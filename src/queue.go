@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// Events travel from the cart service to the order processor over the order
+// events topic (SNS), which fans out to the order queue (SQS). Publisher and
+// Consumer hide that pair so it can be swapped for an in-process queue that
+// behaves the same way (at-least-once, visibility timeouts, long polling).
+
+// ErrReceiptExpired is returned by Delete when the message was redelivered
+// after the given receive; the newer delivery owns it now
+var ErrReceiptExpired = errors.New("receipt handle expired")
+
+// QueueMessage is one delivery of a message
+type QueueMessage struct {
+	ID            string
+	Body          string
+	ReceiptHandle string // identifies this delivery; needed to delete the message
+	ReceiveCount  int    // deliveries so far, this one included
+}
+
+// Publisher sends a message body to the topic; attrs travel as message attributes.
+type Publisher interface {
+	Publish(ctx context.Context, body string, attrs map[string]string) error
+}
+
+// Consumer receives from the queue with at-least-once semantics: a received
+// message is hidden for the visibility timeout and comes back unless it is
+// deleted first.
+type Consumer interface {
+	// Receive long-polls for up to 10 messages; it returns none if none
+	// arrived within the wait time.
+	Receive(ctx context.Context) ([]QueueMessage, error)
+	// Delete acknowledges a delivery.
+	Delete(ctx context.Context, m QueueMessage) error
+}
+
+// DeadLetter is a message that kept failing and was moved off the order queue
+type DeadLetter struct {
+	QueueMessage           // this delivery from the dead-letter queue
+	SourceID     string    // ID on the order queue
+	Reason       string    // the last handling error; empty if the queue's redrive moved it
+	FailedAt     time.Time // zero if the queue's redrive moved it
+	Receives     int       // deliveries on the order queue
+}
+
+// DeadLetterQueue holds the messages the processor gave up on, for an
+// operator to inspect and replay (./app dlq).
+type DeadLetterQueue interface {
+	// Bury copies a delivery of the order queue here with the reason it
+	// failed; the caller then deletes it from the order queue.
+	Bury(ctx context.Context, m QueueMessage, reason string) error
+	// Browse receives up to limit dead letters. They stay hidden from other
+	// browsers until they are replayed or released.
+	Browse(ctx context.Context, limit int) ([]DeadLetter, error)
+	// Replay sends a browsed dead letter back to the order queue and removes it here.
+	Replay(ctx context.Context, d DeadLetter) error
+	// Release makes browsed dead letters visible again.
+	Release(ctx context.Context, ds []DeadLetter) error
+}
+
+// Deliveries of a message before it is dead-lettered (QUEUE_MAX_RECEIVES);
+// the order queue's redrive policy uses the same count
+func queueMaxReceives() int {
+	if n := getenvInt("QUEUE_MAX_RECEIVES", 5); n > 0 {
+		return n
+	}
+	return 5
+}
+
+// Select the queue from QUEUE_BACKEND:
+//
+//	log    events are only logged, nothing can be consumed (default)
+//	aws    publish to SNS_TOPIC_ARN, consume from SQS_QUEUE_URL, dead-letter
+//	       to SQS_DLQ_URL (if unset, only the queue's redrive policy applies)
+//	memory one in-process queue serves as all three; see memoryQueue
+//
+// The Consumer and DeadLetterQueue are nil for "log".
+func newQueueFromEnv() (Publisher, Consumer, DeadLetterQueue, error) {
+	switch name := getenv("QUEUE_BACKEND", "log"); name {
+	case "log":
+		return nil, nil, nil, nil
+	case "aws":
+		topicARN, queueURL := os.Getenv("SNS_TOPIC_ARN"), os.Getenv("SQS_QUEUE_URL")
+		if topicARN == "" || queueURL == "" {
+			return nil, nil, nil, errors.New("QUEUE_BACKEND=aws needs SNS_TOPIC_ARN and SQS_QUEUE_URL")
+		}
+		cfg, err := config.LoadDefaultConfig(context.Background(),
+			config.WithRegion(getenv("AWS_REGION", "us-west-2")),
+		)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to load AWS config: %w", err)
+		}
+		client := sqs.NewFromConfig(cfg)
+		var dlq DeadLetterQueue
+		if dlqURL := os.Getenv("SQS_DLQ_URL"); dlqURL != "" {
+			dlq = &sqsDeadLetters{client: client, queueURL: queueURL, dlqURL: dlqURL}
+		}
+		return &snsPublisher{client: sns.NewFromConfig(cfg), topicARN: topicARN},
+			&sqsQueue{client: client, queueURL: queueURL}, dlq, nil
+	case "memory":
+		q := newMemoryQueue()
+		return q, q, q, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown QUEUE_BACKEND %q", name)
+	}
+}
+
+/************ SNS / SQS ************/
+
+// snsPublisher publishes to one topic
+type snsPublisher struct {
+	client   *sns.Client
+	topicARN string
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, body string, attrs map[string]string) error {
+	in := &sns.PublishInput{
+		TopicArn: aws.String(p.topicARN),
+		Message:  aws.String(body),
+	}
+	if len(attrs) > 0 {
+		in.MessageAttributes = make(map[string]snstypes.MessageAttributeValue, len(attrs))
+		for k, v := range attrs {
+			in.MessageAttributes[k] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+	}
+	if _, err := p.client.Publish(ctx, in); err != nil {
+		return fmt.Errorf("failed to publish to SNS: %w", err)
+	}
+	return nil
+}
+
+// sqsQueue receives from and deletes on one queue
+type sqsQueue struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+// Receive long-polls for up to 10 messages (20s, the queue's own wait time)
+func (q *sqsQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:                    aws.String(q.queueURL),
+		MaxNumberOfMessages:         10,
+		WaitTimeSeconds:             20,
+		MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameApproximateReceiveCount},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]QueueMessage, 0, len(out.Messages))
+	for _, m := range out.Messages {
+		count, _ := strconv.Atoi(m.Attributes[string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount)])
+		msgs = append(msgs, QueueMessage{
+			ID:            aws.ToString(m.MessageId),
+			Body:          aws.ToString(m.Body),
+			ReceiptHandle: aws.ToString(m.ReceiptHandle),
+			ReceiveCount:  count,
+		})
+	}
+	return msgs, nil
+}
+
+func (q *sqsQueue) Delete(ctx context.Context, m QueueMessage) error {
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.queueURL),
+		ReceiptHandle: aws.String(m.ReceiptHandle),
+	})
+	return err
+}
+
+// Message attributes a buried message carries on the dead-letter queue
+const (
+	dlqAttrReason   = "failure_reason"
+	dlqAttrFailedAt = "failed_at"
+	dlqAttrSourceID = "source_message_id"
+	dlqAttrReceives = "receive_count"
+)
+
+// How long browsed dead letters stay hidden if the browser never releases them
+const dlqBrowseVisibility = 60
+
+// sqsDeadLetters is the order queue's dead-letter queue
+type sqsDeadLetters struct {
+	client   *sqs.Client
+	queueURL string // the order queue, where replays go
+	dlqURL   string
+}
+
+func (q *sqsDeadLetters) Bury(ctx context.Context, m QueueMessage, reason string) error {
+	attrs := map[string]string{
+		dlqAttrReason:   truncate(reason, 1024),
+		dlqAttrFailedAt: time.Now().UTC().Format(time.RFC3339),
+		dlqAttrSourceID: m.ID,
+		dlqAttrReceives: strconv.Itoa(m.ReceiveCount),
+	}
+	in := &sqs.SendMessageInput{
+		QueueUrl:          aws.String(q.dlqURL),
+		MessageBody:       aws.String(m.Body),
+		MessageAttributes: make(map[string]sqstypes.MessageAttributeValue, len(attrs)),
+	}
+	for k, v := range attrs {
+		if v != "" {
+			in.MessageAttributes[k] = sqstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+	}
+	if _, err := q.client.SendMessage(ctx, in); err != nil {
+		return fmt.Errorf("failed to send to the dead-letter queue: %w", err)
+	}
+	return nil
+}
+
+// Browse short-polls until limit letters are in hand or a poll comes back empty
+func (q *sqsDeadLetters) Browse(ctx context.Context, limit int) ([]DeadLetter, error) {
+	var out []DeadLetter
+	for len(out) < limit {
+		res, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(q.dlqURL),
+			MaxNumberOfMessages:         int32(min(10, limit-len(out))),
+			VisibilityTimeout:           dlqBrowseVisibility,
+			MessageAttributeNames:       []string{"All"},
+			MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			return out, fmt.Errorf("failed to receive from the dead-letter queue: %w", err)
+		}
+		if len(res.Messages) == 0 {
+			break
+		}
+		for _, m := range res.Messages {
+			attr := func(name string) string { return aws.ToString(m.MessageAttributes[name].StringValue) }
+			d := DeadLetter{
+				QueueMessage: QueueMessage{
+					ID:            aws.ToString(m.MessageId),
+					Body:          aws.ToString(m.Body),
+					ReceiptHandle: aws.ToString(m.ReceiptHandle),
+				},
+				SourceID: attr(dlqAttrSourceID),
+				Reason:   attr(dlqAttrReason),
+			}
+			d.ReceiveCount, _ = strconv.Atoi(m.Attributes[string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount)])
+			d.FailedAt, _ = time.Parse(time.RFC3339, attr(dlqAttrFailedAt))
+			d.Receives, _ = strconv.Atoi(attr(dlqAttrReceives))
+			if d.SourceID == "" {
+				// Moved by the redrive policy: the message ID is kept
+				d.SourceID = d.ID
+			}
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// The body goes back as is (still in its SNS envelope), so the processor sees
+// the same message it gave up on
+func (q *sqsDeadLetters) Replay(ctx context.Context, d DeadLetter) error {
+	if _, err := q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(q.queueURL),
+		MessageBody: aws.String(d.Body),
+	}); err != nil {
+		return fmt.Errorf("failed to send to the order queue: %w", err)
+	}
+	if _, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.dlqURL),
+		ReceiptHandle: aws.String(d.ReceiptHandle),
+	}); err != nil {
+		return fmt.Errorf("replayed, but failed to delete from the dead-letter queue: %w", err)
+	}
+	return nil
+}
+
+func (q *sqsDeadLetters) Release(ctx context.Context, ds []DeadLetter) error {
+	for _, d := range ds {
+		if _, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(q.dlqURL),
+			ReceiptHandle:     aws.String(d.ReceiptHandle),
+			VisibilityTimeout: 0,
+		}); err != nil {
+			return fmt.Errorf("failed to release %s: %w", d.ID, err)
+		}
+	}
+	return nil
+}
+
+/************ In-process queue ************/
+
+// memoryQueue is a topic and its queue in one, for local runs and offline
+// integration tests of the cart service and the processor together. Like SQS
+// it hides a received message for the visibility timeout
+// (MEMORY_QUEUE_VISIBILITY, default 30s) and hands it out again unless it was
+// deleted; Receive waits up to MEMORY_QUEUE_WAIT (default 20s) for messages.
+// It is also its own dead-letter queue: a message received QUEUE_MAX_RECEIVES
+// times that comes back once more is moved there, like SQS's redrive policy.
+// Nothing survives a restart.
+type memoryQueue struct {
+	mu          sync.Mutex
+	visibility  time.Duration
+	wait        time.Duration
+	maxReceives int
+	issued      int
+	msgs        []*memoryMessage // oldest first
+	dead        []*memoryDeadLetter
+	wake        chan struct{} // closed (and replaced) when a message is published
+}
+
+type memoryMessage struct {
+	id        string
+	body      string
+	receipt   string // of the latest delivery
+	receives  int
+	visibleAt time.Time
+}
+
+type memoryDeadLetter struct {
+	DeadLetter
+	visibleAt time.Time
+}
+
+func newMemoryQueue() *memoryQueue {
+	visibility, err := time.ParseDuration(getenv("MEMORY_QUEUE_VISIBILITY", "30s"))
+	if err != nil || visibility <= 0 {
+		visibility = 30 * time.Second
+	}
+	wait, err := time.ParseDuration(getenv("MEMORY_QUEUE_WAIT", "20s"))
+	if err != nil || wait < 0 {
+		wait = 20 * time.Second
+	}
+	return &memoryQueue{visibility: visibility, wait: wait, maxReceives: queueMaxReceives(), wake: make(chan struct{})}
+}
+
+// Publish enqueues body as is: unlike SNS delivery there is no envelope, and
+// attributes are dropped
+func (q *memoryQueue) Publish(ctx context.Context, body string, attrs map[string]string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.issued++
+	q.msgs = append(q.msgs, &memoryMessage{id: fmt.Sprintf("mem-%08d", q.issued), body: body, visibleAt: time.Now()})
+	close(q.wake)
+	q.wake = make(chan struct{})
+	return nil
+}
+
+func (q *memoryQueue) Receive(ctx context.Context) ([]QueueMessage, error) {
+	deadline := time.Now().Add(q.wait)
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		var out []QueueMessage
+		next := deadline // when to look again if nothing is visible
+		q.redrive(now)
+		for _, m := range q.msgs {
+			if !m.visibleAt.After(now) {
+				if len(out) == 10 {
+					break
+				}
+				q.issued++
+				m.receives++
+				m.receipt = fmt.Sprintf("%s#%d", m.id, q.issued)
+				m.visibleAt = now.Add(q.visibility)
+				out = append(out, QueueMessage{ID: m.id, Body: m.body, ReceiptHandle: m.receipt, ReceiveCount: m.receives})
+			} else if m.visibleAt.Before(next) {
+				next = m.visibleAt
+			}
+		}
+		wake := q.wake
+		q.mu.Unlock()
+
+		if len(out) > 0 || !now.Before(deadline) {
+			return out, nil
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (q *memoryQueue) Delete(ctx context.Context, m QueueMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, mm := range q.msgs {
+		if mm.id != m.ID {
+			continue
+		}
+		if mm.receipt != m.ReceiptHandle {
+			return ErrReceiptExpired
+		}
+		q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+		return nil
+	}
+	return nil // already deleted
+}
+
+// Move visible messages that used up their receives to the dead letters
+func (q *memoryQueue) redrive(now time.Time) {
+	q.msgs = slices.DeleteFunc(q.msgs, func(m *memoryMessage) bool {
+		if m.receives < q.maxReceives || m.visibleAt.After(now) {
+			return false
+		}
+		q.dead = append(q.dead, &memoryDeadLetter{DeadLetter: DeadLetter{
+			QueueMessage: QueueMessage{ID: m.id, Body: m.body},
+			SourceID:     m.id,
+			Receives:     m.receives,
+		}, visibleAt: now})
+		return true
+	})
+}
+
+func (q *memoryQueue) Bury(ctx context.Context, m QueueMessage, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.issued++
+	q.dead = append(q.dead, &memoryDeadLetter{DeadLetter: DeadLetter{
+		QueueMessage: QueueMessage{ID: fmt.Sprintf("mem-%08d", q.issued), Body: m.Body},
+		SourceID:     m.ID,
+		Reason:       reason,
+		FailedAt:     time.Now().UTC(),
+		Receives:     m.ReceiveCount,
+	}, visibleAt: time.Now()})
+	return nil
+}
+
+func (q *memoryQueue) Browse(ctx context.Context, limit int) ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.redrive(now)
+	var out []DeadLetter
+	for _, d := range q.dead {
+		if len(out) == limit {
+			break
+		}
+		if d.visibleAt.After(now) {
+			continue
+		}
+		q.issued++
+		d.ReceiveCount++
+		d.ReceiptHandle = fmt.Sprintf("%s#%d", d.ID, q.issued)
+		d.visibleAt = now.Add(dlqBrowseVisibility * time.Second)
+		out = append(out, d.DeadLetter)
+	}
+	return out, nil
+}
+
+func (q *memoryQueue) Replay(ctx context.Context, d DeadLetter) error {
+	q.mu.Lock()
+	i := slices.IndexFunc(q.dead, func(dd *memoryDeadLetter) bool { return dd.ID == d.ID })
+	if i >= 0 && q.dead[i].ReceiptHandle != d.ReceiptHandle {
+		q.mu.Unlock()
+		return ErrReceiptExpired
+	}
+	if i >= 0 {
+		q.dead = slices.Delete(q.dead, i, i+1)
+	}
+	q.mu.Unlock()
+	if i < 0 {
+		return nil // already replayed
+	}
+	return q.Publish(ctx, d.Body, nil)
+}
+
+func (q *memoryQueue) Release(ctx context.Context, ds []DeadLetter) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range ds {
+		for _, dd := range q.dead {
+			if dd.ID == d.ID && dd.ReceiptHandle == d.ReceiptHandle {
+				dd.visibleAt = now
+			}
+		}
+	}
+	return nil
+}
+
+/************ Events over a queue ************/
+
+// queuePublisher is the EventPublisher for the aws and memory queues: the
+// event as JSON, with its type as the event_type attribute
+type queuePublisher struct {
+	pub Publisher
+}
+
+func (p queuePublisher) Publish(ctx context.Context, eventType string, event any) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return p.pub.Publish(ctx, string(b), map[string]string{"event_type": eventType})
+}
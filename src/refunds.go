@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors returned by RefundStore implementations
+var (
+	ErrRefundExceedsCapture = errors.New("refund exceeds the captured amount")
+	ErrIdempotencyConflict  = errors.New("idempotency key already used for a different refund")
+	ErrRefundNotFound       = errors.New("refund not found")
+)
+
+// Refund statuses. A PENDING refund already counts against the captured
+// amount, so concurrent refunds can never exceed it.
+const (
+	RefundStatusPending   = "PENDING"
+	RefundStatusSucceeded = "SUCCEEDED"
+	RefundStatusFailed    = "FAILED"
+)
+
+// Order statuses set by refunds
+const (
+	OrderStatusPartiallyRefunded = "PARTIALLY_REFUNDED"
+	OrderStatusRefunded          = "REFUNDED"
+)
+
+// Refund is one entry of an order's refund ledger.
+type Refund struct {
+	RefundID       string    `json:"refund_id" dynamodbav:"refund_id"`
+	OrderID        string    `json:"order_id" dynamodbav:"order_id"`
+	IdempotencyKey string    `json:"idempotency_key" dynamodbav:"idempotency_key"`
+	AmountCents    int64     `json:"amount_cents" dynamodbav:"amount_cents"`
+	Reason         string    `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Status         string    `json:"status" dynamodbav:"status"`
+	ProcessorRef   string    `json:"processor_ref,omitempty" dynamodbav:"processor_ref,omitempty"` // gateway refund ID
+	CreatedAt      time.Time `json:"created_at" dynamodbav:"created_at"`
+}
+
+// RefundStore keeps the refund ledger of paid orders.
+type RefundStore interface {
+	// BeginRefund records r as PENDING and returns it with its ID and amount.
+	// AmountCents 0 means "whatever is left to refund". If the order already
+	// has a refund with r.IdempotencyKey, that refund is returned unchanged.
+	// Fails with ErrPaymentNotFound, ErrRefundExceedsCapture or ErrIdempotencyConflict.
+	BeginRefund(ctx context.Context, r Refund) (*Refund, error)
+	// FinishRefund moves a PENDING refund to SUCCEEDED or FAILED and, on
+	// success, moves the order to PARTIALLY_REFUNDED or REFUNDED. Finishing an
+	// already finished refund changes nothing. Returns the refund and the order status.
+	FinishRefund(ctx context.Context, orderID, refundID, status, processorRef string) (*Refund, string, error)
+	// ListRefunds returns the ledger of an order, oldest first.
+	ListRefunds(ctx context.Context, orderID string) ([]Refund, error)
+}
+
+/************ Ledger rules shared by the backends ************/
+
+// planRefund applies an idempotent refund request to an order's ledger.
+// It returns the existing refund for the key, or the amount of the new one.
+func planRefund(ledger []Refund, captured int64, r Refund) (*Refund, int64, error) {
+	committed := int64(0)
+	for i := range ledger {
+		if ledger[i].IdempotencyKey == r.IdempotencyKey {
+			if r.AmountCents != 0 && r.AmountCents != ledger[i].AmountCents {
+				return nil, 0, ErrIdempotencyConflict
+			}
+			existing := ledger[i]
+			return &existing, 0, nil
+		}
+		if ledger[i].Status != RefundStatusFailed {
+			committed += ledger[i].AmountCents
+		}
+	}
+	amount := r.AmountCents
+	if amount == 0 {
+		amount = captured - committed
+	}
+	if amount <= 0 || committed+amount > captured {
+		return nil, 0, ErrRefundExceedsCapture
+	}
+	return nil, amount, nil
+}
+
+// Order status once refundedCents of captured have been paid back
+func refundedOrderStatus(captured, refundedCents int64) string {
+	if refundedCents >= captured {
+		return OrderStatusRefunded
+	}
+	return OrderStatusPartiallyRefunded
+}
+
+// Sum of SUCCEEDED refunds
+func refundedCents(ledger []Refund) int64 {
+	var total int64
+	for _, r := range ledger {
+		if r.Status == RefundStatusSucceeded {
+			total += r.AmountCents
+		}
+	}
+	return total
+}
+
+/************ Handlers ************/
+
+type refundReq struct {
+	AmountCents    int64  `json:"amount_cents"` // omitted or 0 = refund everything left
+	Reason         string `json:"reason"`
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type refundResp struct {
+	Refund      Refund `json:"refund"`
+	OrderStatus string `json:"order_status"`
+}
+
+type listRefundsResp struct {
+	Refunds []Refund `json:"refunds"`
+}
+
+// RefundEvent is published once per successful refund
+type RefundEvent struct {
+	EventType     string    `json:"event_type"`
+	Version       int       `json:"version"`
+	RefundID      string    `json:"refund_id"`
+	OrderID       string    `json:"order_id"`
+	TransactionID string    `json:"transaction_id"`
+	AmountCents   int64     `json:"amount_cents"`
+	OrderStatus   string    `json:"order_status"`
+	OccurredAt    time.Time `json:"occurred_at"`
+}
+
+const refundEventType = "payment.refunded"
+
+// /orders/{orderId}/refunds
+//
+//	POST: refund (part of) the captured payment. The idempotency key makes
+//	      retries safe: a repeated request returns the original refund, and a
+//	      refund left PENDING by a crash is resumed with the same gateway key.
+//	GET:  the order's refund ledger.
+func refundsHandler(orders OrderStore, payments PaymentStore, refunds RefundStore, processor PaymentProcessor, events EventPublisher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "refunds" {
+			http.NotFound(w, r)
+			return
+		}
+		orderID := parts[0]
+
+		switch r.Method {
+		case http.MethodGet:
+			ledger, err := refunds.ListRefunds(r.Context(), orderID)
+			if err != nil {
+				writeStoreErr(w, err)
+				return
+			}
+			if ledger == nil {
+				ledger = []Refund{}
+			}
+			writeJSON(w, 200, listRefundsResp{Refunds: ledger})
+			return
+		case http.MethodPost:
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		var req refundReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
+			return
+		}
+		if req.IdempotencyKey == "" || len(req.IdempotencyKey) > 64 || req.AmountCents < 0 || len(req.Reason) > 255 {
+			writeErr(w, 400, "INVALID_INPUT", "idempotency_key (1-64 chars) is required, amount_cents must be >= 0 and reason at most 255 chars")
+			return
+		}
+
+		payment, err := payments.GetOrderPayment(r.Context(), orderID)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		refund, err := refunds.BeginRefund(r.Context(), Refund{
+			OrderID:        orderID,
+			IdempotencyKey: req.IdempotencyKey,
+			AmountCents:    req.AmountCents,
+			Reason:         req.Reason,
+			Status:         RefundStatusPending,
+			CreatedAt:      time.Now().UTC(),
+		})
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		if refund.Status != RefundStatusPending {
+			// Replay of a finished refund
+			order, err := orders.GetOrder(r.Context(), orderID)
+			if err != nil {
+				writeStoreErr(w, err)
+				return
+			}
+			writeJSON(w, 200, refundResp{Refund: *refund, OrderStatus: order.Status})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), paymentTimeout())
+		ref, err := processor.Refund(ctx, payment.TransactionID, refund.AmountCents, "refund:"+orderID+":"+refund.IdempotencyKey)
+		cancel()
+		status := RefundStatusSucceeded
+		if errors.Is(err, ErrPaymentDeclined) {
+			status = RefundStatusFailed
+		} else if err != nil {
+			// Outcome unknown: leave it PENDING, a retry with the same key resumes it
+			writeStoreErr(w, err)
+			return
+		}
+
+		done, orderStatus, ferr := refunds.FinishRefund(context.WithoutCancel(r.Context()), orderID, refund.RefundID, status, ref)
+		if ferr != nil {
+			writeStoreErr(w, ferr)
+			return
+		}
+		if status == RefundStatusFailed {
+			writeStoreErr(w, err)
+			return
+		}
+
+		event := RefundEvent{
+			EventType:     refundEventType,
+			Version:       1,
+			RefundID:      done.RefundID,
+			OrderID:       orderID,
+			TransactionID: payment.TransactionID,
+			AmountCents:   done.AmountCents,
+			OrderStatus:   orderStatus,
+			OccurredAt:    time.Now().UTC(),
+		}
+		if err := events.Publish(r.Context(), refundEventType, event); err != nil {
+			log.Printf("refunds: publish %s for order %s: %v", done.RefundID, orderID, err)
+		}
+		writeJSON(w, 200, refundResp{Refund: *done, OrderStatus: orderStatus})
+	}
+}
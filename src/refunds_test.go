@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlanRefund(t *testing.T) {
+	ledger := []Refund{
+		{IdempotencyKey: "a", AmountCents: 300, Status: RefundStatusSucceeded},
+		{IdempotencyKey: "b", AmountCents: 200, Status: RefundStatusFailed},
+		{IdempotencyKey: "c", AmountCents: 100, Status: RefundStatusPending},
+	}
+	tests := []struct {
+		name       string
+		key        string
+		amount     int64
+		wantKey    string // existing refund returned
+		wantAmount int64
+		wantErr    error
+	}{
+		{"replay", "a", 300, "a", 0, nil},
+		{"replay without amount", "a", 0, "a", 0, nil},
+		{"replay of a failed refund", "b", 200, "b", 0, nil},
+		{"replay with another amount", "a", 250, "", 0, ErrIdempotencyConflict},
+		{"new refund", "d", 400, "", 400, nil},
+		{"rest of the capture", "d", 0, "", 600, nil}, // failed refunds don't count
+		{"beyond the capture", "d", 601, "", 0, ErrRefundExceedsCapture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing, amount, err := planRefund(ledger, 1000, Refund{IdempotencyKey: tt.key, AmountCents: tt.amount})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			gotKey := ""
+			if existing != nil {
+				gotKey = existing.IdempotencyKey
+			}
+			if gotKey != tt.wantKey || amount != tt.wantAmount {
+				t.Errorf("planRefund = (%q, %d), want (%q, %d)", gotKey, amount, tt.wantKey, tt.wantAmount)
+			}
+		})
+	}
+	if _, _, err := planRefund(nil, 1000, Refund{IdempotencyKey: "x"}); err != nil {
+		t.Errorf("full refund of an untouched order: %v", err)
+	}
+	if _, _, err := planRefund([]Refund{{IdempotencyKey: "a", AmountCents: 1000, Status: RefundStatusSucceeded}}, 1000, Refund{IdempotencyKey: "x"}); !errors.Is(err, ErrRefundExceedsCapture) {
+		t.Errorf("refund of a fully refunded order: %v, want %v", err, ErrRefundExceedsCapture)
+	}
+}
+
+// lostReplyProcessor refunds at the gateway but, when loseNext is set,
+// reports a timeout once, as when the gateway's reply never arrives
+type lostReplyProcessor struct {
+	*fakeProcessor
+	loseNext bool
+}
+
+func (p *lostReplyProcessor) Refund(ctx context.Context, transactionID string, amountCents int64, idempotencyKey string) (string, error) {
+	id, err := p.fakeProcessor.Refund(ctx, transactionID, amountCents, idempotencyKey)
+	if err == nil && p.loseNext {
+		p.loseNext = false
+		return "", ErrPaymentTimeout
+	}
+	return id, err
+}
+
+type refundFixture struct {
+	t       *testing.T
+	fake    *fakeProcessor
+	gateway *lostReplyProcessor
+	handler http.Handler
+	orderID string
+	txnID   string
+	amount  int64
+}
+
+// newRefundFixture pays for a cart through the checkout saga
+func newRefundFixture(t *testing.T) *refundFixture {
+	ctx := context.Background()
+	store, fake := newMemoryStore(), newFakeProcessor()
+	if err := store.Restock(ctx, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	id, _ := store.CreateCart(ctx, 7)
+	if _, err := store.UpsertItem(ctx, id, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	cart, _ := store.GetCart(ctx, id)
+	s, err := newCheckoutOrchestrator(store, fake).Run(ctx, cart, sagaTestToken, sagaTestCard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := &lostReplyProcessor{fakeProcessor: fake}
+	return &refundFixture{
+		t:       t,
+		fake:    fake,
+		gateway: gateway,
+		handler: refundsHandler(store, store, store, gateway, discardPublisher{}),
+		orderID: s.OrderID,
+		txnID:   s.TransactionID,
+		amount:  s.AmountCents,
+	}
+}
+
+// refund POSTs a refund request and decodes a 200 reply into resp
+func (f *refundFixture) refund(body string) (int, refundResp) {
+	f.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/orders/"+f.orderID+"/refunds", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	f.handler.ServeHTTP(rec, req)
+	var resp refundResp
+	if rec.Code == 200 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	return rec.Code, resp
+}
+
+func (f *refundFixture) gatewayRefunded() int64 {
+	f.fake.mu.Lock()
+	defer f.fake.mu.Unlock()
+	return f.fake.refunded[f.txnID]
+}
+
+func TestRefundIdempotency(t *testing.T) {
+	f := newRefundFixture(t)
+
+	code, first := f.refund(`{"amount_cents": 1000, "idempotency_key": "k1"}`)
+	if code != 200 || first.Refund.Status != RefundStatusSucceeded || first.OrderStatus != OrderStatusPartiallyRefunded {
+		t.Fatalf("first refund = %d %+v", code, first)
+	}
+	code, replay := f.refund(`{"amount_cents": 1000, "idempotency_key": "k1"}`)
+	if code != 200 || replay.Refund.RefundID != first.Refund.RefundID {
+		t.Fatalf("replay = %d %+v, want refund %s", code, replay, first.Refund.RefundID)
+	}
+	if got := f.gatewayRefunded(); got != 1000 {
+		t.Errorf("gateway refunded %d cents, want 1000", got)
+	}
+
+	if code, _ := f.refund(`{"amount_cents": 500, "idempotency_key": "k1"}`); code != 409 {
+		t.Errorf("same key, other amount: %d, want 409", code)
+	}
+
+	// Without an amount the rest is refunded
+	code, rest := f.refund(`{"idempotency_key": "k2"}`)
+	if code != 200 || rest.Refund.AmountCents != f.amount-1000 || rest.OrderStatus != OrderStatusRefunded {
+		t.Fatalf("refund of the rest = %d %+v", code, rest)
+	}
+	if code, _ := f.refund(`{"amount_cents": 1, "idempotency_key": "k3"}`); code != 400 {
+		t.Errorf("refund beyond the capture: %d, want 400", code)
+	}
+	if got := f.gatewayRefunded(); got != f.amount {
+		t.Errorf("gateway refunded %d cents, want %d", got, f.amount)
+	}
+}
+
+func TestRefundResumesAfterLostReply(t *testing.T) {
+	f := newRefundFixture(t)
+	f.gateway.loseNext = true
+
+	if code, _ := f.refund(`{"amount_cents": 1000, "idempotency_key": "k1"}`); code != 504 {
+		t.Fatalf("refund with a lost reply: %d, want 504", code)
+	}
+	// The retry resumes the PENDING refund under the same gateway key
+	code, resp := f.refund(`{"amount_cents": 1000, "idempotency_key": "k1"}`)
+	if code != 200 || resp.Refund.Status != RefundStatusSucceeded || resp.Refund.ProcessorRef == "" {
+		t.Fatalf("retry = %d %+v", code, resp)
+	}
+	if got := f.gatewayRefunded(); got != 1000 {
+		t.Errorf("gateway refunded %d cents, want 1000", got)
+	}
+}
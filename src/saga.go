@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Errors returned by SagaStore implementations and the checkout orchestrator
+var (
+	ErrSagaNotFound       = errors.New("checkout saga not found")
+	ErrCheckoutInProgress = errors.New("checkout already in progress")
+)
+
+// Saga statuses
+const (
+	SagaStatusRunning   = "RUNNING"
+	SagaStatusCompleted = "COMPLETED"
+	SagaStatusAborted   = "ABORTED"
+)
+
+// Saga steps, in order. The step is persisted before it starts, so after a
+// crash we know exactly which side effects may already have happened.
+const (
+	SagaStepReserving    = "RESERVING"    // holding stock for every line
+	SagaStepCharging     = "CHARGING"     // charging the card
+	SagaStepCompleting   = "COMPLETING"   // checking out the cart, recording the payment
+	SagaStepCompensating = "COMPENSATING" // voiding the charge, releasing the stock
+	SagaStepDone         = "DONE"
+)
+
+// CheckoutSaga is the persisted state of one paid checkout of a cart. There is
+// at most one saga per cart; an aborted one is replaced by the next attempt.
+type CheckoutSaga struct {
+	CartID        string     `json:"cart_id" dynamodbav:"cart_id"`
+	CustomerID    int        `json:"customer_id" dynamodbav:"customer_id"`
+	Attempt       int        `json:"attempt" dynamodbav:"attempt"`
+	Status        string     `json:"status" dynamodbav:"status"`
+	Step          string     `json:"step" dynamodbav:"step"`
+	Items         []CartItem `json:"items" dynamodbav:"items"`
+	AmountCents   int64      `json:"amount_cents" dynamodbav:"amount_cents"`
+	CardToken     string     `json:"card_token" dynamodbav:"card_token"`
+	CardLast4     string     `json:"card_last4" dynamodbav:"card_last4"`
+	CardBrand     string     `json:"card_brand" dynamodbav:"card_brand"`
+	TransactionID string     `json:"transaction_id,omitempty" dynamodbav:"transaction_id,omitempty"`
+	OrderID       string     `json:"order_id,omitempty" dynamodbav:"order_id,omitempty"`
+	Failure       string     `json:"failure,omitempty" dynamodbav:"failure,omitempty"`
+	Version       int        `json:"version" dynamodbav:"version"`
+	CreatedAt     time.Time  `json:"created_at" dynamodbav:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" dynamodbav:"updated_at"`
+}
+
+// Reservations made by a saga are held in the cart's name
+func (s *CheckoutSaga) owner() string { return "cart:" + s.CartID }
+
+// Charges are keyed per attempt: a declined attempt must not block the next one
+func (s *CheckoutSaga) chargeKey() string { return "cart:" + s.CartID + ":" + strconv.Itoa(s.Attempt) }
+
+// SagaStore persists checkout sagas.
+type SagaStore interface {
+	// GetSaga returns the saga of a cart, or ErrSagaNotFound.
+	GetSaga(ctx context.Context, cartID string) (*CheckoutSaga, error)
+	// SaveSaga writes s if the stored version still equals s.Version (0: no
+	// saga stored yet) and increments s.Version; otherwise ErrConflict. Every
+	// save therefore also claims the saga from whoever saved it before.
+	SaveSaga(ctx context.Context, s *CheckoutSaga) error
+	// ListStaleSagas returns up to limit RUNNING sagas last saved before before.
+	ListStaleSagas(ctx context.Context, before time.Time, limit int) ([]CheckoutSaga, error)
+}
+
+// CheckoutOrchestrator runs the paid checkout saga:
+//
+//	RESERVING  reserve every line        compensation: release the holds
+//	CHARGING   charge the card           compensation: void the charge
+//	COMPLETING confirm the holds, check out the cart, record the payment
+//
+// Once the charge succeeded the saga only moves forward.
+type CheckoutOrchestrator struct {
+	carts     CartStore
+	inventory InventoryStore
+	payments  PaymentStore
+	sagas     SagaStore
+	processor PaymentProcessor
+}
+
+func newCheckoutOrchestrator(store Store, processor PaymentProcessor) *CheckoutOrchestrator {
+	return &CheckoutOrchestrator{carts: store, inventory: store, payments: store, sagas: store, processor: processor}
+}
+
+// Run checks out cart, paying with pan. It returns the finished saga, or the
+// error that aborted it (the stock is released and any charge voided by then).
+func (o *CheckoutOrchestrator) Run(ctx context.Context, cart *Cart, card CardToken, pan string) (*CheckoutSaga, error) {
+	saga, err := o.sagas.GetSaga(ctx, cart.ID)
+	switch {
+	case errors.Is(err, ErrSagaNotFound):
+		saga = &CheckoutSaga{}
+	case err != nil:
+		return nil, err
+	case saga.Status == SagaStatusRunning:
+		return nil, ErrCheckoutInProgress
+	case saga.Status == SagaStatusCompleted:
+		return saga, nil
+	}
+
+	// Start a new attempt, replacing an aborted one (same version => same record)
+	now := time.Now().UTC()
+	*saga = CheckoutSaga{
+		CartID:      cart.ID,
+		CustomerID:  cart.CustomerID,
+		Attempt:     saga.Attempt + 1,
+		Status:      SagaStatusRunning,
+		Step:        SagaStepReserving,
+		Items:       slices.Clone(cart.Items),
+		AmountCents: cartAmountCents(cart),
+		CardToken:   card.Token,
+		CardLast4:   card.Last4,
+		CardBrand:   card.Brand,
+		Version:     saga.Version,
+		CreatedAt:   now,
+	}
+	if err := o.save(ctx, saga); err != nil {
+		if errors.Is(err, ErrConflict) {
+			return nil, ErrCheckoutInProgress
+		}
+		return nil, err
+	}
+
+	// 1) Reserve
+	ttl := reservationTTL()
+	for _, it := range saga.Items {
+		if _, err := o.inventory.Reserve(ctx, it.ProductID, it.Quantity, saga.owner(), ttl); err != nil {
+			return nil, o.abort(ctx, saga, err)
+		}
+	}
+
+	// 2) Charge
+	saga.Step = SagaStepCharging
+	if err := o.save(ctx, saga); err != nil {
+		return nil, err
+	}
+	chargeCtx, cancel := context.WithTimeout(ctx, paymentTimeout())
+	txnID, err := o.processor.Charge(chargeCtx, ChargeRequest{IdempotencyKey: saga.chargeKey(), AmountCents: saga.AmountCents, CardNumber: pan})
+	cancel()
+	if err != nil {
+		return nil, o.abort(ctx, saga, err)
+	}
+	saga.TransactionID = txnID
+
+	// 3) Complete
+	saga.Step = SagaStepCompleting
+	if err := o.save(ctx, saga); err != nil {
+		return nil, err
+	}
+	if err := o.complete(ctx, saga); err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+// complete is idempotent, so recovery can simply run it again
+func (o *CheckoutOrchestrator) complete(ctx context.Context, saga *CheckoutSaga) error {
+	cart, err := o.carts.GetCart(ctx, saga.CartID)
+	if err != nil {
+		return err
+	}
+	held := false
+	switch {
+	case cart.Status == CartStatusOpen:
+		// Hold the stock for good before the order exists, so a shortfall can
+		// still be compensated
+		if err := o.holdItems(ctx, saga); errors.Is(err, ErrInsufficientInventory) {
+			return o.abort(ctx, saga, err)
+		} else if err != nil {
+			return err
+		}
+		held = true
+		// Only the items we reserved and charged may become the order
+		saga.OrderID, err = o.carts.Checkout(ctx, saga.CartID, saga.Items)
+		if errors.Is(err, ErrCartChanged) {
+			return o.abort(ctx, saga, fmt.Errorf("%w during checkout", err))
+		}
+		if err != nil {
+			return err
+		}
+	case saga.OrderID == "" && cart.OrderID != "":
+		// Checked out before a crash recorded the order
+		saga.OrderID = cart.OrderID
+	}
+	if saga.OrderID == "" {
+		return o.abort(ctx, saga, ErrCartCheckedOut)
+	}
+
+	p := Payment{
+		TransactionID: saga.TransactionID,
+		OrderID:       saga.OrderID,
+		CartID:        saga.CartID,
+		CustomerID:    saga.CustomerID,
+		AmountCents:   saga.AmountCents,
+		Status:        PaymentStatusCaptured,
+		CardToken:     saga.CardToken,
+		CardLast4:     saga.CardLast4,
+		CardBrand:     saga.CardBrand,
+		CreatedAt:     time.Now().UTC(),
+	}
+	if err := o.payments.SavePayment(ctx, p); err != nil && !errors.Is(err, ErrConflict) {
+		return err
+	}
+	if !held {
+		// Checked out before a crash; the holds were confirmed first, so this
+		// only repeats that
+		if err := o.holdItems(ctx, saga); err != nil {
+			return err
+		}
+	}
+
+	saga.Status = SagaStatusCompleted
+	saga.Step = SagaStepDone
+	return o.save(ctx, saga)
+}
+
+// holdItems confirms the saga's holds so paid stock stays reserved until it
+// ships. Holds the reaper took back, because charging or recovery outlasted
+// RESERVATION_TTL, are reserved again; if the stock has gone meanwhile it
+// fails with ErrInsufficientInventory.
+func (o *CheckoutOrchestrator) holdItems(ctx context.Context, saga *CheckoutSaga) error {
+	for _, it := range saga.Items {
+		units, err := o.inventory.Confirm(ctx, it.ProductID, saga.owner())
+		if err != nil {
+			return err
+		}
+		if units >= it.Quantity {
+			continue
+		}
+		if _, err := o.inventory.Reserve(ctx, it.ProductID, it.Quantity-units, saga.owner(), reservationTTL()); err != nil {
+			return fmt.Errorf("product %d: reservation expired before checkout: %w", it.ProductID, err)
+		}
+		if _, err := o.inventory.Confirm(ctx, it.ProductID, saga.owner()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort compensates whatever the saga did so far and returns cause
+func (o *CheckoutOrchestrator) abort(ctx context.Context, saga *CheckoutSaga, cause error) error {
+	saga.Step = SagaStepCompensating
+	saga.Failure = truncate(cause.Error(), 255)
+	if err := o.save(ctx, saga); err != nil {
+		return err
+	}
+	if err := o.compensate(ctx, saga); err != nil {
+		log.Printf("checkout saga %s: compensation failed, recovery will retry: %v", saga.CartID, err)
+	}
+	return cause
+}
+
+// compensate voids the charge (if one went through) and releases the holds;
+// every call is safe to repeat
+func (o *CheckoutOrchestrator) compensate(ctx context.Context, saga *CheckoutSaga) error {
+	txnID := saga.TransactionID
+	if txnID == "" {
+		// A timed-out or interrupted charge may still have been captured
+		id, err := o.processor.Lookup(ctx, saga.chargeKey())
+		if err != nil && !errors.Is(err, ErrPaymentNotFound) {
+			return err
+		}
+		txnID = id
+	}
+	if txnID != "" {
+		if err := o.processor.Void(ctx, txnID); err != nil {
+			return err
+		}
+	}
+	for _, it := range saga.Items {
+		if _, err := o.inventory.Release(ctx, it.ProductID, saga.owner()); err != nil && !errors.Is(err, ErrProductNotFound) {
+			return err
+		}
+	}
+
+	saga.Status = SagaStatusAborted
+	saga.Step = SagaStepDone
+	return o.save(ctx, saga)
+}
+
+func (o *CheckoutOrchestrator) save(ctx context.Context, saga *CheckoutSaga) error {
+	saga.UpdatedAt = time.Now().UTC()
+	return o.sagas.SaveSaga(ctx, saga)
+}
+
+/************ Recovery ************/
+
+// Sagas untouched for longer than this (SAGA_STALE_AFTER) are assumed to
+// belong to a dead task; it must exceed the processor timeout
+func sagaStaleAfter() time.Duration {
+	if d, err := time.ParseDuration(getenv("SAGA_STALE_AFTER", "2m")); err == nil && d > paymentTimeout() {
+		return d
+	}
+	return 2 * time.Minute
+}
+
+// How often every replica looks for stale sagas (SAGA_RECOVERY_INTERVAL)
+func sagaRecoveryInterval() time.Duration {
+	if d, err := time.ParseDuration(getenv("SAGA_RECOVERY_INTERVAL", "1m")); err == nil && d > 0 {
+		return d
+	}
+	return time.Minute
+}
+
+// Recover finishes the sagas a crashed task left RUNNING: forward if the card
+// was charged, backward otherwise. It runs at startup and then every interval.
+func (o *CheckoutOrchestrator) Recover(ctx context.Context) {
+	interval := sagaRecoveryInterval()
+	for {
+		o.recoverOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (o *CheckoutOrchestrator) recoverOnce(ctx context.Context) {
+	stale, err := o.sagas.ListStaleSagas(ctx, time.Now().Add(-sagaStaleAfter()), 100)
+	if err != nil {
+		log.Printf("checkout saga recovery: %v", err)
+		return
+	}
+	for i := range stale {
+		saga := &stale[i]
+		// Claim it; if another task got there first, leave it to them
+		if err := o.save(ctx, saga); err != nil {
+			continue
+		}
+		if err := o.resume(ctx, saga); err != nil {
+			log.Printf("checkout saga %s: recovery from %s: %v", saga.CartID, saga.Step, err)
+			continue
+		}
+		log.Printf("checkout saga %s: recovered, now %s", saga.CartID, saga.Status)
+	}
+}
+
+func (o *CheckoutOrchestrator) resume(ctx context.Context, saga *CheckoutSaga) error {
+	switch saga.Step {
+	case SagaStepCharging:
+		txnID, err := o.processor.Lookup(ctx, saga.chargeKey())
+		if errors.Is(err, ErrPaymentNotFound) {
+			saga.Failure = "interrupted by a restart before the charge"
+			return o.compensate(ctx, saga)
+		}
+		if err != nil {
+			return err
+		}
+		saga.TransactionID = txnID
+		saga.Step = SagaStepCompleting
+		if err := o.save(ctx, saga); err != nil {
+			return err
+		}
+		return o.complete(ctx, saga)
+	case SagaStepCompleting:
+		return o.complete(ctx, saga)
+	default: // RESERVING, COMPENSATING
+		if saga.Failure == "" {
+			saga.Failure = "interrupted by a restart"
+		}
+		return o.compensate(ctx, saga)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const sagaTestCard = "4111111111111111"
+
+var sagaTestToken = CardToken{Token: "tok_test", Last4: "1111", Brand: "visa"}
+
+type sagaFixture struct {
+	t     *testing.T
+	store *MemoryStore
+	fake  *fakeProcessor
+	o     *CheckoutOrchestrator
+}
+
+// newSagaFixture stocks the warehouse with stock (product ID -> units)
+func newSagaFixture(t *testing.T, stock map[int]int) *sagaFixture {
+	f := &sagaFixture{t: t, store: newMemoryStore(), fake: newFakeProcessor()}
+	f.o = newCheckoutOrchestrator(f.store, f.fake)
+	for productID, n := range stock {
+		if err := f.store.Restock(context.Background(), productID, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+func (f *sagaFixture) cart(items ...CartItem) *Cart {
+	ctx := context.Background()
+	id, err := f.store.CreateCart(ctx, 7)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	for _, it := range items {
+		if _, err := f.store.UpsertItem(ctx, id, it.ProductID, it.Quantity); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	c, err := f.store.GetCart(ctx, id)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return c
+}
+
+func (f *sagaFixture) saga(cartID string) *CheckoutSaga {
+	s, err := f.store.GetSaga(context.Background(), cartID)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return s
+}
+
+// reserved returns the units of productID currently held
+func (f *sagaFixture) reserved(productID int) int {
+	inv, err := f.store.GetInventory(context.Background(), productID)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return inv.Reserved
+}
+
+// expectCompensated checks that an aborted checkout left nothing behind
+func (f *sagaFixture) expectCompensated(cart *Cart) {
+	f.t.Helper()
+	s := f.saga(cart.ID)
+	if s.Status != SagaStatusAborted || s.Step != SagaStepDone || s.Failure == "" {
+		f.t.Errorf("saga = %s/%s (failure %q), want ABORTED/DONE with the failure", s.Status, s.Step, s.Failure)
+	}
+	for _, it := range cart.Items {
+		if n := f.reserved(it.ProductID); n != 0 {
+			f.t.Errorf("product %d: %d units still reserved", it.ProductID, n)
+		}
+	}
+	if _, err := f.fake.Lookup(context.Background(), s.chargeKey()); !errors.Is(err, ErrPaymentNotFound) {
+		f.t.Errorf("charge %s is still live (%v)", s.chargeKey(), err)
+	}
+	c, _ := f.store.GetCart(context.Background(), cart.ID)
+	if c.Status != CartStatusOpen || c.OrderID != "" {
+		f.t.Errorf("cart = %s with order %q, want OPEN without an order", c.Status, c.OrderID)
+	}
+}
+
+func TestSagaCompletes(t *testing.T) {
+	ctx := context.Background()
+	f := newSagaFixture(t, map[int]int{1: 10, 2: 10})
+	cart := f.cart(CartItem{ProductID: 1, Quantity: 2}, CartItem{ProductID: 2, Quantity: 3})
+
+	s, err := f.o.Run(ctx, cart, sagaTestToken, sagaTestCard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Status != SagaStatusCompleted || s.Step != SagaStepDone || s.OrderID == "" || s.TransactionID == "" {
+		t.Fatalf("saga = %+v", s)
+	}
+	p, err := f.store.GetOrderPayment(ctx, s.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TransactionID != s.TransactionID || p.AmountCents != s.AmountCents || p.CardToken != sagaTestToken.Token {
+		t.Errorf("payment = %+v, want transaction %s for %d cents", p, s.TransactionID, s.AmountCents)
+	}
+	// Paid stock stays held until it ships
+	if f.reserved(1) != 2 || f.reserved(2) != 3 {
+		t.Errorf("reserved = %d, %d; want 2, 3", f.reserved(1), f.reserved(2))
+	}
+
+	// Paying again returns the same checkout
+	again, err := f.o.Run(ctx, cart, sagaTestToken, sagaTestCard)
+	if err != nil || again.OrderID != s.OrderID || again.TransactionID != s.TransactionID {
+		t.Errorf("second run = %+v, %v; want the first checkout", again, err)
+	}
+}
+
+func TestSagaCompensates(t *testing.T) {
+	tests := []struct {
+		name    string
+		stock   map[int]int
+		card    string
+		wantErr error
+	}{
+		{"short stock on a later line", map[int]int{1: 10, 2: 1}, sagaTestCard, ErrInsufficientInventory},
+		{"declined card", map[int]int{1: 10, 2: 10}, "4000000000000002", ErrPaymentDeclined},
+		{"gateway timeout", map[int]int{1: 10, 2: 10}, fakeTimeoutCard, ErrPaymentTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PAYMENT_TIMEOUT", "20ms")
+			f := newSagaFixture(t, tt.stock)
+			cart := f.cart(CartItem{ProductID: 1, Quantity: 2}, CartItem{ProductID: 2, Quantity: 3})
+
+			if _, err := f.o.Run(context.Background(), cart, sagaTestToken, tt.card); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run = %v, want %v", err, tt.wantErr)
+			}
+			f.expectCompensated(cart)
+		})
+	}
+}
+
+// changingProcessor adds an item to the cart right after the charge, as a
+// concurrent add-to-cart request would
+type changingProcessor struct {
+	*fakeProcessor
+	store  *MemoryStore
+	cartID string
+}
+
+func (p changingProcessor) Charge(ctx context.Context, req ChargeRequest) (string, error) {
+	id, err := p.fakeProcessor.Charge(ctx, req)
+	if err == nil {
+		_, err = p.store.UpsertItem(ctx, p.cartID, 3, 1)
+	}
+	return id, err
+}
+
+func TestSagaCompensatesWhenTheCartChanges(t *testing.T) {
+	f := newSagaFixture(t, map[int]int{1: 10, 2: 10})
+	cart := f.cart(CartItem{ProductID: 1, Quantity: 2}, CartItem{ProductID: 2, Quantity: 3})
+	f.o.processor = changingProcessor{fakeProcessor: f.fake, store: f.store, cartID: cart.ID}
+
+	if _, err := f.o.Run(context.Background(), cart, sagaTestToken, sagaTestCard); !errors.Is(err, ErrCartChanged) {
+		t.Fatalf("Run = %v, want %v", err, ErrCartChanged)
+	}
+	f.expectCompensated(cart)
+	if len(f.store.orders) != 0 {
+		t.Errorf("%d order(s) created from a cart nobody paid for", len(f.store.orders))
+	}
+}
+
+// reapingProcessor lets the reaper take every hold while the charge is in
+// flight, as when charging outlasts RESERVATION_TTL; then another cart may
+// buy the freed stock
+type reapingProcessor struct {
+	*fakeProcessor
+	store     *MemoryStore
+	buyFreed  bool
+	productID int
+}
+
+func (p reapingProcessor) Charge(ctx context.Context, req ChargeRequest) (string, error) {
+	id, err := p.fakeProcessor.Charge(ctx, req)
+	if err != nil {
+		return id, err
+	}
+	if _, err := p.store.ReapExpired(ctx, time.Now().Add(time.Hour), 100); err != nil {
+		return id, err
+	}
+	if p.buyFreed {
+		inv, _ := p.store.GetInventory(ctx, p.productID)
+		_, err = p.store.Reserve(ctx, p.productID, inv.Available(), "cart:other", time.Hour)
+	}
+	return id, err
+}
+
+func TestSagaReservationExpiredDuringCharge(t *testing.T) {
+	tests := []struct {
+		name     string
+		buyFreed bool
+		wantErr  error
+	}{
+		{"stock still there: reserved again", false, nil},
+		{"stock sold meanwhile: compensated", true, ErrInsufficientInventory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newSagaFixture(t, map[int]int{1: 5})
+			cart := f.cart(CartItem{ProductID: 1, Quantity: 2})
+			f.o.processor = reapingProcessor{fakeProcessor: f.fake, store: f.store, buyFreed: tt.buyFreed, productID: 1}
+
+			s, err := f.o.Run(ctx, cart, sagaTestToken, sagaTestCard)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if n, _ := f.store.Release(ctx, 1, "cart:other"); n != 5 {
+					t.Errorf("the other cart holds %d units, want 5", n)
+				}
+				f.expectCompensated(cart)
+				return
+			}
+			if s.Status != SagaStatusCompleted {
+				t.Fatalf("saga = %s, want COMPLETED", s.Status)
+			}
+			if n := f.reserved(1); n != 2 {
+				t.Errorf("reserved = %d, want the order's 2", n)
+			}
+			// The holds are permanent now: a later reap leaves them
+			f.store.ReapExpired(ctx, time.Now().Add(24*time.Hour), 100)
+			if n := f.reserved(1); n != 2 {
+				t.Errorf("reserved after a reap = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestSagaRetryAfterAbort(t *testing.T) {
+	ctx := context.Background()
+	f := newSagaFixture(t, map[int]int{1: 10})
+	cart := f.cart(CartItem{ProductID: 1, Quantity: 2})
+
+	if _, err := f.o.Run(ctx, cart, sagaTestToken, "4000000000000002"); !errors.Is(err, ErrPaymentDeclined) {
+		t.Fatalf("first run = %v, want %v", err, ErrPaymentDeclined)
+	}
+	s, err := f.o.Run(ctx, cart, sagaTestToken, sagaTestCard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Attempt != 2 || s.Status != SagaStatusCompleted {
+		t.Errorf("second run: attempt %d, %s; want attempt 2, COMPLETED", s.Attempt, s.Status)
+	}
+}
+
+func TestSagaRecovery(t *testing.T) {
+	tests := []struct {
+		name    string
+		charged bool // the crashed task's charge went through
+		want    string
+	}{
+		{"charged: forward", true, SagaStatusCompleted},
+		{"not charged: backward", false, SagaStatusAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f := newSagaFixture(t, map[int]int{1: 10})
+			cart := f.cart(CartItem{ProductID: 1, Quantity: 2})
+
+			// A task reserved, started charging and died
+			s := &CheckoutSaga{
+				CartID: cart.ID, CustomerID: cart.CustomerID, Attempt: 1,
+				Status: SagaStatusRunning, Step: SagaStepCharging,
+				Items: cart.Items, AmountCents: cartAmountCents(cart), CardToken: sagaTestToken.Token,
+				CreatedAt: time.Now().Add(-time.Hour), UpdatedAt: time.Now().Add(-time.Hour),
+			}
+			if _, err := f.store.Reserve(ctx, 1, 2, s.owner(), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if tt.charged {
+				if _, err := f.fake.Charge(ctx, ChargeRequest{IdempotencyKey: s.chargeKey(), AmountCents: s.AmountCents, CardNumber: sagaTestCard}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := f.store.SaveSaga(ctx, s); err != nil {
+				t.Fatal(err)
+			}
+
+			f.o.recoverOnce(ctx)
+			got := f.saga(cart.ID)
+			if got.Status != tt.want || got.Step != SagaStepDone {
+				t.Fatalf("recovered saga = %s/%s, want %s/DONE", got.Status, got.Step, tt.want)
+			}
+			if tt.charged {
+				if _, err := f.store.GetOrderPayment(ctx, got.OrderID); err != nil {
+					t.Errorf("payment of order %q: %v", got.OrderID, err)
+				}
+				return
+			}
+			f.expectCompensated(cart)
+		})
+	}
+}
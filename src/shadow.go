@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shadow reads check DynamoDB against production traffic before it takes over.
+// With DB_BACKEND=dualwrite every cart read is answered from MySQL; a sample of
+// them (SHADOW_READ_PERCENT, default 100; 0 turns them off) also reads the
+// cart from DynamoDB in the background and compares customer_id and the item
+// quantities. Mismatches are counted and logged with both payloads.
+//
+// The comparison runs after the primary answer is handed back and never makes
+// the request wait: when shadowReadSlots comparisons are already running, the
+// read is not compared (and counted as dropped).
+
+const (
+	shadowReadSlots   = 64
+	shadowReadTimeout = 2 * time.Second
+	// A cart written between the two reads looks like a mismatch; it is only
+	// reported if it still differs this long after
+	shadowRecheckDelay = 500 * time.Millisecond
+)
+
+// ShadowReader compares primary cart reads with the secondary's copy
+type ShadowReader struct {
+	primary   CartStore
+	secondary CartStore
+	percent   int
+	slots     chan struct{}
+
+	compared   atomic.Int64
+	mismatches atomic.Int64
+	changed    atomic.Int64 // primary cart changed while comparing; not judged
+	failures   atomic.Int64
+	dropped    atomic.Int64
+
+	mu             sync.Mutex
+	lastMismatchAt time.Time
+}
+
+// newShadowReaderFromEnv returns nil if SHADOW_READ_PERCENT is 0
+func newShadowReaderFromEnv(primary, secondary CartStore) *ShadowReader {
+	// Not getenvInt: it takes 0 for unset, and 0 here turns shadow reads off
+	percent := 100
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("SHADOW_READ_PERCENT"))); err == nil {
+		percent = min(max(n, 0), 100)
+	}
+	if percent == 0 {
+		return nil
+	}
+	return &ShadowReader{
+		primary:   primary,
+		secondary: secondary,
+		percent:   percent,
+		slots:     make(chan struct{}, shadowReadSlots),
+	}
+}
+
+// Observe schedules a comparison of c, as just read from the primary, with the
+// secondary's copy. It never blocks.
+func (s *ShadowReader) Observe(c *Cart) {
+	if s.percent < 100 && rand.Intn(100) >= s.percent {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		s.dropped.Add(1)
+		return
+	}
+	primary := *c
+	primary.Items = slices.Clone(c.Items)
+	go func() {
+		defer func() { <-s.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), shadowReadTimeout)
+		defer cancel()
+		s.compare(ctx, &primary)
+	}()
+}
+
+func (s *ShadowReader) compare(ctx context.Context, primary *Cart) {
+	s.compared.Add(1)
+	secondary, diff, err := s.diff(ctx, primary)
+	if err != nil || diff == "" {
+		return
+	}
+
+	// Give an in-flight write time to reach both stores, then look again
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(shadowRecheckDelay):
+	}
+	again, err := s.primary.GetCart(ctx, primary.ID)
+	if err != nil {
+		s.fail(primary.ID, "primary", err)
+		return
+	}
+	if diffCarts(primary, again) != "" || !again.UpdatedAt.Equal(primary.UpdatedAt) {
+		s.changed.Add(1)
+		return
+	}
+	if secondary, diff, err = s.diff(ctx, primary); err != nil || diff == "" {
+		return
+	}
+
+	s.mismatches.Add(1)
+	s.mu.Lock()
+	s.lastMismatchAt = time.Now().UTC()
+	s.mu.Unlock()
+	secondaryJSON := []byte("null")
+	if secondary != nil {
+		secondaryJSON, _ = json.Marshal(newGetCartResp(secondary))
+	}
+	primaryJSON, _ := json.Marshal(newGetCartResp(primary))
+	log.Printf("shadow: cart %s mismatch: %s; primary=%s secondary=%s", primary.ID, diff, primaryJSON, secondaryJSON)
+}
+
+// diff reads the secondary's copy of primary and describes how they differ
+func (s *ShadowReader) diff(ctx context.Context, primary *Cart) (*Cart, string, error) {
+	secondary, err := s.secondary.GetCart(ctx, primary.ID)
+	if errors.Is(err, ErrCartNotFound) {
+		return nil, "cart missing in dynamodb", nil
+	}
+	if err != nil {
+		s.fail(primary.ID, "secondary", err)
+		return nil, "", err
+	}
+	return secondary, diffCarts(primary, secondary), nil
+}
+
+func (s *ShadowReader) fail(cartID, side string, err error) {
+	s.failures.Add(1)
+	log.Printf("shadow: cart %s: read %s: %v", cartID, side, err)
+}
+
+type shadowStatsResp struct {
+	Percent        int        `json:"percent"`
+	Compared       int64      `json:"compared"`
+	Mismatches     int64      `json:"mismatches"`
+	Changed        int64      `json:"changed_while_comparing"`
+	Errors         int64      `json:"errors"`
+	Dropped        int64      `json:"dropped"`
+	LastMismatchAt *time.Time `json:"last_mismatch_at,omitempty"`
+}
+
+func (s *ShadowReader) stats() *shadowStatsResp {
+	resp := &shadowStatsResp{
+		Percent:    s.percent,
+		Compared:   s.compared.Load(),
+		Mismatches: s.mismatches.Load(),
+		Changed:    s.changed.Load(),
+		Errors:     s.failures.Load(),
+		Dropped:    s.dropped.Load(),
+	}
+	s.mu.Lock()
+	if !s.lastMismatchAt.IsZero() {
+		t := s.lastMismatchAt
+		resp.LastMismatchAt = &t
+	}
+	s.mu.Unlock()
+	return resp
+}
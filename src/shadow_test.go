@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestNewShadowReaderFromEnv(t *testing.T) {
+	tests := []struct {
+		env     string
+		percent int // 0: no shadow reader
+	}{
+		{"", 100},
+		{"0", 0},
+		{" 0 ", 0},
+		{"-5", 0},
+		{"25", 25},
+		{"100", 100},
+		{"250", 100},
+		{"half", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("SHADOW_READ_PERCENT", tt.env)
+			s := newShadowReaderFromEnv(newMemoryStore(), newMemoryStore())
+			switch {
+			case tt.percent == 0 && s != nil:
+				t.Fatalf("SHADOW_READ_PERCENT=%q: got a shadow reader at %d%%, want none", tt.env, s.percent)
+			case tt.percent != 0 && s == nil:
+				t.Fatalf("SHADOW_READ_PERCENT=%q: got no shadow reader, want %d%%", tt.env, tt.percent)
+			case s != nil && s.percent != tt.percent:
+				t.Fatalf("SHADOW_READ_PERCENT=%q: percent = %d, want %d", tt.env, s.percent, tt.percent)
+			}
+		})
+	}
+}
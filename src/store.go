@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Errors returned by CartStore implementations. Handlers map these to HTTP
+// status codes, so every backend must use them instead of ad-hoc messages.
+var (
+	ErrCartNotFound   = errors.New("cart not found")
+	ErrInvalidCartID  = errors.New("invalid cart id")
+	ErrConflict       = errors.New("concurrent update conflict")
+	ErrCartEmpty      = errors.New("cart is empty")
+	ErrCartCheckedOut = errors.New("cart is already checked out")
+	ErrCartChanged    = errors.New("cart items changed")
+)
+
+// Cart statuses (mirrors the MySQL carts.status ENUM)
+const (
+	CartStatusOpen       = "OPEN"
+	CartStatusCheckedOut = "CHECKED_OUT"
+)
+
+// Order statuses
+const (
+	OrderStatusPlaced = "PLACED"
+)
+
+// Cart item structure shared by every backend (embedded in DynamoDB records)
+type CartItem struct {
+	ProductID int `json:"product_id" dynamodbav:"product_id"`
+	Quantity  int `json:"quantity" dynamodbav:"quantity"`
+}
+
+// Cart is the backend-neutral view of a shopping cart and its items.
+type Cart struct {
+	ID         string
+	CustomerID int
+	Status     string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	OrderID    string // set once the cart is checked out
+	Items      []CartItem
+}
+
+// CartItemChange is what UpsertItem and RemoveItem report about the change
+type CartItemChange struct {
+	CustomerID  int // owner of the cart
+	OldQuantity int // quantity before the change; 0 if the product was not in the cart
+}
+
+// Order is created by checkout from a snapshot of the cart's items.
+type Order struct {
+	ID         string
+	CartID     string
+	CustomerID int
+	Status     string
+	CreatedAt  time.Time
+	Items      []CartItem
+}
+
+// CartStore is implemented by every cart persistence backend (MySQL, DynamoDB, memory).
+// The HTTP handlers only depend on this interface, so validation, path parsing
+// and error mapping are written once.
+type CartStore interface {
+	// CreateCart creates an empty OPEN cart and returns its ID.
+	CreateCart(ctx context.Context, customerID int) (string, error)
+	// GetCart returns the cart with its items, or ErrCartNotFound.
+	GetCart(ctx context.Context, cartID string) (*Cart, error)
+	// UpsertItem sets the quantity of a product in the cart (quantity > 0).
+	UpsertItem(ctx context.Context, cartID string, productID, quantity int) (CartItemChange, error)
+	// RemoveItem deletes a product from the cart; removing an absent product is a no-op.
+	RemoveItem(ctx context.Context, cartID string, productID int) (CartItemChange, error)
+	// Checkout atomically moves an OPEN, non-empty cart to CHECKED_OUT and
+	// persists an order holding a copy of its items, plus its order.placed
+	// event in the outbox. The cart must still hold exactly items (the ones the
+	// caller reserved and charged, in any order), checked in the same
+	// transaction. Returns the new order ID, ErrCartEmpty, ErrCartCheckedOut or
+	// ErrCartChanged.
+	Checkout(ctx context.Context, cartID string, items []CartItem) (string, error)
+}
+
+// Store is the full set of capabilities every DB_BACKEND provides.
+type Store interface {
+	CartStore
+	OrderStore
+	ProductStore
+	InventoryStore
+	PaymentStore
+	RefundStore
+	SagaStore
+	OutboxStore
+}
+
+// sameItems reports whether a and b hold the same quantities of the same
+// products, in whatever order
+func sameItems(a, b []CartItem) bool {
+	byProduct := func(x, y CartItem) int { return x.ProductID - y.ProductID }
+	return slices.Equal(slices.SortedFunc(slices.Values(a), byProduct), slices.SortedFunc(slices.Values(b), byProduct))
+}
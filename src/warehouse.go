@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned by InventoryStore implementations
+var (
+	ErrInsufficientInventory = errors.New("insufficient inventory")
+	ErrInsufficientReserved  = errors.New("insufficient reserved inventory")
+)
+
+// Inventory is the stock of one product.
+// OnHand counts units physically in the warehouse, Reserved is the part of
+// OnHand promised to someone, Shipped counts units that already left.
+// Invariant: 0 <= Reserved <= OnHand.
+type Inventory struct {
+	ProductID int `json:"product_id" dynamodbav:"product_id"`
+	OnHand    int `json:"on_hand" dynamodbav:"on_hand"`
+	Reserved  int `json:"reserved" dynamodbav:"reserved"`
+	Shipped   int `json:"shipped" dynamodbav:"shipped"`
+}
+
+// Available is what can still be reserved
+func (inv Inventory) Available() int { return inv.OnHand - inv.Reserved }
+
+// InventoryStore tracks warehouse stock. Every method is a single atomic step,
+// so concurrent requests can never drive any counter negative.
+//
+// Reserved stock is made of individual holds (reservations), each with an
+// owner (cart or order ID) and an expiry. The sum of the quantities of all
+// live holds of a product always equals its Reserved counter.
+type InventoryStore interface {
+	// GetInventory returns the stock of a product, or ErrProductNotFound.
+	GetInventory(ctx context.Context, productID int) (*Inventory, error)
+	// Restock adds units to on-hand stock, creating the inventory record if needed.
+	Restock(ctx context.Context, productID, quantity int) error
+	// Reserve places a hold of quantity available units for owner that expires
+	// after ttl. Returns the reservation ID, or ErrInsufficientInventory.
+	Reserve(ctx context.Context, productID, quantity int, owner string, ttl time.Duration) (string, error)
+	// Ship consumes quantity units from the product's holds, oldest first, and
+	// removes them from the warehouse. With a non-empty owner only that owner's
+	// holds are used. Fails with ErrInsufficientReserved.
+	Ship(ctx context.Context, productID, quantity int, owner string) error
+	// Release drops every hold owner has on the product and returns the units freed.
+	Release(ctx context.Context, productID int, owner string) (int, error)
+	// Confirm makes owner's holds on the product permanent: they no longer
+	// expire and stay reserved until shipped or released. Returns the units held.
+	Confirm(ctx context.Context, productID int, owner string) (int, error)
+	// ReapExpired releases up to limit holds that expired before now. It is safe
+	// to run concurrently from several replicas: each hold is released once.
+	ReapExpired(ctx context.Context, now time.Time, limit int) (ReapResult, error)
+}
+
+// ReapResult counts what one ReapExpired call gave back to available stock
+type ReapResult struct {
+	Reservations int `json:"reservations"`
+	Units        int `json:"units"`
+}
+
+// inventoryHold is one live reservation, as embedded in the memory and
+// DynamoDB inventory records (MySQL keeps them in the reservations table).
+type inventoryHold struct {
+	ReservationID string `dynamodbav:"reservation_id"`
+	Owner         string `dynamodbav:"owner"`
+	Quantity      int    `dynamodbav:"quantity"`
+	ExpiresAt     int64  `dynamodbav:"expires_at"` // unix milliseconds, 0 once confirmed
+}
+
+func (h inventoryHold) expired(cutoff int64) bool {
+	return h.ExpiresAt != 0 && h.ExpiresAt <= cutoff
+}
+
+// confirmHolds clears the expiry of owner's holds and returns their units
+func confirmHolds(holds []inventoryHold, owner string) int {
+	units := 0
+	for i := range holds {
+		if holds[i].Owner == owner {
+			holds[i].ExpiresAt = 0
+			units += holds[i].Quantity
+		}
+	}
+	return units
+}
+
+// takeHolds consumes quantity units from holds, oldest first, restricted to
+// owner unless owner is "". Returns the remaining holds, or false if there
+// were not enough reserved units to take.
+func takeHolds(holds []inventoryHold, owner string, quantity int) ([]inventoryHold, bool) {
+	avail := 0
+	for _, h := range holds {
+		if owner == "" || h.Owner == owner {
+			avail += h.Quantity
+		}
+	}
+	if avail < quantity {
+		return holds, false
+	}
+
+	remaining := make([]inventoryHold, 0, len(holds))
+	for _, h := range holds {
+		if quantity > 0 && (owner == "" || h.Owner == owner) {
+			take := min(quantity, h.Quantity)
+			h.Quantity -= take
+			quantity -= take
+		}
+		if h.Quantity > 0 {
+			remaining = append(remaining, h)
+		}
+	}
+	return remaining, true
+}
+
+// dropHolds removes the holds matching drop and reports how many holds and
+// units were removed.
+func dropHolds(holds []inventoryHold, drop func(h inventoryHold) bool) ([]inventoryHold, ReapResult) {
+	var res ReapResult
+	remaining := make([]inventoryHold, 0, len(holds))
+	for _, h := range holds {
+		if drop(h) {
+			res.Reservations++
+			res.Units += h.Quantity
+			continue
+		}
+		remaining = append(remaining, h)
+	}
+	return remaining, res
+}
+
+// Default hold lifetime when the reserve request does not set ttl_seconds
+func reservationTTL() time.Duration {
+	if d, err := time.ParseDuration(getenv("RESERVATION_TTL", "15m")); err == nil && d > 0 {
+		return d
+	}
+	return 15 * time.Minute
+}
+
+/************ Handlers ************/
+
+type inventoryReq struct {
+	ProductID  int    `json:"product_id"`
+	Quantity   int    `json:"quantity"`
+	Owner      string `json:"owner,omitempty"`       // cart or order ID holding the stock
+	TTLSeconds int    `json:"ttl_seconds,omitempty"` // reserve only; defaults to RESERVATION_TTL
+}
+
+type releaseReq struct {
+	ProductID int    `json:"product_id"`
+	Owner     string `json:"owner"`
+}
+
+type releaseResp struct {
+	Released int `json:"released"`
+}
+
+type inventoryResp struct {
+	Inventory
+	Available int `json:"available"`
+}
+
+func decodeInventoryReq(w http.ResponseWriter, r *http.Request) (inventoryReq, bool) {
+	var req inventoryReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
+		return req, false
+	}
+	if req.ProductID < 1 || req.Quantity < 1 {
+		writeErr(w, 400, "INVALID_INPUT", "product_id and quantity must be >= 1")
+		return req, false
+	}
+	if len(req.Owner) > 64 || req.TTLSeconds < 0 {
+		writeErr(w, 400, "INVALID_INPUT", "owner must be at most 64 characters and ttl_seconds >= 0")
+		return req, false
+	}
+	return req, true
+}
+
+// POST /warehouse/reserve
+func reserveInventoryHandler(store InventoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		req, ok := decodeInventoryReq(w, r)
+		if !ok {
+			return
+		}
+		ttl := reservationTTL()
+		if req.TTLSeconds > 0 {
+			ttl = time.Duration(req.TTLSeconds) * time.Second
+		}
+		id, err := store.Reserve(r.Context(), req.ProductID, req.Quantity, req.Owner, ttl)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		w.Header().Set("X-Reservation-Id", id)
+		w.WriteHeader(204)
+	}
+}
+
+// POST /warehouse/ship
+func shipProductHandler(store InventoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		req, ok := decodeInventoryReq(w, r)
+		if !ok {
+			return
+		}
+		if err := store.Ship(r.Context(), req.ProductID, req.Quantity, req.Owner); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// POST /warehouse/restock (admin listener only)
+func restockHandler(store InventoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		req, ok := decodeInventoryReq(w, r)
+		if !ok {
+			return
+		}
+		if err := store.Restock(r.Context(), req.ProductID, req.Quantity); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// POST /warehouse/release —— give an owner's holds on a product back to available
+// stock (admin listener only)
+func releaseHandler(store InventoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var req releaseReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErr(w, 400, "INVALID_INPUT", "Invalid JSON")
+			return
+		}
+		if req.ProductID < 1 || req.Owner == "" {
+			writeErr(w, 400, "INVALID_INPUT", "product_id must be >= 1 and owner is required")
+			return
+		}
+		n, err := store.Release(r.Context(), req.ProductID, req.Owner)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		writeJSON(w, 200, releaseResp{Released: n})
+	}
+}
+
+// GET /warehouse/inventory/{productId}
+func getInventoryHandler(store InventoryStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		after := strings.TrimPrefix(r.URL.Path, "/warehouse/inventory/")
+		productID, err := strconv.Atoi(after)
+		if err != nil || productID < 1 {
+			writeErr(w, 400, "INVALID_INPUT", "productId must be a positive integer")
+			return
+		}
+
+		inv, err := store.GetInventory(r.Context(), productID)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		writeJSON(w, 200, inventoryResp{Inventory: *inv, Available: inv.Available()})
+	}
+}
+
+func registerWarehouseRoutes(mux *http.ServeMux, store InventoryStore, reaper *ReservationReaper) {
+	mux.HandleFunc("/warehouse/reserve", reserveInventoryHandler(store))
+	mux.HandleFunc("/warehouse/ship", shipProductHandler(store))
+	mux.HandleFunc("/warehouse/reaper", reaper.statsHandler)
+	mux.HandleFunc("/warehouse/inventory/", getInventoryHandler(store))
+}
+
+// Stock can only be added, and anyone's holds dropped, from the admin
+// listener, which the load balancer does not reach
+func registerWarehouseAdminRoutes(mux *http.ServeMux, store InventoryStore) {
+	mux.HandleFunc("/warehouse/restock", restockHandler(store))
+	mux.HandleFunc("/warehouse/release", releaseHandler(store))
+}
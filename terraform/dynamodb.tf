@@ -4,6 +4,10 @@ resource "aws_dynamodb_table" "shopping_carts" {
   billing_mode   = "PAY_PER_REQUEST"  # On-demand pricing for unpredictable workloads
   hash_key       = "cart_id"
 
+  # Every change goes to the stream; the projector task copies carts into MySQL
+  stream_enabled   = true
+  stream_view_type = "NEW_AND_OLD_IMAGES"  # removals need the old image
+
   attribute {
     name = "cart_id"
     type = "S"  # String type for cart_id
@@ -26,6 +30,206 @@ resource "aws_dynamodb_table" "shopping_carts" {
   }
 }
 
+# Orders written by checkout (cart status flip + order put in one transaction)
+resource "aws_dynamodb_table" "orders" {
+  name         = "${var.project_name}-orders"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "order_id"
+
+  attribute {
+    name = "order_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "customer_id"
+    type = "N"
+  }
+
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+
+  # Per-customer order history, newest first (GET /customers/{id}/orders)
+  global_secondary_index {
+    name            = "customer_id-created_at-index"
+    hash_key        = "customer_id"
+    range_key       = "created_at"
+    projection_type = "ALL"
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-orders"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
+# Product catalog (GET /products/{id}, POST /products/{id}/details)
+resource "aws_dynamodb_table" "products" {
+  name         = "${var.project_name}-products"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "product_id"
+
+  attribute {
+    name = "product_id"
+    type = "N"
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-products"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
+# Warehouse stock per product, with its live reservations (holds) embedded in the item
+resource "aws_dynamodb_table" "inventory" {
+  name         = "${var.project_name}-inventory"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "product_id"
+
+  attribute {
+    name = "product_id"
+    type = "N"
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-inventory"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
+# Captured payments, one per order (written by /payments/checkout)
+resource "aws_dynamodb_table" "payments" {
+  name         = "${var.project_name}-payments"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "order_id"
+
+  attribute {
+    name = "order_id"
+    type = "S"
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-payments"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
+# Checkout sagas, one per cart (written by /payments/checkout, scanned by the
+# recovery loop for sagas a crashed task left RUNNING)
+resource "aws_dynamodb_table" "checkout_sagas" {
+  name         = "${var.project_name}-checkout-sagas"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "cart_id"
+
+  attribute {
+    name = "cart_id"
+    type = "S"
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-checkout-sagas"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
+# Transactional outbox: events written in the same transaction as the change
+# they describe (order.placed with the checkout), published by the relay
+resource "aws_dynamodb_table" "outbox" {
+  name         = "${var.project_name}-outbox"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "event_id"
+
+  attribute {
+    name = "event_id"
+    type = "S"
+  }
+
+  attribute {
+    name = "pending"
+    type = "S"
+  }
+
+  attribute {
+    name = "next_attempt_ms"
+    type = "N"
+  }
+
+  # Sparse index of unsent events, due first ("pending" is removed once sent)
+  global_secondary_index {
+    name            = "pending-index"
+    hash_key        = "pending"
+    range_key       = "next_attempt_ms"
+    projection_type = "ALL"
+  }
+
+  # Sent events expire OUTBOX_RETENTION after they are published
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = false # Disabled for cost savings in lab environment
+  }
+
+  server_side_encryption {
+    enabled = true
+  }
+
+  tags = {
+    Name        = "${var.project_name}-outbox"
+    Environment = var.environment
+    ManagedBy   = "terraform"
+  }
+}
+
 # Output the DynamoDB table name for ECS task configuration
 output "dynamodb_table_name" {
   description = "Name of the DynamoDB shopping carts table"
@@ -36,3 +240,38 @@ output "dynamodb_table_arn" {
   description = "ARN of the DynamoDB shopping carts table"
   value       = aws_dynamodb_table.shopping_carts.arn
 }
+
+output "dynamodb_stream_arn" {
+  description = "Stream of the DynamoDB shopping carts table"
+  value       = aws_dynamodb_table.shopping_carts.stream_arn
+}
+
+output "dynamodb_orders_table_name" {
+  description = "Name of the DynamoDB orders table"
+  value       = aws_dynamodb_table.orders.name
+}
+
+output "dynamodb_products_table_name" {
+  description = "Name of the DynamoDB products table"
+  value       = aws_dynamodb_table.products.name
+}
+
+output "dynamodb_inventory_table_name" {
+  description = "Name of the DynamoDB inventory table"
+  value       = aws_dynamodb_table.inventory.name
+}
+
+output "dynamodb_payments_table_name" {
+  description = "Name of the DynamoDB payments table"
+  value       = aws_dynamodb_table.payments.name
+}
+
+output "dynamodb_sagas_table_name" {
+  description = "Name of the DynamoDB checkout sagas table"
+  value       = aws_dynamodb_table.checkout_sagas.name
+}
+
+output "dynamodb_outbox_table_name" {
+  description = "Name of the DynamoDB outbox table"
+  value       = aws_dynamodb_table.outbox.name
+}
@@ -36,23 +36,37 @@ resource "aws_ecs_task_definition" "receiver" {
         { name = "AWS_REGION",        value = var.aws_region },
 
         # SNS/SQS configuration
+        { name = "QUEUE_BACKEND", value = "aws" },
         { name = "SNS_TOPIC_ARN", value = aws_sns_topic.orders.arn },
         { name = "SQS_QUEUE_URL", value = aws_sqs_queue.orders.url },
         { name = "SQS_QUEUE_ARN", value = aws_sqs_queue.orders.arn },
 
-        # Backend selection: "mysql" or "dynamodb"
+        # Backend selection: "mysql", "dynamodb" or "dualwrite" (MySQL → DynamoDB migration)
         { name = "DB_BACKEND",        value = var.db_backend },
+        { name = "CART_VALIDATE_PRODUCTS", value = tostring(var.validate_cart_products) },
+        { name = "CART_EVENTS",       value = tostring(var.cart_events) },
+        { name = "SHADOW_READ_PERCENT", value = tostring(var.shadow_read_percent) },
+        { name = "RESERVATION_TTL",   value = var.reservation_ttl },
+        { name = "CARD_TOKEN_KEY",    value = var.card_token_key },
 
-        # MySQL/RDS configuration (used when DB_BACKEND=mysql)
+        # MySQL/RDS configuration (used when DB_BACKEND=mysql or dualwrite)
         { name = "DB_HOST",           value = aws_db_instance.cart.address },
         { name = "DB_USER",           value = var.db_user },
         { name = "DB_PASS",           value = var.db_pass },
         { name = "DB_NAME",           value = var.db_name },
         { name = "DB_MAX_OPEN_CONNS", value = "40" },
         { name = "DB_MAX_IDLE_CONNS", value = "20" },
-
-        # DynamoDB configuration (used when DB_BACKEND=dynamodb)
-        { name = "DYNAMODB_TABLE_NAME", value = aws_dynamodb_table.shopping_carts.name }
+        { name = "DB_AUTO_MIGRATE",   value = tostring(var.db_auto_migrate) },
+
+        # DynamoDB configuration (used when DB_BACKEND=dynamodb or dualwrite)
+        { name = "DYNAMODB_TABLE_NAME", value = aws_dynamodb_table.shopping_carts.name },
+        { name = "DYNAMODB_ORDERS_TABLE_NAME", value = aws_dynamodb_table.orders.name },
+        { name = "DYNAMODB_PRODUCTS_TABLE_NAME", value = aws_dynamodb_table.products.name },
+        { name = "DYNAMODB_INVENTORY_TABLE_NAME", value = aws_dynamodb_table.inventory.name },
+        { name = "DYNAMODB_PAYMENTS_TABLE_NAME", value = aws_dynamodb_table.payments.name },
+        { name = "DYNAMODB_SAGAS_TABLE_NAME", value = aws_dynamodb_table.checkout_sagas.name },
+        { name = "DYNAMODB_OUTBOX_TABLE_NAME", value = aws_dynamodb_table.outbox.name },
+        { name = "DYNAMODB_BOOTSTRAP", value = var.dynamodb_bootstrap }
       ]
 
       # logConfiguration removed - requires execution role with PassRole permission
@@ -100,6 +114,8 @@ resource "aws_ecs_task_definition" "processor" {
       name      = "processor"
       image     = var.processor_image
       essential = true
+      # 同一镜像，以 processor 子命令启动（订单队列消费者）
+      command   = ["./app", "processor"]
 
       # Processor 不对外暴露端口，但你之前保留了 PORT；保留不影响
       environment = [
@@ -108,17 +124,30 @@ resource "aws_ecs_task_definition" "processor" {
         { name = "WORKER_GOROUTINES",  value = tostring(var.worker_goroutines) },
         { name = "AWS_REGION",         value = var.aws_region },
 
-        # SQS/SNS（如仍需要）
+        # SQS/SNS
+        { name = "QUEUE_BACKEND", value = "aws" },
         { name = "SNS_TOPIC_ARN", value = aws_sns_topic.orders.arn },
         { name = "SQS_QUEUE_URL", value = aws_sqs_queue.orders.url },
+        { name = "SQS_DLQ_URL",   value = aws_sqs_queue.orders_dlq.url },
+        { name = "QUEUE_MAX_RECEIVES", value = tostring(var.order_queue_max_receives) },
 
-        # 如果 Processor 也需要访问 DB（例如写入统计/异步加购物车），保留；否则可删除以下 6 行
+        # Processor 读订单 / saga、按单发货，需要和 receiver 相同的存储后端
+        { name = "DB_BACKEND",         value = var.db_backend },
         { name = "DB_HOST",            value = aws_db_instance.cart.address },
         { name = "DB_USER",            value = var.db_user },
         { name = "DB_PASS",            value = var.db_pass },
         { name = "DB_NAME",            value = var.db_name },
         { name = "DB_MAX_OPEN_CONNS",  value = "10" },
-        { name = "DB_MAX_IDLE_CONNS",  value = "5" }
+        { name = "DB_MAX_IDLE_CONNS",  value = "5" },
+        { name = "DB_AUTO_MIGRATE",    value = tostring(var.db_auto_migrate) },
+        { name = "DYNAMODB_TABLE_NAME", value = aws_dynamodb_table.shopping_carts.name },
+        { name = "DYNAMODB_ORDERS_TABLE_NAME", value = aws_dynamodb_table.orders.name },
+        { name = "DYNAMODB_PRODUCTS_TABLE_NAME", value = aws_dynamodb_table.products.name },
+        { name = "DYNAMODB_INVENTORY_TABLE_NAME", value = aws_dynamodb_table.inventory.name },
+        { name = "DYNAMODB_PAYMENTS_TABLE_NAME", value = aws_dynamodb_table.payments.name },
+        { name = "DYNAMODB_SAGAS_TABLE_NAME", value = aws_dynamodb_table.checkout_sagas.name },
+        { name = "DYNAMODB_OUTBOX_TABLE_NAME", value = aws_dynamodb_table.outbox.name },
+        { name = "DYNAMODB_BOOTSTRAP", value = var.dynamodb_bootstrap }
       ]
 
       # logConfiguration removed - requires execution role with PassRole permission
@@ -139,4 +168,53 @@ resource "aws_ecs_service" "processor" {
     security_groups  = [aws_security_group.ecs_sg.id]
     assign_public_ip = false
   }
-}
\ No newline at end of file
+}
+
+# Projector：DynamoDB 购物车表 stream → MySQL carts / cart_items（报表用）
+resource "aws_ecs_task_definition" "projector" {
+  family                   = "${var.project_name}-projector"
+  cpu                      = "256"
+  memory                   = "512"
+  network_mode             = "awsvpc"
+  requires_compatibilities = ["FARGATE"]
+  execution_role_arn       = "arn:aws:iam::211125751164:role/LabRole"
+  task_role_arn            = "arn:aws:iam::211125751164:role/LabRole"
+
+  container_definitions = jsonencode([
+    {
+      name      = "projector"
+      image     = var.processor_image
+      essential = true
+      # 同一镜像，以 projector 子命令启动；进度记录在 MySQL stream_checkpoints
+      command   = ["./app", "projector"]
+
+      environment = [
+        { name = "AWS_REGION",          value = var.aws_region },
+        { name = "DYNAMODB_STREAM_ARN", value = aws_dynamodb_table.shopping_carts.stream_arn },
+        { name = "DB_BACKEND",          value = var.db_backend },
+        { name = "DB_HOST",             value = aws_db_instance.cart.address },
+        { name = "DB_USER",             value = var.db_user },
+        { name = "DB_PASS",             value = var.db_pass },
+        { name = "DB_NAME",             value = var.db_name },
+        { name = "DB_MAX_OPEN_CONNS",   value = "5" },
+        { name = "DB_MAX_IDLE_CONNS",   value = "5" },
+        { name = "DB_AUTO_MIGRATE",     value = tostring(var.db_auto_migrate) }
+      ]
+    }
+  ])
+}
+
+resource "aws_ecs_service" "projector" {
+  name            = "${var.project_name}-projector-svc"
+  cluster         = aws_ecs_cluster.this.id
+  task_definition = aws_ecs_task_definition.projector.arn
+  # 双写迁移期间 MySQL 为主，投影会用 DynamoDB 的镜像覆盖 MySQL，因此停掉
+  desired_count   = var.db_backend == "dualwrite" ? 0 : var.desired_count_projector
+  launch_type     = "FARGATE"
+
+  network_configuration {
+    subnets          = local.private_subnet_ids
+    security_groups  = [aws_security_group.ecs_sg.id]
+    assign_public_ip = false
+  }
+}
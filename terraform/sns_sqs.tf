@@ -7,6 +7,27 @@ resource "aws_sqs_queue" "orders" {
   visibility_timeout_seconds = 30
   message_retention_seconds  = 345600 # 4 days
   receive_wait_time_seconds  = 20     # long polling
+
+  # 反复失败的消息转入死信队列；processor 在最后一次失败时自己转移并附上错误原因，
+  # 这里兜底（例如处理中途崩溃）
+  redrive_policy = jsonencode({
+    deadLetterTargetArn = aws_sqs_queue.orders_dlq.arn
+    maxReceiveCount     = var.order_queue_max_receives
+  })
+}
+
+# 死信队列：保留期比主队列长，留出排查和重放（./app dlq）的时间
+resource "aws_sqs_queue" "orders_dlq" {
+  name                      = "${var.project_name}-order-dlq"
+  message_retention_seconds = 1209600 # 14 days
+}
+
+resource "aws_sqs_queue_redrive_allow_policy" "orders_dlq" {
+  queue_url = aws_sqs_queue.orders_dlq.id
+  redrive_allow_policy = jsonencode({
+    redrivePermission = "byQueue"
+    sourceQueueArns   = [aws_sqs_queue.orders.arn]
+  })
 }
 
 # 允许 SNS 向队列投递
@@ -39,4 +60,9 @@ resource "aws_sns_topic_subscription" "orders_to_queue" {
   topic_arn = aws_sns_topic.orders.arn
   protocol  = "sqs"
   endpoint  = aws_sqs_queue.orders.arn
+
+  # 主题上还有购物车 / 退款事件，processor 只需要 order.placed
+  filter_policy = jsonencode({
+    event_type = ["order.placed"]
+  })
 }
\ No newline at end of file
@@ -13,6 +13,8 @@ variable "processor_image" { type = string }
 variable "container_port" { default = 8080 }
 variable "desired_count_receiver" { default = 1 }
 variable "desired_count_processor" { default = 1 }
+# DynamoDB stream → MySQL 投影；只需一个（多于一个也收敛，只是重复劳动）
+variable "desired_count_projector" { default = 1 }
 variable "worker_goroutines" { default = 1 }
 variable "payment_permits" { default = 15 }
 
@@ -36,11 +38,60 @@ variable "db_name" {
 }
 
 variable "db_backend" {
-  description = "Database backend to use: 'mysql' or 'dynamodb'"
+  description = "Database backend to use: 'mysql', 'dynamodb', or 'dualwrite' (migration: MySQL primary, cart writes mirrored to DynamoDB)"
   type        = string
   default     = "mysql"
 }
 
+variable "db_auto_migrate" {
+  description = "Apply pending MySQL schema migrations when a task starts; false makes tasks refuse to start until ./app migrate up has run"
+  type        = bool
+  default     = true
+}
+
+variable "dynamodb_bootstrap" {
+  description = "DYNAMODB_BOOTSTRAP for tasks using DynamoDB: 'off', 'check' (refuse to start unless the tables and GSIs match the code) or 'create' (also create what is missing)"
+  type        = string
+  default     = "check"
+}
+
+variable "validate_cart_products" {
+  description = "Reject add-to-cart for product IDs missing from the catalog (disable for load tests with synthetic IDs)"
+  type        = bool
+  default     = true
+}
+
+variable "reservation_ttl" {
+  description = "Default lifetime of a warehouse reservation before the reaper releases it (Go duration)"
+  type        = string
+  default     = "15m"
+}
+
+variable "card_token_key" {
+  description = "Hex HMAC key for card tokens (>= 16 bytes); empty generates a per-task key, so tokens differ between tasks"
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+variable "cart_events" {
+  description = "Publish a CartEvent to the order events topic on every cart change (turn off for load tests)"
+  type        = bool
+  default     = true
+}
+
+variable "shadow_read_percent" {
+  description = "With db_backend = \"dualwrite\", percent of cart reads also read from DynamoDB in the background and compared with MySQL (0 turns shadow reads off)"
+  type        = number
+  default     = 100
+}
+
+variable "order_queue_max_receives" {
+  description = "Deliveries of an order message before it is moved to the dead-letter queue"
+  type        = number
+  default     = 5
+}
+
 variable "environment" {
   description = "Environment name (e.g., dev, staging, prod)"
   type        = string
@@ -23,7 +23,7 @@ type result struct {
 }
 
 type createResp struct {
-	ShoppingCartID int64 `json:"shopping_cart_id"`
+	ShoppingCartID string `json:"shopping_cart_id"` // opaque string ID (see CartId in api.yaml)
 }
 
 // doReq 发起 HTTP 请求并返回状态码、耗时(ms)、响应体
@@ -90,7 +90,7 @@ func main() {
 
 	// 成功创建的 cartIDs
 	var cartIDsMu sync.Mutex
-	var cartIDs []int64
+	var cartIDs []string
 
 	// -------------------------
 	// Phase 1: 恰好 *createN 次 创建；每次创建内部可重试，但只记录一次最终结果
@@ -102,7 +102,7 @@ func main() {
 		var finalOK bool
 		var finalStatus int
 		var finalDur float64
-		var gotID int64
+		var gotID string
 
 		for attempt := 0; attempt <= *maxCreateRetries; attempt++ {
 			status, dur, b, err := doReq(ctx, client, http.MethodPost, url, map[string]any{"customer_id": 1})
@@ -110,7 +110,7 @@ func main() {
 			finalOK = (err == nil && status == 201)
 			if finalOK {
 				var cr createResp
-				if json.Unmarshal(b, &cr) == nil && cr.ShoppingCartID > 0 {
+				if json.Unmarshal(b, &cr) == nil && cr.ShoppingCartID != "" {
 					gotID = cr.ShoppingCartID
 					break
 				}
@@ -129,7 +129,7 @@ func main() {
 		// 这一次创建只记录 1 条（最终结果）
 		record("create_cart", finalStatus, finalDur, finalOK)
 
-		if finalOK && gotID > 0 {
+		if finalOK && gotID != "" {
 			cartIDsMu.Lock()
 			cartIDs = append(cartIDs, gotID)
 			cartIDsMu.Unlock()
@@ -138,7 +138,7 @@ func main() {
 	fmt.Println("Phase 1 done.")
 
 	// 如果一次都没成功，为保障 Phase2/3 可用，偷偷兜底创建 1 个（不计入 150）
-	var fallbackID int64
+	var fallbackID string
 	cartIDsMu.Lock()
 	needFallback := len(cartIDs) == 0
 	cartIDsMu.Unlock()
@@ -146,7 +146,7 @@ func main() {
 		status, _, b, err := doReq(ctx, client, http.MethodPost, fmt.Sprintf("%s/shopping-carts", *base), map[string]any{"customer_id": 1})
 		if err == nil && status == 201 {
 			var cr createResp
-			if json.Unmarshal(b, &cr) == nil && cr.ShoppingCartID > 0 {
+			if json.Unmarshal(b, &cr) == nil && cr.ShoppingCartID != "" {
 				fallbackID = cr.ShoppingCartID
 				fmt.Println("NOTE: created 1 fallback cart (not counted in 150 results).")
 			}
@@ -154,13 +154,13 @@ func main() {
 	}
 
 	// 取一个安全的 cart 取模函数
-	getCartID := func(i int) int64 {
+	getCartID := func(i int) string {
 		cartIDsMu.Lock()
 		defer cartIDsMu.Unlock()
 		if len(cartIDs) > 0 {
 			return cartIDs[i%len(cartIDs)]
 		}
-		// 如果没有成功创建过，使用兜底 ID（可能为 0，后续请求会得到 404，但仍计入操作）
+		// 如果没有成功创建过，使用兜底 ID（可能为空，后续请求会得到 404，但仍计入操作）
 		return fallbackID
 	}
 
@@ -170,11 +170,12 @@ func main() {
 	fmt.Printf("Phase 2: adding %d items...\n", *addN)
 	runConcurrent(ctx, *concurrency, *addN, func(i int) {
 		cid := getCartID(i)
+		// 合成 product_id：服务端需 CART_VALIDATE_PRODUCTS=false，或预先创建这些商品
 		body := map[string]any{
 			"product_id": 1000 + (i % 50),
 			"quantity":   1 + (i % 3),
 		}
-		url := fmt.Sprintf("%s/shopping-carts/%d/items", *base, cid)
+		url := fmt.Sprintf("%s/shopping-carts/%s/items", *base, cid)
 		status, dur, _, err := doReq(ctx, client, http.MethodPost, url, body)
 		ok := (err == nil && status == 204)
 		record("add_items", status, dur, ok)
@@ -187,7 +188,7 @@ func main() {
 	fmt.Printf("Phase 3: getting %d carts...\n", *getN)
 	runConcurrent(ctx, *concurrency, *getN, func(i int) {
 		cid := getCartID(i)
-		url := fmt.Sprintf("%s/shopping-carts/%d", *base, cid)
+		url := fmt.Sprintf("%s/shopping-carts/%s", *base, cid)
 		status, dur, _, err := doReq(ctx, client, http.MethodGet, url, nil)
 		ok := (err == nil && status == 200)
 		record("get_cart", status, dur, ok)